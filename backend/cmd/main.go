@@ -1,34 +1,177 @@
 package main
 
 import (
+	"backend/internal/audit"
 	"backend/internal/config"
 	api "backend/internal/http"
+	"backend/internal/logging"
+	"backend/internal/tracing"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds how long a graceful shutdown waits for requests in
+// flight.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 
 	// --------------------- LOAD CONFIG --------------------------
 
-	cfgPath := flag.String("config", "config.json", "Path to the config file")
+	cfgPath := flag.String("config", "config.json", "Comma-separated paths of the config files (.json, .yaml, .yml or .toml), later files overriding earlier ones")
+	verifyAuditLog := flag.String("verify-audit-log", "", "Verify the hash chain of an audit log file and exit")
+	checkConfig := flag.Bool("check-config", false, "Validate the config file, report every problem and exit")
+	printConfig := flag.Bool("print-config", false, "Print the effective config, with secrets redacted, and exit")
 	flag.Parse()
 
+	if *verifyAuditLog != "" {
+		verifyAuditLogFile(*verifyAuditLog)
+		return
+	}
+
 	if *cfgPath == "" {
 		log.Fatal("Please provide a config file path using the -config flag")
 	}
 
+	cfgPaths := strings.Split(*cfgPath, ",")
+
+	if *checkConfig {
+		checkConfigFile(cfgPaths)
+		return
+	}
+	if *printConfig {
+		printConfigFile(cfgPaths)
+		return
+	}
+
 	log.Printf("Loading configuration from %s", *cfgPath)
 
-	cfg, err := config.LoadFromFile(*cfgPath)
+	cfg, err := config.LoadFromFiles(cfgPaths...)
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
+	// From here on everything, including the standard log package, logs
+	// through the configured structured logger.
+	logger := logging.New(cfg.Logging, os.Stderr)
+	slog.SetDefault(logger)
+
 	// --------------------- SET UP SERVER --------------------------
-	serv := api.NewServer(cfg)
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Error setting up tracing: %v", err)
+	}
+	serv := api.NewServer(cfg, logger)
+
+	// Reload the config on SIGHUP so admin credentials can be rotated without
+	// downtime. A config that fails to load or validate is rejected and the
+	// running config is kept.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("reloading configuration", "config", *cfgPath)
+			newCfg, err := config.LoadFromFiles(cfgPaths...)
+			if err != nil {
+				logger.Error("error reloading config, keeping the current one", "error", err)
+				continue
+			}
+			serv.Reload(newCfg)
+		}
+	}()
+
+	// Stop gracefully on SIGINT and SIGTERM: finish the requests in flight
+	// and stop tracking issuance sessions.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		<-ctx.Done()
+		logger.Info("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := serv.Shutdown(ctx); err != nil {
+			logger.Error("error shutting down", "error", err)
+		}
+	}()
+
+	logger.Info("listening", "addr", cfg.App.Addr)
+	err = serv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+	}
+	// Export the spans that are still buffered before exiting.
+	if shutdownErr := shutdownTracing(context.Background()); shutdownErr != nil {
+		logger.Error("error shutting down tracing", "error", shutdownErr)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 
-	log.Printf("listening on %s", cfg.App.Addr)
-	log.Fatal(serv.ListenAndServe())
+}
 
+// checkConfigFile loads and validates the config at paths, with the
+// environment overrides applied, and exits non-zero listing every problem
+// when it is invalid.
+func checkConfigFile(paths []string) {
+	if _, err := config.LoadFromFiles(paths...); err != nil {
+		log.Printf("Config %s is invalid:", strings.Join(paths, ","))
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		for _, err := range errs {
+			log.Printf("  - %v", err)
+		}
+		os.Exit(1)
+	}
+	log.Printf("Config %s is valid", strings.Join(paths, ","))
+}
+
+// printConfigFile prints the config merged from paths, with the environment
+// overrides applied and secrets redacted, as JSON. It does not validate the
+// config, so it also helps to debug an invalid one.
+func printConfigFile(paths []string) {
+	cfg, err := config.ReadFiles(paths...)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	redacted, err := cfg.Redacted()
+	if err != nil {
+		log.Fatalf("Error redacting config: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(redacted); err != nil {
+		log.Fatalf("Error encoding config: %v", err)
+	}
+}
+
+// verifyAuditLogFile checks the hash chain of an audit log written by the file
+// sink and exits non-zero when it was tampered with.
+func verifyAuditLogFile(path string) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	n, err := audit.Verify(f)
+	if err != nil {
+		log.Fatalf("Audit log %s failed verification: %v", path, err)
+	}
+	log.Printf("Audit log %s verified: %d records", path, n)
 }
@@ -0,0 +1,187 @@
+// Package audit records security-relevant events (verification emails sent,
+// verifications, credential issuance and admin actions) as structured JSON
+// records in a dedicated sink.
+//
+// Every record carries a sequence number, the hash of the previous record and
+// its own hash, so records that are removed, reordered or modified after the
+// fact are detected by Verify. Email addresses are never written in clear
+// text: they are replaced by a keyed HMAC, which still lets operators
+// correlate events for the same address (and look up a given address when
+// they hold the key) without the log itself disclosing who verified.
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	EventEmailSent        = "email_sent"
+	EventVerifyCode       = "verify_code"
+	EventVerifyLink       = "verify_link"
+	EventCredentialIssued = "credential_issued"
+	EventAdminAction      = "admin_action"
+	EventAdminRejected    = "admin_rejected"
+)
+
+// Event outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event is a single audit record.
+type Event struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Outcome is OutcomeSuccess or OutcomeFailure.
+	Outcome string `json:"outcome"`
+	// Actor identifies the admin credential behind an admin action.
+	Actor string `json:"actor,omitempty"`
+	// Email is the address the event concerns. It is never written; the
+	// logger replaces it by its pseudonym in Subject.
+	Email   string `json:"-"`
+	Subject string `json:"subject,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	// Reason is an error code explaining a failure.
+	Reason  string            `json:"reason,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	// PrevHash is the hash of the preceding record, empty for the first.
+	PrevHash string `json:"prev_hash"`
+	// Hash is the hex SHA-256 of the record as serialised without this field.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Sink stores serialised audit records, one JSON object each.
+type Sink interface {
+	Write(record []byte) error
+	Close() error
+}
+
+// lastRecorder is implemented by sinks that can read back their most recent
+// record, so the hash chain continues across restarts.
+type lastRecorder interface {
+	LastRecord() ([]byte, error)
+}
+
+// Logger writes hash-chained events to a sink. A nil *Logger discards every
+// event, so callers do not need to check whether auditing is enabled.
+type Logger struct {
+	sink         Sink
+	pseudonymKey []byte
+	now          func() time.Time
+
+	mu       sync.Mutex
+	seq      uint64
+	prevHash string
+}
+
+// NewLogger returns a Logger writing to sink. When the sink can read back its
+// last record, the chain continues from it.
+func NewLogger(sink Sink, pseudonymKey []byte) (*Logger, error) {
+	l := &Logger{sink: sink, pseudonymKey: pseudonymKey, now: time.Now}
+
+	lr, ok := sink.(lastRecorder)
+	if !ok {
+		return l, nil
+	}
+	last, err := lr.LastRecord()
+	if err != nil {
+		return nil, fmt.Errorf("could not read last audit record: %w", err)
+	}
+	if last != nil {
+		var ev Event
+		if err := json.Unmarshal(last, &ev); err != nil {
+			return nil, fmt.Errorf("could not parse last audit record: %w", err)
+		}
+		l.seq, l.prevHash = ev.Seq, ev.Hash
+	}
+	return l, nil
+}
+
+// Pseudonymise returns the keyed pseudonym used for email in audit records.
+func (l *Logger) Pseudonymise(email string) string {
+	mac := hmac.New(sha256.New, l.pseudonymKey)
+	mac.Write([]byte(email))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record appends ev to the chain. A failure to write is logged but does not
+// fail the request that caused the event; the chain then continues from the
+// last record that was written.
+func (l *Logger) Record(ev Event) {
+	if l == nil {
+		return
+	}
+	if ev.Email != "" {
+		ev.Subject = l.Pseudonymise(ev.Email)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ev.Seq = l.seq + 1
+	ev.Time = l.now().UTC()
+	ev.PrevHash = l.prevHash
+	record, hash, err := seal(ev)
+	if err != nil {
+		slog.Error("audit: could not encode event", "type", ev.Type, "error", err)
+		return
+	}
+	if err := l.sink.Write(record); err != nil {
+		slog.Error("audit: could not write event", "type", ev.Type, "error", err)
+		return
+	}
+	l.seq, l.prevHash = ev.Seq, hash
+}
+
+// Close closes the underlying sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.sink.Close()
+}
+
+// seal serialises ev without its hash, hashes those bytes and appends the
+// hash as the final member of the object.
+func seal(ev Event) (record []byte, hash string, err error) {
+	ev.Hash = ""
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(body)
+	hash = hex.EncodeToString(sum[:])
+
+	record = append(body[:len(body)-1:len(body)-1], `,"hash":"`...)
+	record = append(record, hash...)
+	record = append(record, `"}`...)
+	return record, hash, nil
+}
+
+// hashMarker precedes the hash, which seal always writes last.
+var hashMarker = []byte(`,"hash":"`)
+
+// unseal splits a record into the serialised body that was hashed and the
+// recorded hash.
+func unseal(record []byte) (body []byte, hash string, err error) {
+	record = bytes.TrimSpace(record)
+	i := bytes.LastIndex(record, hashMarker)
+	if i < 0 || !bytes.HasSuffix(record, []byte(`"}`)) {
+		return nil, "", errors.New("record has no hash")
+	}
+	body = append(append([]byte{}, record[:i]...), '}')
+	hash = string(record[i+len(hashMarker) : len(record)-2])
+	return body, hash, nil
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func writeEvents(t *testing.T, l *Logger, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		l.Record(Event{Type: EventEmailSent, Outcome: OutcomeSuccess, Email: "user@example.com", IP: "192.0.2.1"})
+	}
+}
+
+func TestFileSinkChainVerifies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+	l, err := NewLogger(sink, testKey)
+	require.NoError(t, err)
+	writeEvents(t, l, 3)
+	require.NoError(t, l.Close())
+
+	// A restarted logger continues the chain of the existing file.
+	sink, err = NewFileSink(path)
+	require.NoError(t, err)
+	l, err = NewLogger(sink, testKey)
+	require.NoError(t, err)
+	writeEvents(t, l, 2)
+	require.NoError(t, l.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	n, err := Verify(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	require.NotContains(t, string(data), "user@example.com")
+	require.Contains(t, string(data), l.Pseudonymise("user@example.com"))
+	require.Contains(t, string(data), `"seq":5`)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&writerSink{&buf}, testKey)
+	require.NoError(t, err)
+	writeEvents(t, l, 4)
+	lines := strings.SplitAfter(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 4)
+
+	modified := strings.Replace(buf.String(), `"outcome":"success"`, `"outcome":"failure"`, 1)
+	_, err = Verify(strings.NewReader(modified))
+	require.ErrorContains(t, err, "record 1: hash mismatch")
+
+	removed := lines[0] + lines[2] + lines[3]
+	_, err = Verify(strings.NewReader(removed))
+	require.ErrorContains(t, err, "chain broken")
+
+	reordered := lines[0] + lines[2] + lines[1] + lines[3]
+	_, err = Verify(strings.NewReader(reordered))
+	require.ErrorContains(t, err, "chain broken")
+
+	// A suffix of the log (e.g. after rotation) still verifies.
+	n, err := Verify(strings.NewReader(lines[2] + lines[3]))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+}
+
+func TestPseudonymDependsOnKey(t *testing.T) {
+	a, err := NewLogger(&writerSink{&bytes.Buffer{}}, testKey)
+	require.NoError(t, err)
+	b, err := NewLogger(&writerSink{&bytes.Buffer{}}, []byte("another key, also 32 characters!"))
+	require.NoError(t, err)
+
+	require.Equal(t, a.Pseudonymise("user@example.com"), a.Pseudonymise("user@example.com"))
+	require.NotEqual(t, a.Pseudonymise("user@example.com"), a.Pseudonymise("other@example.com"))
+	require.NotEqual(t, a.Pseudonymise("user@example.com"), b.Pseudonymise("user@example.com"))
+}
+
+func TestNilLoggerDiscardsEvents(t *testing.T) {
+	var l *Logger
+	l.Record(Event{Type: EventEmailSent})
+	require.NoError(t, l.Close())
+}
+
+func TestRedisStreamSinkResumesChain(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	l, err := NewLogger(NewRedisStreamSink(client, "ns:audit"), testKey)
+	require.NoError(t, err)
+	writeEvents(t, l, 2)
+
+	l, err = NewLogger(NewRedisStreamSink(client, "ns:audit"), testKey)
+	require.NoError(t, err)
+	writeEvents(t, l, 1)
+
+	msgs, err := client.XRange(t.Context(), "ns:audit", "-", "+").Result()
+	require.NoError(t, err)
+	var records bytes.Buffer
+	for _, msg := range msgs {
+		records.WriteString(msg.Values["event"].(string) + "\n")
+	}
+	n, err := Verify(&records)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+}
+
+// writerSink writes records as lines to an io.Writer.
+type writerSink struct{ buf *bytes.Buffer }
+
+func (s *writerSink) Write(record []byte) error {
+	s.buf.Write(append(record, '\n'))
+	return nil
+}
+
+func (s *writerSink) Close() error { return nil }
@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FileSink appends records as JSON lines to a file.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(filepath.Clean(path), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log %q: %w", path, err)
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A single write per record, so concurrent writers appending to the same
+	// file (O_APPEND) never interleave within a line.
+	_, err := s.file.Write(append(record, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// LastRecord returns the last line of the file, or nil when it is empty.
+func (s *FileSink) LastRecord() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Records are small; the last one is well within the final 64 KiB.
+	size := info.Size()
+	offset := max(size-64*1024, 0)
+	tail := make([]byte, size-offset)
+	if _, err := s.file.ReadAt(tail, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	return tail[bytes.LastIndexByte(tail, '\n')+1:], nil
+}
+
+func (s *FileSink) Close() error { return s.file.Close() }
+
+// SyslogSink sends records to a syslog daemon. An empty network and address
+// use the local syslog socket. Syslog cannot be read back, so the hash chain
+// starts afresh every time the process starts.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(network, addr string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "email-issuer-audit")
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %w", err)
+	}
+	return &SyslogSink{writer: w}, nil
+}
+
+func (s *SyslogSink) Write(record []byte) error {
+	return s.writer.Info(string(record))
+}
+
+func (s *SyslogSink) Close() error { return s.writer.Close() }
+
+// RedisStreamSink appends records to a Redis stream, each entry holding the
+// record in its "event" field.
+type RedisStreamSink struct {
+	client *redis.Client
+	stream string
+}
+
+func NewRedisStreamSink(client *redis.Client, stream string) *RedisStreamSink {
+	return &RedisStreamSink{client: client, stream: stream}
+}
+
+func (s *RedisStreamSink) Write(record []byte) error {
+	return s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]any{"event": record},
+	}).Err()
+}
+
+// LastRecord returns the newest entry of the stream, or nil when it is empty.
+func (s *RedisStreamSink) LastRecord() ([]byte, error) {
+	msgs, err := s.client.XRevRangeN(context.Background(), s.stream, "+", "-", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	record, ok := msgs[0].Values["event"].(string)
+	if !ok {
+		return nil, fmt.Errorf("stream entry %s has no event field", msgs[0].ID)
+	}
+	return []byte(record), nil
+}
+
+// Close does not close the client, which is shared with the rest of the
+// server.
+func (s *RedisStreamSink) Close() error { return nil }
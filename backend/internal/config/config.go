@@ -1,19 +1,23 @@
 package config
 
 import (
-	"crypto/rsa"
+	"backend/internal/validators"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
-
-	"github.com/golang-jwt/jwt/v4"
 )
 
 type Config struct {
@@ -22,18 +26,130 @@ type Config struct {
 	JWT           JWTConfig           `json:"jwt"`
 	RedisSentinel RedisSentinelConfig `json:"redis_sentinel"`
 	Redis         RedisConfig         `json:"redis"`
+	Audit         AuditConfig         `json:"audit,omitempty"`
+	Tracing       TracingConfig       `json:"tracing,omitempty"`
+	Logging       LoggingConfig       `json:"logging,omitempty"`
+	Readiness     ReadinessConfig     `json:"readiness,omitempty"`
+}
+
+// ReadinessConfig configures the dependency checks of /api/ready.
+type ReadinessConfig struct {
+	// CheckSMTP adds a check that connects to the SMTP server and reads its
+	// greeting. Off by default, as the SMTP server may rate limit or log
+	// such connections.
+	CheckSMTP bool `json:"check_smtp,omitempty"`
+	// CacheTTL is how long a result is reused, so frequent probes do not
+	// hit the dependencies each time. Defaults to DefaultReadinessCacheTTL.
+	CacheTTL JSONDuration `json:"cache_ttl,omitempty"`
+}
+
+const DefaultReadinessCacheTTL = 5 * time.Second
+
+// CacheTTLOrDefault returns the configured cache TTL or the default.
+func (c ReadinessConfig) CacheTTLOrDefault() time.Duration {
+	if c.CacheTTL == 0 {
+		return DefaultReadinessCacheTTL
+	}
+	return time.Duration(c.CacheTTL)
 }
+
+// LoggingConfig configures the application log.
+type LoggingConfig struct {
+	// Level is one of "debug", "info", "warn" or "error". Defaults to "info".
+	Level string `json:"level,omitempty"`
+	// Format is "text" or "json". Defaults to "text".
+	Format string `json:"format,omitempty"`
+	// Redact masks email addresses and replaces verification codes and
+	// tokens in log lines. Defaults to true; only disable it for local
+	// development.
+	Redact *bool `json:"redact,omitempty"`
+}
+
+// RedactOrDefault reports whether log lines are redacted.
+func (c LoggingConfig) RedactOrDefault() bool {
+	return c.Redact == nil || *c.Redact
+}
+
+// TracingConfig configures OpenTelemetry tracing. Spans are exported over
+// OTLP/HTTP to Endpoint; an empty endpoint disables the exporter.
+type TracingConfig struct {
+	// Endpoint is the URL traces are posted to, e.g.
+	// "http://otel-collector:4318/v1/traces".
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, e.g. to authenticate with the
+	// collector.
+	Headers map[string]string `json:"headers,omitempty" secret:"true"`
+	// ServiceName is reported as service.name. Defaults to
+	// DefaultTracingServiceName.
+	ServiceName string `json:"service_name,omitempty"`
+	// SampleRatio is the fraction of traces that is sampled, including those
+	// continued from an incoming request that the caller sampled. Defaults
+	// to 1.
+	SampleRatio *float64 `json:"sample_ratio,omitempty"`
+}
+
+const DefaultTracingServiceName = "email-issuer"
+
+// ServiceNameOrDefault returns the configured service name or the default.
+func (c TracingConfig) ServiceNameOrDefault() string {
+	if c.ServiceName == "" {
+		return DefaultTracingServiceName
+	}
+	return c.ServiceName
+}
+
+// SampleRatioOrDefault returns the configured sample ratio or 1.
+func (c TracingConfig) SampleRatioOrDefault() float64 {
+	if c.SampleRatio == nil {
+		return 1
+	}
+	return *c.SampleRatio
+}
+
+// AuditConfig configures the audit log of sends, verifications, credential
+// issuance and admin actions. Sink is one of "file", "syslog" or "redis"; an
+// empty sink disables the audit log.
+type AuditConfig struct {
+	Sink     string `json:"sink,omitempty"`
+	FilePath string `json:"file_path,omitempty"`
+	// SyslogNetwork and SyslogAddr select a remote syslog daemon (e.g. "udp"
+	// and "logs.internal:514"). When empty the local syslog socket is used.
+	SyslogNetwork string `json:"syslog_network,omitempty"`
+	SyslogAddr    string `json:"syslog_addr,omitempty"`
+	// RedisStream is the stream the redis sink appends to, within the Redis
+	// namespace. Defaults to DefaultAuditRedisStream.
+	RedisStream string `json:"redis_stream,omitempty"`
+	// PseudonymKey keys the HMAC that replaces email addresses in audit
+	// records. Keep it secret: anyone holding it can test whether a given
+	// address appears in the log.
+	PseudonymKey string `json:"pseudonym_key,omitempty" secret:"true"`
+}
+
+const (
+	DefaultAuditRedisStream = "audit"
+	// MinAuditPseudonymKeyLength is the minimum length of audit.pseudonym_key.
+	MinAuditPseudonymKeyLength = 32
+)
+
+// RedisStreamOrDefault returns the configured stream name or the default.
+func (c AuditConfig) RedisStreamOrDefault() string {
+	if c.RedisStream == "" {
+		return DefaultAuditRedisStream
+	}
+	return c.RedisStream
+}
+
 type RedisConfig struct {
 	Host      string `json:"host"`
 	Port      int    `json:"port"`
-	Password  string `json:"password"`
+	Password  string `json:"password" secret:"true"`
 	Namespace string `json:"namespace"`
 }
 
 type RedisSentinelConfig struct {
 	SentinelHost     string `json:"sentinel_host"`
 	SentinelPort     int    `json:"sentinel_port"`
-	Password         string `json:"password"`
+	Password         string `json:"password" secret:"true"`
 	MasterName       string `json:"master_name"`
 	SentinelUsername string `json:"sentinel_username"`
 	Namespace        string `json:"sentinel_namespace"`
@@ -55,9 +171,202 @@ type AppConfig struct {
 	// and the connection's remote address is always used.
 	TrustedProxies []string `json:"trusted_proxies,omitempty"`
 	// AdminToken guards the admin endpoints (e.g. resetting a rate limit for an
-	// email address). When empty, those endpoints are disabled.
-	AdminToken string `json:"admin_token,omitempty"`
+	// email address). It acts as a single credential named "admin_token" with
+	// every scope. Prefer AdminCredentials, which are stored hashed and can be
+	// scoped. When neither is set, the admin endpoints are disabled.
+	AdminToken string `json:"admin_token,omitempty" secret:"true"`
+	// AdminCredentials lists named admin tokens, each with its own scopes. The
+	// name is recorded in the audit log of every admin action.
+	AdminCredentials []AdminCredential `json:"admin_credentials,omitempty"`
+	// AdminAddr, when set, moves the admin endpoints off the public router
+	// onto a separate plain-HTTP listener at this address (together with the
+	// health check). Bind it to localhost or an internal interface.
+	AdminAddr string `json:"admin_addr,omitempty"`
+	// AdminTLSCertPath and AdminTLSKeyPath make the admin listener serve
+	// HTTPS. They are required for AdminClientCerts.
+	AdminTLSCertPath string `json:"admin_tls_cert_path,omitempty"`
+	AdminTLSKeyPath  string `json:"admin_tls_key_path,omitempty"`
+	// AdminClientCerts authorizes admin requests by TLS client certificate.
+	AdminClientCerts *AdminClientCertConfig `json:"admin_client_certs,omitempty"`
+	// AdminJWT authorizes admin requests by JWT bearer access token.
+	AdminJWT *AdminJWTConfig `json:"admin_jwt,omitempty"`
+	// IPAggregation controls how client addresses are grouped before they are
+	// used as per-IP rate-limit keys. See IPAggregationConfig.
+	IPAggregation IPAggregationConfig `json:"ip_aggregation,omitempty"`
+	// IPPrefixLimits assigns a dedicated limit to specific address ranges, for
+	// example a large carrier-grade NAT where many legitimate users share a few
+	// addresses. Every address within such a range shares a single counter.
+	IPPrefixLimits []IPPrefixLimitConfig `json:"ip_prefix_limits,omitempty"`
+	// AllowedEmailDomains, when non-empty, restricts verification to email
+	// addresses at these domains. DeniedEmailDomains rejects addresses at
+	// these domains and takes precedence over the allow list. Entries are an
+	// exact domain ("example.com") or a wildcard matching every subdomain
+	// ("*.example.com").
+	AllowedEmailDomains []string `json:"allowed_email_domains,omitempty"`
+	DeniedEmailDomains  []string `json:"denied_email_domains,omitempty"`
+	// RouteRateLimits limits how often a single client IP may call individual
+	// routes, keyed by route path (e.g. "/api/verify"). When absent,
+	// DefaultRouteRateLimits applies; an empty object disables route limits.
+	RouteRateLimits map[string]RouteRateLimitConfig `json:"route_rate_limits,omitempty"`
+	// RateLimitBypass exempts trusted clients (QA environments, partner
+	// integrations) from the send rate limits. Every bypassed request is
+	// logged.
+	RateLimitBypass RateLimitBypassConfig `json:"rate_limit_bypass,omitempty"`
+	// MaxLinkTokensPerEmail is how many verification links per email address
+	// stay valid at once. Sending a new verification email revokes the oldest
+	// links beyond this number. Zero selects DefaultMaxLinkTokensPerEmail.
+	MaxLinkTokensPerEmail int `json:"max_link_tokens_per_email,omitempty"`
+	// AllowCrossDeviceLink lets a verification link be opened in a different
+	// browser than the one that requested it, e.g. on a phone. Verification
+	// codes are always bound to the requesting browser.
+	AllowCrossDeviceLink bool `json:"allow_cross_device_link,omitempty"`
+}
+
+// DefaultMaxLinkTokensPerEmail keeps only the link of the most recent
+// verification email valid.
+const DefaultMaxLinkTokensPerEmail = 1
+
+// MaxLinkTokensPerEmailOrDefault returns the configured maximum number of
+// valid verification links per email address, or
+// DefaultMaxLinkTokensPerEmail when unset.
+func (c AppConfig) MaxLinkTokensPerEmailOrDefault() int {
+	if c.MaxLinkTokensPerEmail == 0 {
+		return DefaultMaxLinkTokensPerEmail
+	}
+	return c.MaxLinkTokensPerEmail
+}
+
+// RateLimitBypassConfig lists the clients exempt from rate limiting. CIDRs
+// accepts ranges or bare IP addresses; EmailDomains accepts exact domains or
+// "*.example.com" wildcards.
+type RateLimitBypassConfig struct {
+	CIDRs        []string `json:"cidrs,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	EmailDomains []string `json:"email_domains,omitempty"`
+}
+
+// RouteRateLimitConfig allows Limit requests per client IP within Window.
+type RouteRateLimitConfig struct {
+	Limit  int          `json:"limit"`
+	Window JSONDuration `json:"window"`
+}
+
+// DefaultRouteRateLimits protects the endpoints that redeem a verification
+// code or link token, so guessing them is not free. The limits are generous
+// enough for users sharing an address.
+func DefaultRouteRateLimits() map[string]RouteRateLimitConfig {
+	verify := RouteRateLimitConfig{Limit: 20, Window: JSONDuration(15 * time.Minute)}
+	return map[string]RouteRateLimitConfig{
+		"/api/verify":               verify,
+		"/api/verify-link":          verify,
+		"/api/done":                 verify,
+		"/api/embedded/verify":      verify,
+		"/api/embedded/verify-link": verify,
+	}
+}
+
+// RouteRateLimitsOrDefault returns the configured route limits, or
+// DefaultRouteRateLimits when none are configured.
+func (c AppConfig) RouteRateLimitsOrDefault() map[string]RouteRateLimitConfig {
+	if c.RouteRateLimits == nil {
+		return DefaultRouteRateLimits()
+	}
+	return c.RouteRateLimits
+}
+
+// AdminCredential is a named admin bearer token. Only the hex-encoded SHA-256
+// hash of the token is configured, so the config file never holds the token
+// itself. Generate a token with e.g. `openssl rand -hex 32` and hash it with
+// `printf %s "$TOKEN" | sha256sum`.
+type AdminCredential struct {
+	Name        string   `json:"name"`
+	TokenSHA256 string   `json:"token_sha256"`
+	Scopes      []string `json:"scopes"`
+}
+
+// Admin scopes. Each admin endpoint requires one of them.
+const (
+	ScopeRateLimitReset = "ratelimit:reset"
+	ScopeTokensRevoke   = "tokens:revoke"
+	ScopeStatsRead      = "stats:read"
+)
+
+// AdminScopes lists every known admin scope.
+var AdminScopes = []string{ScopeRateLimitReset, ScopeTokensRevoke, ScopeStatsRead}
+
+// AdminClientCertConfig authorizes admin requests that present a client
+// certificate issued by the CA in CAPath. Only certificates whose subject is
+// listed in Subjects are accepted, with that entry's scopes.
+type AdminClientCertConfig struct {
+	CAPath   string             `json:"ca_path"`
+	Subjects []AdminCertSubject `json:"subjects"`
+}
+
+// AdminCertSubject maps a client certificate subject, in the RFC 2253 form
+// produced by Go (e.g. "CN=ops-alice,O=Yivi"), to an audit name and scopes.
+type AdminCertSubject struct {
+	Name    string   `json:"name"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+}
+
+// AdminJWTConfig authorizes admin requests carrying a JWT access token as
+// bearer token. Tokens must be signed by a key in the local JWKS file at
+// JWKSPath and carry the configured issuer and audience. Scopes are read from
+// the space-separated "scope" claim (or the "scp" array), and the "sub"
+// claim is recorded in the audit log.
+type AdminJWTConfig struct {
+	JWKSPath string `json:"jwks_path"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+// LegacyAdminCredentialName is the audit name of the credential derived from
+// AdminToken.
+const LegacyAdminCredentialName = "admin_token"
+
+// IPAggregationConfig sets the prefix length client addresses are truncated to
+// before they are rate limited. A single IPv6 user is usually handed a whole
+// /64, so limiting on the exact address lets them rotate through it and bypass
+// the per-IP limit. A zero value selects the default (DefaultIPv4Prefix /
+// DefaultIPv6Prefix).
+type IPAggregationConfig struct {
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// IPPrefixLimitConfig overrides the per-IP limit for one address range.
+type IPPrefixLimitConfig struct {
+	CIDR  string `json:"cidr"`
+	Limit int    `json:"limit"`
+}
+
+const (
+	// DefaultIPv4Prefix keys IPv4 clients on their full address.
+	DefaultIPv4Prefix = 32
+	// DefaultIPv6Prefix keys IPv6 clients on their /64, the smallest subnet
+	// normally assigned to a single end site.
+	DefaultIPv6Prefix = 64
+)
+
+// IPv4PrefixOrDefault returns the configured IPv4 aggregation prefix, or
+// DefaultIPv4Prefix when unset.
+func (c IPAggregationConfig) IPv4PrefixOrDefault() int {
+	if c.IPv4Prefix == 0 {
+		return DefaultIPv4Prefix
+	}
+	return c.IPv4Prefix
 }
+
+// IPv6PrefixOrDefault returns the configured IPv6 aggregation prefix, or
+// DefaultIPv6Prefix when unset.
+func (c IPAggregationConfig) IPv6PrefixOrDefault() int {
+	if c.IPv6Prefix == 0 {
+		return DefaultIPv6Prefix
+	}
+	return c.IPv6Prefix
+}
+
 type MailTemplate struct {
 	Subject     string `json:"mail_subject"`
 	TemplateDir string `json:"mail_template_dir"`
@@ -66,7 +375,7 @@ type MailTemplate struct {
 type MailConfig struct {
 	Host          string                  `json:"mail_host"`
 	User          string                  `json:"mail_user"`
-	Password      string                  `json:"mail_password"`
+	Password      string                  `json:"mail_password" secret:"true"`
 	Port          int                     `json:"mail_port"`
 	From          string                  `json:"mail_from"`
 	SenderName    string                  `json:"mail_sender_name"`
@@ -74,89 +383,573 @@ type MailConfig struct {
 	MailTemplates map[string]MailTemplate `json:"mail_templates"`
 }
 
+// EmailCredentialAttributes maps the values derived from a verified email
+// address to the attribute names of a credential. An empty name means the
+// value is not issued.
 type EmailCredentialAttributes struct {
 	Email       string `json:"email"`
 	EmailDomain string `json:"email_domain"`
+	// LocalPart is the part of the address before the "@".
+	LocalPart string `json:"local_part,omitempty"`
+	// VerifiedAt is the time of verification in Unix seconds.
+	VerifiedAt string `json:"verified_at,omitempty"`
+}
+
+// Names returns the configured attribute names.
+func (a EmailCredentialAttributes) Names() []string {
+	var names []string
+	for _, name := range []string{a.Email, a.EmailDomain, a.LocalPart, a.VerifiedAt} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+const (
+	// DefaultSdJwtBatchSize is the number of SD-JWT instances issued per
+	// credential when BatchSize is not set.
+	DefaultSdJwtBatchSize = 200
+	// MaxSdJwtBatchSize is the largest batch the IRMA server accepts
+	// (irma.MaxSdJwtIssueAmount).
+	MaxSdJwtBatchSize = 200
+
+	// DefaultCredentialValidity is the validity the IRMA server gives a
+	// credential when the issuance request does not set one.
+	DefaultCredentialValidity = 6 * 30 * 24 * time.Hour
+	// MinCredentialValidity is the shortest validity that can be configured.
+	// IRMA rounds expiry dates down to whole weeks, so anything shorter could
+	// produce a credential that is expired on issuance.
+	MinCredentialValidity = 2 * 7 * 24 * time.Hour
+)
+
+// CredentialConfig describes one credential the service can issue. Name is
+// what clients pass to select it; Credential is the full credential type ID,
+// e.g. "pbdf.sidn-pbdf.email".
+type CredentialConfig struct {
+	Name       string                    `json:"name"`
+	Credential string                    `json:"full_credential"`
+	Attributes EmailCredentialAttributes `json:"attributes"`
+	// BatchSize is the number of SD-JWT instances to issue, at most
+	// MaxSdJwtBatchSize. Zero selects DefaultSdJwtBatchSize.
+	BatchSize int `json:"batch_size,omitempty"`
+	// Validity is how long issued credentials are valid, at least
+	// MinCredentialValidity. Zero leaves it to the IRMA server, which uses
+	// DefaultCredentialValidity.
+	Validity JSONDuration `json:"validity,omitempty"`
+	// Revocation issues every credential with a revocation key, which is
+	// stored so the credential can be revoked later. The credential type must
+	// have revocation enabled in its scheme and on the IRMA server.
+	Revocation bool `json:"revocation,omitempty"`
+}
+
+// ValidityOrDefault returns the configured validity or the default.
+func (c CredentialConfig) ValidityOrDefault() time.Duration {
+	if c.Validity == 0 {
+		return DefaultCredentialValidity
+	}
+	return time.Duration(c.Validity)
+}
+
+// BatchSizeOrDefault returns the configured batch size or the default.
+func (c CredentialConfig) BatchSizeOrDefault() int {
+	if c.BatchSize == 0 {
+		return DefaultSdJwtBatchSize
+	}
+	return c.BatchSize
 }
 
 type JWTConfig struct {
-	IRMAServerURL  string                    `json:"irma_server_url"`
-	PrivateKeyPath string                    `json:"private_key_path"`
-	IssuerID       string                    `json:"issuer_id"`
-	CredentialType string                    `json:"credential_type"`
-	Credential     string                    `json:"full_credential"`
-	Attributes     EmailCredentialAttributes `json:"attributes"`
+	IRMAServerURL  string `json:"irma_server_url"`
+	PrivateKeyPath string `json:"private_key_path"`
+	// PrivateKeyEnv names an environment variable that holds the PEM
+	// private key, as is or base64 encoded. It replaces PrivateKeyPath.
+	PrivateKeyEnv string `json:"private_key_env,omitempty"`
+	// PrivateKeyPassphraseEnv names an environment variable that holds the
+	// passphrase of an encrypted private key.
+	PrivateKeyPassphraseEnv string `json:"private_key_passphrase_env,omitempty"`
+	// PKCS11 selects a private key held by a PKCS #11 token instead. It
+	// replaces PrivateKeyPath and PrivateKeyEnv.
+	PKCS11   *PKCS11Config `json:"pkcs11,omitempty"`
+	IssuerID string        `json:"issuer_id"`
+	// SigningAlgorithm overrides the JWT algorithm used with the private key,
+	// e.g. "PS256" for an RSA key. By default it follows from the key type
+	// (see SigningMethod).
+	SigningAlgorithm string `json:"signing_algorithm,omitempty"`
+	CredentialType   string `json:"credential_type"`
+	// Credential and Attributes describe a single credential. They are
+	// ignored when Credentials is set.
+	Credential string                    `json:"full_credential"`
+	Attributes EmailCredentialAttributes `json:"attributes"`
+	// Credentials lists the credentials that can be issued. The first one is
+	// issued when a client does not ask for a specific credential.
+	Credentials []CredentialConfig `json:"credentials,omitempty"`
+	// ServerSideSession makes the backend start the issuance session at
+	// IRMAServerURL and hand only the session pointer to the frontend,
+	// instead of the signed request. The backend then tracks whether the
+	// credential was actually issued.
+	ServerSideSession bool `json:"server_side_session,omitempty"`
 }
 
+// IRMAServerAlgorithm is the only JWT algorithm the IRMA server authenticates
+// requestors with, for session and revocation requests alike. Keys and
+// algorithms that produce anything else are rejected at load time, as every
+// request signed with them would fail.
+const IRMAServerAlgorithm = "RS256"
+
+// PKCS11Config selects the issuer key pair on a PKCS #11 token, such as a
+// hardware security module. It needs a build with the pkcs11 build tag.
+type PKCS11Config struct {
+	// Module is the path of the PKCS #11 library of the token.
+	Module     string `json:"module"`
+	TokenLabel string `json:"token_label"`
+	// PINEnv names an environment variable that holds the user PIN.
+	PINEnv string `json:"pin_env"`
+	// KeyLabel and KeyID select the key pair by its label and its
+	// hex-encoded ID. At least one of them is required.
+	KeyLabel string `json:"key_label,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+// CredentialsOrDefault returns the configured credentials, or a single
+// credential named "default" built from Credential and Attributes.
+func (c JWTConfig) CredentialsOrDefault() []CredentialConfig {
+	if len(c.Credentials) > 0 {
+		return c.Credentials
+	}
+	return []CredentialConfig{{Name: "default", Credential: c.Credential, Attributes: c.Attributes}}
+}
+
+// LoadFromFile loads and validates the config file at path. See
+// LoadFromFiles.
 func LoadFromFile(path string) (*Config, error) {
-	file, err := os.Open(path)
+	return LoadFromFiles(path)
+}
+
+// --- helpers ---
+
+// configErrors collects every problem found in a config, so they can all be
+// reported at once instead of one per start attempt.
+type configErrors []error
+
+func (e *configErrors) add(err error) {
 	if err != nil {
-		return nil, err
+		*e = append(*e, err)
+	}
+}
+
+func (e *configErrors) addf(format string, args ...any) {
+	*e = append(*e, fmt.Errorf(format, args...))
+}
+
+// validate checks cfg and returns all problems found, joined with
+// errors.Join.
+func validate(cfg *Config) error {
+	var errs configErrors
+	validateApp(cfg.App, &errs)
+	validateStorage(cfg, &errs)
+	validateMail(cfg.Mail, &errs)
+	validateJWT(cfg.JWT, &errs)
+	validateAdmin(cfg.App, &errs)
+	validateAudit(cfg, &errs)
+	validateTracing(cfg.Tracing, &errs)
+	validateLogging(cfg.Logging, &errs)
+	if cfg.Readiness.CacheTTL < 0 {
+		errs.addf("readiness.cache_ttl must not be negative")
+	}
+	return errors.Join(errs...)
+}
+
+// rateLimitCountKeys are the limits app.rate_limit_count may set.
+var rateLimitCountKeys = []string{"email", "ip", "domain"}
+
+func validateApp(app AppConfig, errs *configErrors) {
+	if app.Addr == "" {
+		errs.addf("app.addr is required")
+	} else if _, _, err := net.SplitHostPort(app.Addr); err != nil {
+		errs.addf("app.addr invalid: %w", err)
+	}
+	// Verification links are built from the base URL, so it must be
+	// absolute.
+	if u, err := url.Parse(app.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.addf("app.base_url must be an absolute http or https URL, got %q", app.BaseURL)
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("failed to close file: %v", err)
+	if app.UseTLS {
+		if app.TLSCertPath == "" || app.TLSPrivKeyPath == "" {
+			errs.addf("app.use_tls requires tls_cert_path and tls_priv_key_path")
+		} else if _, err := tls.LoadX509KeyPair(app.TLSCertPath, app.TLSPrivKeyPath); err != nil {
+			errs.addf("app.tls_cert_path and tls_priv_key_path: %w", err)
 		}
-	}()
+	}
 
-	var cfg Config
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-		return nil, err
+	for key, limit := range app.RateLimitCount {
+		if !slices.Contains(rateLimitCountKeys, key) {
+			errs.addf("app.rate_limit_count: unknown key %q, expected one of %s", key, strings.Join(rateLimitCountKeys, ", "))
+		} else if limit < 0 {
+			errs.addf("app.rate_limit_count %s must not be negative: %d", key, limit)
+		}
 	}
 
-	if err := validate(&cfg); err != nil {
-		return nil, err
+	// Fail fast on a malformed trusted-proxy list rather than silently
+	// ignoring proxy headers at runtime.
+	if _, err := ParseTrustedProxies(app.TrustedProxies); err != nil {
+		errs.add(err)
 	}
 
-	return &cfg, nil
-}
+	// IP aggregation and per-range limits.
+	if n := app.MaxLinkTokensPerEmail; n < 0 {
+		errs.addf("max_link_tokens_per_email must not be negative: %d", n)
+	}
+	if p := app.IPAggregation.IPv4Prefix; p < 0 || p > 32 {
+		errs.addf("ip_aggregation.ipv4_prefix out of range: %d", p)
+	}
+	if p := app.IPAggregation.IPv6Prefix; p < 0 || p > 128 {
+		errs.addf("ip_aggregation.ipv6_prefix out of range: %d", p)
+	}
+	for _, pl := range app.IPPrefixLimits {
+		if _, err := ParseCIDR(pl.CIDR); err != nil {
+			errs.addf("invalid ip_prefix_limits CIDR %q: %w", pl.CIDR, err)
+		}
+		if pl.Limit <= 0 {
+			errs.addf("ip_prefix_limits limit for %q must be positive", pl.CIDR)
+		}
+	}
 
-// --- helpers ---
+	// Per-route limits.
+	for route, rl := range app.RouteRateLimits {
+		if !strings.HasPrefix(route, "/") {
+			errs.addf("route_rate_limits route %q must start with /", route)
+		}
+		if rl.Limit <= 0 {
+			errs.addf("route_rate_limits limit for %q must be positive", route)
+		}
+		if rl.Window <= 0 {
+			errs.addf("route_rate_limits window for %q must be positive", route)
+		}
+	}
 
-func validate(cfg *Config) error {
+	// Rate-limit bypass list.
+	for _, entry := range app.RateLimitBypass.CIDRs {
+		if _, err := ParseCIDR(entry); err != nil {
+			errs.addf("invalid rate_limit_bypass CIDR %q: %w", entry, err)
+		}
+	}
+	for _, email := range app.RateLimitBypass.Emails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			errs.addf("invalid rate_limit_bypass email %q: %w", email, err)
+		}
+	}
+	for _, pattern := range app.RateLimitBypass.EmailDomains {
+		if err := validators.ValidateDomainPattern(pattern); err != nil {
+			errs.addf("invalid rate_limit_bypass email domain: %w", err)
+		}
+	}
 
-	// Mail
-	if cfg.Mail.Host == "" {
-		return errors.New("SMTP_HOST is required")
+	// Email domain allow/deny lists.
+	for _, pattern := range append(append([]string{}, app.AllowedEmailDomains...), app.DeniedEmailDomains...) {
+		errs.add(validators.ValidateDomainPattern(pattern))
 	}
-	if cfg.Mail.Port <= 0 || cfg.Mail.Port > 65535 {
-		return fmt.Errorf("SMTP_PORT out of range: %d", cfg.Mail.Port)
+}
+
+func validateStorage(cfg *Config, errs *configErrors) {
+	switch cfg.App.StorageType {
+	case "inmemory", "memory":
+	case "redis":
+		if cfg.Redis.Host == "" {
+			errs.addf("redis.host is required for storage_type redis")
+		}
+		if cfg.Redis.Port <= 0 || cfg.Redis.Port > 65535 {
+			errs.addf("redis.port out of range: %d", cfg.Redis.Port)
+		}
+	case "redis_sentinel":
+		if cfg.RedisSentinel.SentinelHost == "" {
+			errs.addf("redis_sentinel.sentinel_host is required for storage_type redis_sentinel")
+		}
+		if p := cfg.RedisSentinel.SentinelPort; p <= 0 || p > 65535 {
+			errs.addf("redis_sentinel.sentinel_port out of range: %d", p)
+		}
+		if cfg.RedisSentinel.MasterName == "" {
+			errs.addf("redis_sentinel.master_name is required for storage_type redis_sentinel")
+		}
+	default:
+		errs.addf("app.storage_type must be inmemory, redis or redis_sentinel, got %q", cfg.App.StorageType)
+	}
+}
+
+func validateMail(m MailConfig, errs *configErrors) {
+	if m.Host == "" {
+		errs.addf("mail.mail_host is required")
+	}
+	if m.Port <= 0 || m.Port > 65535 {
+		errs.addf("mail.mail_port out of range: %d", m.Port)
 	}
-	if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
-		return fmt.Errorf("SMTP_FROM invalid: %w", err)
+	if _, err := mail.ParseAddress(m.From); err != nil {
+		errs.addf("mail.mail_from invalid: %w", err)
 	}
 
-	// Yivi issuance session JWT
-	//
+	// Emails in other languages fall back to English.
+	if _, ok := m.MailTemplates["en"]; !ok {
+		errs.addf("mail.mail_templates must contain an \"en\" template")
+	}
+	for lang, tmpl := range m.MailTemplates {
+		if tmpl.Subject == "" {
+			errs.addf("mail.mail_templates.%s.mail_subject is required", lang)
+		}
+		if tmpl.TemplateDir == "" {
+			errs.addf("mail.mail_templates.%s.mail_template_dir is required", lang)
+		} else if _, err := os.Stat(tmpl.TemplateDir); err != nil {
+			errs.addf("mail.mail_templates.%s.mail_template_dir: %w", lang, err)
+		}
+	}
+}
+
+func validateJWT(j JWTConfig, errs *configErrors) {
 	// The private key is mandatory: every issuance request signs a JWT with
 	// it, so a missing path makes the service non-functional. Reject an empty
 	// path at startup rather than letting the service boot and 500 on the
 	// first issuance request.
-	if cfg.JWT.PrivateKeyPath == "" {
-		return errors.New("PRIVATE_KEY_PATH is required")
+	sources := 0
+	for _, set := range []bool{j.PrivateKeyPath != "", j.PrivateKeyEnv != "", j.PKCS11 != nil} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0:
+		errs.addf("jwt.private_key_path is required unless jwt.private_key_env or jwt.pkcs11 is set")
+	case sources > 1:
+		errs.addf("set only one of jwt.private_key_path, jwt.private_key_env and jwt.pkcs11")
+	default:
+		if j.PKCS11 != nil && !validPKCS11(*j.PKCS11, errs) {
+			break
+		}
+		// Fully parse the key at startup so an unreadable or unsupported key
+		// file, or an algorithm that does not fit the key, fails fast with a
+		// clear error instead of only surfacing when the first issuance
+		// request is handled.
+		key, err := LoadSigner(j)
+		if err != nil {
+			errs.add(err)
+		} else if method, err := SigningMethod(key, j.SigningAlgorithm); err != nil {
+			errs.addf("jwt.signing_algorithm: %w", err)
+		} else if method.Alg() != IRMAServerAlgorithm {
+			errs.addf("jwt: the IRMA server only accepts %s requestor JWTs, so use an RSA key and leave jwt.signing_algorithm unset (got %s)",
+				IRMAServerAlgorithm, method.Alg())
+		}
+	}
+	if j.IssuerID == "" {
+		errs.addf("jwt.issuer_id is required")
 	}
-	// Fully parse the key at startup so an unreadable or non-RSA (e.g. ECDSA)
-	// key file fails fast with a clear error instead of only surfacing when
-	// the first issuance request is handled.
-	if _, err := LoadRSAPrivateKey(cfg.JWT.PrivateKeyPath); err != nil {
-		return err
+	if j.IRMAServerURL != "" {
+		if u, err := url.Parse(j.IRMAServerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.addf("jwt.irma_server_url must be an absolute http or https URL, got %q", j.IRMAServerURL)
+		}
+	}
+	if len(j.Credentials) > 0 {
+		validateCredentials(j.Credentials, j.IRMAServerURL, errs)
+	} else {
+		// The single credential configured by full_credential and
+		// attributes.
+		validateCredentialIdentifiers("jwt", j.Credential, j.Attributes, errs)
 	}
-	if cfg.JWT.IssuerID == "" {
-		return errors.New("ISSUER_ID is required")
+	if j.ServerSideSession && j.IRMAServerURL == "" {
+		errs.addf("jwt.server_side_session requires jwt.irma_server_url")
 	}
+}
 
-	// Fail fast on a malformed trusted-proxy list rather than silently
-	// ignoring proxy headers at runtime.
-	if _, err := ParseTrustedProxies(cfg.App.TrustedProxies); err != nil {
-		return err
+// validPKCS11 reports whether p is complete enough to look the key up.
+func validPKCS11(p PKCS11Config, errs *configErrors) bool {
+	n := len(*errs)
+	if p.Module == "" {
+		errs.addf("jwt.pkcs11.module is required")
+	}
+	if p.TokenLabel == "" {
+		errs.addf("jwt.pkcs11.token_label is required")
+	}
+	if p.PINEnv == "" {
+		errs.addf("jwt.pkcs11.pin_env is required")
+	}
+	if p.KeyLabel == "" && p.KeyID == "" {
+		errs.addf("jwt.pkcs11 needs key_label, key_id or both")
+	}
+	if _, err := hex.DecodeString(p.KeyID); err != nil {
+		errs.addf("jwt.pkcs11.key_id must be hex encoded: %w", err)
+	}
+	return len(*errs) == n
+}
+
+func validateAudit(cfg *Config, errs *configErrors) {
+	switch cfg.Audit.Sink {
+	case "":
+	case "file":
+		if cfg.Audit.FilePath == "" {
+			errs.addf("audit.file_path is required for the file sink")
+		}
+	case "syslog":
+	case "redis":
+		if cfg.App.StorageType != "redis" && cfg.App.StorageType != "redis_sentinel" {
+			errs.addf("audit sink redis requires storage_type redis or redis_sentinel")
+		}
+	default:
+		errs.addf("unsupported audit.sink %q", cfg.Audit.Sink)
+	}
+	if cfg.Audit.Sink != "" && len(cfg.Audit.PseudonymKey) < MinAuditPseudonymKeyLength {
+		errs.addf("audit.pseudonym_key must be at least %d characters", MinAuditPseudonymKeyLength)
+	}
+}
+
+func validateTracing(tc TracingConfig, errs *configErrors) {
+	if tc.Endpoint != "" {
+		if u, err := url.Parse(tc.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.addf("tracing.endpoint must be an absolute http or https URL, got %q", tc.Endpoint)
+		}
+	}
+	if r := tc.SampleRatioOrDefault(); r < 0 || r > 1 {
+		errs.addf("tracing.sample_ratio must be between 0 and 1")
+	}
+}
+
+func validateLogging(lc LoggingConfig, errs *configErrors) {
+	switch lc.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		errs.addf("logging.level must be debug, info, warn or error, got %q", lc.Level)
+	}
+	switch lc.Format {
+	case "", "text", "json":
+	default:
+		errs.addf("logging.format must be text or json, got %q", lc.Format)
+	}
+}
+
+func validateAdmin(app AppConfig, errs *configErrors) {
+	// Separate admin listener (optional).
+	if app.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(app.AdminAddr); err != nil {
+			errs.addf("admin_addr invalid: %w", err)
+		}
+		if app.AdminAddr == app.Addr {
+			errs.addf("admin_addr must differ from addr")
+		}
+	}
+
+	// Admin TLS, client certificates and JWT access tokens (optional).
+	if (app.AdminTLSCertPath == "") != (app.AdminTLSKeyPath == "") {
+		errs.addf("admin_tls_cert_path and admin_tls_key_path must be set together")
+	} else if app.AdminTLSCertPath != "" {
+		if _, err := tls.LoadX509KeyPair(app.AdminTLSCertPath, app.AdminTLSKeyPath); err != nil {
+			errs.addf("admin_tls_cert_path and admin_tls_key_path: %w", err)
+		}
+	}
+	if app.AdminTLSCertPath != "" && app.AdminAddr == "" {
+		errs.addf("admin_tls_cert_path requires admin_addr")
+	}
+	if cc := app.AdminClientCerts; cc != nil {
+		if app.AdminTLSCertPath == "" {
+			errs.addf("admin_client_certs requires admin_addr with admin_tls_cert_path and admin_tls_key_path")
+		}
+		if _, err := LoadCertPool(cc.CAPath); err != nil {
+			errs.add(err)
+		}
+		for i, subj := range cc.Subjects {
+			if subj.Name == "" || subj.Subject == "" {
+				errs.addf("admin_client_certs.subjects[%d]: name and subject are required", i)
+			}
+			errs.add(validateAdminScopes(subj.Name, subj.Scopes))
+		}
+	}
+	if aj := app.AdminJWT; aj != nil {
+		if aj.Issuer == "" || aj.Audience == "" {
+			errs.addf("admin_jwt.issuer and admin_jwt.audience are required")
+		}
+		if _, err := LoadJWKS(aj.JWKSPath); err != nil {
+			errs.add(err)
+		}
 	}
 
 	// Admin endpoints (optional). When a token is set it is the only credential
-	// guarding the admin routes, which sit on the same public router as the SPA.
-	// A short token is brute-forceable over the network, so reject a weak one at
-	// startup rather than accepting it silently.
-	if cfg.App.AdminToken != "" && len(cfg.App.AdminToken) < MinAdminTokenLength {
-		return fmt.Errorf("admin_token must be at least %d characters when set", MinAdminTokenLength)
+	// guarding the admin routes, which sit on the same public router as the SPA
+	// unless admin_addr moves them to their own listener. A short token is
+	// brute-forceable over the network, so reject a weak one at startup rather
+	// than accepting it silently.
+	if app.AdminToken != "" && len(app.AdminToken) < MinAdminTokenLength {
+		errs.addf("admin_token must be at least %d characters when set", MinAdminTokenLength)
+	}
+	names := make(map[string]bool, len(app.AdminCredentials))
+	for i, cred := range app.AdminCredentials {
+		if cred.Name == "" {
+			errs.addf("admin_credentials[%d].name is required", i)
+		}
+		if names[cred.Name] || cred.Name == LegacyAdminCredentialName && app.AdminToken != "" {
+			errs.addf("admin_credentials name %q is not unique", cred.Name)
+		}
+		names[cred.Name] = true
+		if b, err := hex.DecodeString(cred.TokenSHA256); err != nil || len(b) != sha256.Size {
+			errs.addf("admin_credentials %q: token_sha256 must be a hex-encoded SHA-256 hash", cred.Name)
+		}
+		errs.add(validateAdminScopes(cred.Name, cred.Scopes))
+	}
+}
+
+// irmaIdentifier matches one part of an IRMA identifier, such as "sidn-pbdf"
+// in "pbdf.sidn-pbdf.email", or an attribute name.
+var irmaIdentifier = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateCredentials checks the entries of JWTConfig.Credentials. Names must
+// be unique so clients can select a credential unambiguously.
+func validateCredentials(credentials []CredentialConfig, irmaServerURL string, errs *configErrors) {
+	seen := make(map[string]bool, len(credentials))
+	for _, c := range credentials {
+		if c.Name == "" {
+			errs.addf("credential name is required")
+		} else if seen[c.Name] {
+			errs.addf("duplicate credential name %q", c.Name)
+		}
+		seen[c.Name] = true
+
+		what := fmt.Sprintf("credential %q", c.Name)
+		validateCredentialIdentifiers(what, c.Credential, c.Attributes, errs)
+		if c.BatchSize < 0 || c.BatchSize > MaxSdJwtBatchSize {
+			errs.addf("%s: batch_size must be between 0 and %d", what, MaxSdJwtBatchSize)
+		}
+		if c.Validity != 0 && time.Duration(c.Validity) < MinCredentialValidity {
+			errs.addf("%s: validity must be at least %s", what, MinCredentialValidity)
+		}
+		if c.Revocation && irmaServerURL == "" {
+			errs.addf("%s: revocation requires jwt.irma_server_url", what)
+		}
+	}
+}
+
+// validateCredentialIdentifiers checks that credential is a full credential
+// type ID and that the attribute names are valid and distinct.
+func validateCredentialIdentifiers(what, credential string, attrs EmailCredentialAttributes, errs *configErrors) {
+	parts := strings.Split(credential, ".")
+	if len(parts) != 3 || slices.ContainsFunc(parts, func(p string) bool { return !irmaIdentifier.MatchString(p) }) {
+		errs.addf("%s: full_credential must look like scheme.issuer.credential, got %q", what, credential)
+	}
+	names := attrs.Names()
+	if len(names) == 0 {
+		errs.addf("%s: at least one attribute is required", what)
+	}
+	for i, name := range names {
+		if !irmaIdentifier.MatchString(name) {
+			errs.addf("%s: invalid attribute name %q", what, name)
+		}
+		if slices.Contains(names[i+1:], name) {
+			errs.addf("%s: attribute %q is mapped twice", what, name)
+		}
+	}
+}
+
+func validateAdminScopes(name string, scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("admin credential %q: at least one scope is required", name)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(AdminScopes, scope) {
+			return fmt.Errorf("admin credential %q: unknown scope %q", name, scope)
+		}
 	}
 	return nil
 }
@@ -173,17 +966,7 @@ func ParseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 		if entry == "" {
 			continue
 		}
-		// Allow bare IP addresses by promoting them to a single-host CIDR.
-		if !strings.Contains(entry, "/") {
-			if ip := net.ParseIP(entry); ip != nil {
-				if ip.To4() != nil {
-					entry += "/32"
-				} else {
-					entry += "/128"
-				}
-			}
-		}
-		_, network, err := net.ParseCIDR(entry)
+		network, err := ParseCIDR(entry)
 		if err != nil {
 			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", entry, err)
 		}
@@ -192,29 +975,47 @@ func ParseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 	return nets, nil
 }
 
+// ParseCIDR parses a single CIDR range. A bare IP address is accepted and
+// treated as a single-host range (/32 or /128).
+func ParseCIDR(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	// Allow bare IP addresses by promoting them to a single-host CIDR.
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil {
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
 // MinAdminTokenLength is the minimum length required for app.admin_token when
 // the admin endpoints are enabled.
 const MinAdminTokenLength = 16
 
-// LoadRSAPrivateKey reads and parses the PEM-encoded RSA private key at path.
-// It returns a descriptive error if the file cannot be read or does not
-// contain a valid RSA private key (e.g. it is empty or holds an ECDSA key).
-func LoadRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
-	keyBytes, err := os.ReadFile(filepath.Clean(path))
+// LoadCertPool reads the PEM-encoded CA certificates at path into a pool.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(filepath.Clean(path))
 	if err != nil {
-		return nil, fmt.Errorf("could not read private key file %q: %w", path, err)
+		return nil, fmt.Errorf("could not read CA file %q: %w", path, err)
 	}
-
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
-	if err != nil {
-		return nil, fmt.Errorf("invalid RSA private key in %q: %w", path, err)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in CA file %q", path)
 	}
-
-	return key, nil
+	return pool, nil
 }
 
 type JSONDuration time.Duration
 
+func (d JSONDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
 func (d *JSONDuration) UnmarshalJSON(b []byte) error {
 	// Try string: "15m", "1h30m", etc.
 	var s string
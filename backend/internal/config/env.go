@@ -0,0 +1,152 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides a
+// config field.
+const EnvPrefix = "EMAIL_ISSUER_"
+
+// EnvName returns the environment variable that overrides the config field
+// with the given JSON path, e.g. "mail.mail_password" for
+// EMAIL_ISSUER_MAIL_MAIL_PASSWORD.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// applyEnv overrides fields of cfg from the environment (see EnvName).
+// Strings, numbers, booleans and durations are given as is and lists of
+// strings comma separated; other fields, such as maps and lists of objects,
+// take JSON. Setting NAME_FILE instead of NAME reads the value from that file,
+// so secrets can be mounted as Docker or Kubernetes secrets.
+func applyEnv(cfg *Config) error {
+	_, err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), "")
+	return err
+}
+
+// applyEnvStruct applies the overrides for the fields of the struct v, whose
+// JSON path is prefix. It reports whether any field was set.
+func applyEnvStruct(v reflect.Value, prefix string) (bool, error) {
+	set := false
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		fv := v.Field(i)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			ok, err := applyEnvStruct(fv, key+".")
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+			continue
+		case field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct:
+			// Optional sections stay nil unless one of their fields is set.
+			section := reflect.New(field.Type.Elem())
+			if !fv.IsNil() {
+				section.Elem().Set(fv.Elem())
+			}
+			ok, err := applyEnvStruct(section.Elem(), key+".")
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				fv.Set(section)
+				set = true
+			}
+			continue
+		}
+
+		value, ok, err := lookupEnv(EnvName(key))
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(fv, value); err != nil {
+			return false, fmt.Errorf("%s: invalid value for %s: %w", EnvName(key), key, err)
+		}
+		set = true
+	}
+	return set, nil
+}
+
+// lookupEnv returns the value of the variable name, or the contents of the
+// file named by name_FILE.
+func lookupEnv(name string) (string, bool, error) {
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		value, ok := os.LookupEnv(name)
+		return value, ok, nil
+	}
+	if _, ok := os.LookupEnv(name); ok {
+		return "", false, fmt.Errorf("set only one of %s and %s_FILE", name, name)
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	// Editors and echo add a trailing newline that is not part of the secret.
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+var jsonDurationType = reflect.TypeFor[JSONDuration]()
+
+func setFromEnv(v reflect.Value, value string) error {
+	if v.Type() == jsonDurationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var items []string
+			for item := range strings.SplitSeq(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		fallthrough
+	default:
+		// Replace rather than merge into the value from the config file.
+		v.SetZero()
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	}
+	return nil
+}
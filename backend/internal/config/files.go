@@ -0,0 +1,165 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadFiles reads the config files at paths, merges them and applies the
+// environment overrides, without validating the result. The format of each
+// file follows from its extension: .json, .yaml, .yml or .toml. Every format
+// uses the keys of the JSON config.
+//
+// Later files override earlier ones. Objects are merged key by key, so a file
+// only needs to hold the keys it changes; any other value, including a list,
+// replaces the earlier value as a whole.
+func ReadFiles(paths ...string) (*Config, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no config file given")
+	}
+
+	merged := map[string]any{}
+	for _, path := range paths {
+		layer, err := readLayer(path)
+		if err != nil {
+			return nil, err
+		}
+		// Check each file on its own, so an unknown key is reported
+		// together with the file it is in.
+		if err := decodeStrict(layer, &Config{}); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		mergeLayer(merged, layer)
+	}
+
+	var cfg Config
+	if err := decodeStrict(merged, &cfg); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadFromFiles is like ReadFiles, but also validates the config.
+func LoadFromFiles(paths ...string) (*Config, error) {
+	cfg, err := ReadFiles(paths...)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readLayer parses the config file at path into a generic map.
+func readLayer(path string) (map[string]any, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	layer := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&layer)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &layer)
+	case ".toml":
+		err = toml.Unmarshal(data, &layer)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q, use .json, .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return layer, nil
+}
+
+// mergeLayer merges layer into dst. Objects present in both are merged
+// recursively; any other value in layer replaces the one in dst.
+func mergeLayer(dst, layer map[string]any) {
+	for key, value := range layer {
+		if obj, ok := value.(map[string]any); ok {
+			if existing, ok := dst[key].(map[string]any); ok {
+				mergeLayer(existing, obj)
+				continue
+			}
+			// Copy, so merging a later layer does not modify this one.
+			copied := map[string]any{}
+			mergeLayer(copied, obj)
+			value = copied
+		}
+		dst[key] = value
+	}
+}
+
+// decodeStrict decodes the generic config in layer into cfg through JSON,
+// rejecting unknown keys, which are usually misspelled keys that would
+// otherwise be silently ignored.
+func decodeStrict(layer map[string]any, cfg *Config) error {
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(cfg)
+}
+
+// Redacted returns a copy of the config in which the fields tagged
+// `secret:"true"` are replaced by "REDACTED" when set, for printing. For a
+// map of strings the values are replaced and the keys kept.
+func (c *Config) Redacted() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var copied Config
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	redact(reflect.ValueOf(&copied).Elem())
+	return &copied, nil
+}
+
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			redact(v.Elem())
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			redact(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Field(i)
+			if v.Type().Field(i).Tag.Get("secret") == "true" {
+				switch {
+				case field.Kind() == reflect.String && field.String() != "":
+					field.SetString("REDACTED")
+				case field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.String:
+					for _, key := range field.MapKeys() {
+						field.SetMapIndex(key, reflect.ValueOf("REDACTED").Convert(field.Type().Elem()))
+					}
+				}
+				continue
+			}
+			redact(field)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// LoadSigner returns the issuer key configured in cfg. The PEM-encoded key is
+// read from the file at PrivateKeyPath or, when PrivateKeyEnv is set, from
+// that environment variable, either as is or base64 encoded. An encrypted
+// PKCS #8 key is decrypted with the passphrase in the environment variable
+// named by PrivateKeyPassphraseEnv. With PKCS11 set, the key stays on the
+// PKCS #11 token and the signer signs through it.
+//
+// The parsed key is cached until the key or passphrase changes, as it is
+// loaded for every issuance and decrypting it is deliberately slow.
+func LoadSigner(cfg JWTConfig) (crypto.Signer, error) {
+	if cfg.PKCS11 != nil {
+		return loadPKCS11Signer(*cfg.PKCS11)
+	}
+
+	var passphrase []byte
+	if cfg.PrivateKeyPassphraseEnv != "" {
+		value, ok := os.LookupEnv(cfg.PrivateKeyPassphraseEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("private key passphrase variable %s is not set", cfg.PrivateKeyPassphraseEnv)
+		}
+		passphrase = []byte(value)
+	}
+
+	if cfg.PrivateKeyEnv == "" {
+		data, err := os.ReadFile(filepath.Clean(cfg.PrivateKeyPath))
+		if err != nil {
+			return nil, fmt.Errorf("could not read private key file %q: %w", cfg.PrivateKeyPath, err)
+		}
+		key, err := parseCachedPrivateKeyPEM("file:"+cfg.PrivateKeyPath, data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key in %q: %w", cfg.PrivateKeyPath, err)
+		}
+		return key, nil
+	}
+	value := strings.TrimSpace(os.Getenv(cfg.PrivateKeyEnv))
+	if value == "" {
+		return nil, fmt.Errorf("private key variable %s is not set", cfg.PrivateKeyEnv)
+	}
+	if !strings.HasPrefix(value, "-----BEGIN") {
+		// Multi-line values are awkward in many deployment tools, so the
+		// PEM may also be base64 encoded as a whole.
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("private key variable %s holds neither PEM nor base64: %w", cfg.PrivateKeyEnv, err)
+		}
+		value = string(decoded)
+	}
+	key, err := parseCachedPrivateKeyPEM("env:"+cfg.PrivateKeyEnv, []byte(value), passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", cfg.PrivateKeyEnv, err)
+	}
+	return key, nil
+}
+
+// pemSigners caches the key last parsed from each key file or variable, with
+// a digest of the PEM and passphrase it was parsed from. A new key, e.g. after
+// a reload, replaces the entry of its source.
+var pemSigners struct {
+	sync.Mutex
+	bySource map[string]cachedSigner
+}
+
+type cachedSigner struct {
+	digest [sha256.Size]byte
+	signer crypto.Signer
+}
+
+// parseCachedPrivateKeyPEM is parsePrivateKeyPEM, cached per source. The lock
+// is held while parsing, so concurrent requests decrypt a new key only once.
+func parseCachedPrivateKeyPEM(source string, data, passphrase []byte) (crypto.Signer, error) {
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte{0})
+	h.Write(passphrase)
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+
+	pemSigners.Lock()
+	defer pemSigners.Unlock()
+	if cached, ok := pemSigners.bySource[source]; ok && cached.digest == digest {
+		return cached.signer, nil
+	}
+	key, err := parsePrivateKeyPEM(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if pemSigners.bySource == nil {
+		pemSigners.bySource = make(map[string]cachedSigner)
+	}
+	pemSigners.bySource[source] = cachedSigner{digest: digest, signer: key}
+	return key, nil
+}
+
+// LoadPrivateKey reads and parses the PEM-encoded issuer private key at path.
+// RSA (PKCS #1 or PKCS #8), ECDSA (SEC 1 or PKCS #8, on P-256, P-384 or P-521)
+// and Ed25519 (PKCS #8) keys are supported.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	return loadPrivateKey(path, nil)
+}
+
+func loadPrivateKey(path string, passphrase []byte) (crypto.Signer, error) {
+	keyBytes, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key file %q: %w", path, err)
+	}
+
+	key, err := parsePrivateKeyPEM(keyBytes, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %q: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKeyPEM parses the first PEM block of data as a private key of
+// one of the types supported by LoadPrivateKey.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	return parsePrivateKeyPEM(data, nil)
+}
+
+func parsePrivateKeyPEM(data, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if _, ok := block.Headers["Proc-Type"]; ok {
+		// The legacy OpenSSL encryption is weak and deprecated in Go.
+		return nil, errors.New("legacy PEM encryption is not supported, convert the key with openssl pkcs8 -topk8")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, errors.New("the key is encrypted but no passphrase is configured")
+		}
+		var der []byte
+		if der, err = decryptPKCS8(block.Bytes, passphrase); err == nil {
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		if _, err := defaultECDSAMethod(k.Curve); err != nil {
+			return nil, err
+		}
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// SigningMethod returns the JWT signing method for key. An empty alg selects
+// the default for the key type: RS256 for RSA, ES256, ES384 or ES512 for
+// ECDSA depending on the curve, and EdDSA for Ed25519. Otherwise alg must be
+// a method that works with key, e.g. PS256 for an RSA key.
+//
+// The key need not be one of the crypto package's private key types: any
+// crypto.Signer with an RSA, ECDSA or Ed25519 public key works, so the
+// private key may live in a hardware module or a key management service.
+func SigningMethod(key crypto.Signer, alg string) (jwt.SigningMethod, error) {
+	method, err := signingMethod(key.Public(), alg)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return method, nil
+	}
+	return signerMethod{method}, nil
+}
+
+func signingMethod(pub crypto.PublicKey, alg string) (jwt.SigningMethod, error) {
+	if alg == "" {
+		switch k := pub.(type) {
+		case *rsa.PublicKey:
+			return jwt.SigningMethodRS256, nil
+		case *ecdsa.PublicKey:
+			return defaultECDSAMethod(k.Curve)
+		case ed25519.PublicKey:
+			return jwt.SigningMethodEdDSA, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("unknown signing algorithm %q", alg)
+	}
+	ok := false
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			ok = true
+		}
+	case *ecdsa.PublicKey:
+		// Each ECDSA method is bound to one curve.
+		m, isECDSA := method.(*jwt.SigningMethodECDSA)
+		ok = isECDSA && m.CurveBits == k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		_, ok = method.(*jwt.SigningMethodEd25519)
+	}
+	if !ok {
+		return nil, fmt.Errorf("signing algorithm %s cannot be used with a %T key", alg, pub)
+	}
+	return method, nil
+}
+
+// signerMethod signs through the crypto.Signer interface. The golang-jwt
+// methods only accept the crypto package's own private key types.
+// Verification is left to the wrapped method.
+type signerMethod struct {
+	jwt.SigningMethod
+}
+
+func (m signerMethod) Sign(signingString string, key any) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	var opts crypto.SignerOpts
+	curveBits := 0
+	switch method := m.SigningMethod.(type) {
+	case *jwt.SigningMethodRSA:
+		opts = method.Hash
+	case *jwt.SigningMethodRSAPSS:
+		opts = &rsa.PSSOptions{SaltLength: method.Options.SaltLength, Hash: method.Hash}
+	case *jwt.SigningMethodECDSA:
+		opts, curveBits = method.Hash, method.CurveBits
+	case *jwt.SigningMethodEd25519:
+		// Ed25519 signs the message itself rather than a digest.
+		opts = crypto.Hash(0)
+	default:
+		return "", fmt.Errorf("unsupported signing method %s", m.Alg())
+	}
+
+	digest := []byte(signingString)
+	if hash := opts.HashFunc(); hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return "", err
+	}
+	if curveBits != 0 {
+		// JWS uses the fixed-size concatenation of r and s instead of the
+		// ASN.1 encoding crypto.Signer returns.
+		if sig, err = rawECDSASignature(sig, curveBits); err != nil {
+			return "", err
+		}
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+func rawECDSASignature(der []byte, curveBits int) ([]byte, error) {
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("invalid ECDSA signature: %w", err)
+	}
+	size := (curveBits + 7) / 8
+	raw := make([]byte, 2*size)
+	sig.R.FillBytes(raw[:size])
+	sig.S.FillBytes(raw[size:])
+	return raw, nil
+}
+
+func defaultECDSAMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	}
+	return nil, fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+}
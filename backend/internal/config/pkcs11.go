@@ -0,0 +1,61 @@
+//go:build pkcs11
+
+package config
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ThalesGroup/crypto11"
+)
+
+// pkcs11Signers caches the signer of every token key loaded so far. LoadSigner
+// is called for each issuance and readiness check, and every crypto11 context
+// keeps its own logged-in sessions with the token open.
+var pkcs11Signers struct {
+	sync.Mutex
+	byConfig map[PKCS11Config]crypto.Signer
+}
+
+// loadPKCS11Signer logs in to the token selected by cfg and returns a signer
+// for the key pair with the configured label and ID.
+func loadPKCS11Signer(cfg PKCS11Config) (crypto.Signer, error) {
+	pin, ok := os.LookupEnv(cfg.PINEnv)
+	if !ok || pin == "" {
+		return nil, fmt.Errorf("PKCS #11 PIN variable %s is not set", cfg.PINEnv)
+	}
+	var id, label []byte
+	if cfg.KeyID != "" {
+		var err error
+		if id, err = hex.DecodeString(cfg.KeyID); err != nil {
+			return nil, fmt.Errorf("invalid PKCS #11 key ID %q: %w", cfg.KeyID, err)
+		}
+	}
+	if cfg.KeyLabel != "" {
+		label = []byte(cfg.KeyLabel)
+	}
+
+	pkcs11Signers.Lock()
+	defer pkcs11Signers.Unlock()
+	if signer, ok := pkcs11Signers.byConfig[cfg]; ok {
+		return signer, nil
+	}
+
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: cfg.Module, TokenLabel: cfg.TokenLabel, Pin: pin})
+	if err != nil {
+		return nil, fmt.Errorf("could not open PKCS #11 token %q with %q: %w", cfg.TokenLabel, cfg.Module, err)
+	}
+	signer, err := ctx.FindKeyPair(id, label)
+	if err != nil {
+		_ = ctx.Close()
+		return nil, fmt.Errorf("could not find the issuer key on PKCS #11 token %q: %w", cfg.TokenLabel, err)
+	}
+	if pkcs11Signers.byConfig == nil {
+		pkcs11Signers.byConfig = make(map[PKCS11Config]crypto.Signer)
+	}
+	pkcs11Signers.byConfig[cfg] = signer
+	return signer, nil
+}
@@ -0,0 +1,14 @@
+//go:build !pkcs11
+
+package config
+
+import (
+	"crypto"
+	"errors"
+)
+
+// loadPKCS11Signer fails: PKCS #11 support needs cgo and the token's library,
+// so it is only linked into builds with the pkcs11 build tag.
+func loadPKCS11Signer(PKCS11Config) (crypto.Signer, error) {
+	return nil, errors.New("jwt.pkcs11 is not supported by this build, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,145 @@
+//go:build pkcs11
+
+package config
+
+import (
+	"crypto/elliptic"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ThalesGroup/crypto11"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// softHSMModules are the usual install locations of the SoftHSM library.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softHSMToken initialises a SoftHSM token with the given label and PIN in a
+// temporary directory and returns the path of the SoftHSM library. The test
+// is skipped when SoftHSM is not installed. SOFTHSM2_MODULE overrides the
+// library path. SoftHSM reads its configuration once per process, so call
+// this only once.
+func softHSMToken(t *testing.T, label, pin string) string {
+	t.Helper()
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			module = path
+		}
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if module == "" || err != nil {
+		t.Skip("SoftHSM is not installed")
+	}
+
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+	out, err := exec.Command(util, "--init-token", "--free", "--label", label, "--pin", pin, "--so-pin", "so-"+pin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util --init-token: %v\n%s", err, out)
+	}
+	return module
+}
+
+func TestLoadSignerFromPKCS11(t *testing.T) {
+	module := softHSMToken(t, "issuer", "1234")
+	t.Setenv("TEST_PKCS11_PIN", "1234")
+
+	hsm, err := crypto11.Configure(&crypto11.Config{Path: module, TokenLabel: "issuer", Pin: "1234"})
+	if err != nil {
+		t.Fatalf("failed to open token: %v", err)
+	}
+	if _, err := hsm.GenerateECDSAKeyPairWithLabel([]byte{1}, []byte("issuer-ec"), elliptic.P256()); err != nil {
+		t.Fatalf("failed to generate ECDSA key: %v", err)
+	}
+	if _, err := hsm.GenerateRSAKeyPairWithLabel([]byte{2}, []byte("issuer-rsa"), 2048); err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	if err := hsm.Close(); err != nil {
+		t.Fatalf("failed to close token: %v", err)
+	}
+
+	tests := map[string]struct {
+		key PKCS11Config
+		alg string
+	}{
+		"RS256": {PKCS11Config{KeyLabel: "issuer-rsa"}, ""},
+		"ES256": {PKCS11Config{KeyLabel: "issuer-ec"}, ""},
+		"PS256": {PKCS11Config{KeyID: "02"}, "PS256"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc.key.Module, tc.key.TokenLabel, tc.key.PINEnv = module, "issuer", "TEST_PKCS11_PIN"
+			cfg := baseConfig("")
+			cfg.JWT.PKCS11, cfg.JWT.SigningAlgorithm = &tc.key, tc.alg
+			if err := validate(cfg); name == IRMAServerAlgorithm && err != nil {
+				t.Fatalf("expected the token key to pass validation, got: %v", err)
+			} else if name != IRMAServerAlgorithm {
+				wantOnlyAlgorithmError(t, err, name)
+			}
+
+			key, err := LoadSigner(cfg.JWT)
+			if err != nil {
+				t.Fatalf("failed to load the token key: %v", err)
+			}
+			if again, err := LoadSigner(cfg.JWT); err != nil || again != key {
+				t.Fatalf("expected the token key to be cached, got %v, %v", again, err)
+			}
+			method, err := SigningMethod(key, tc.alg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if method.Alg() != name {
+				t.Fatalf("expected %s, got %s", name, method.Alg())
+			}
+			signed, err := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "test"}).SignedString(key)
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			_, err = jwt.Parse(signed, func(*jwt.Token) (any, error) { return key.Public(), nil },
+				jwt.WithValidMethods([]string{name}))
+			if err != nil {
+				t.Fatalf("signature does not verify: %v", err)
+			}
+		})
+	}
+
+	t.Setenv("TEST_PKCS11_WRONG_PIN", "4321")
+	failures := map[string]struct {
+		key  PKCS11Config
+		want string
+	}{
+		"unset PIN":     {PKCS11Config{Module: module, TokenLabel: "issuer", PINEnv: "TEST_PKCS11_UNSET", KeyLabel: "issuer"}, "PIN variable TEST_PKCS11_UNSET is not set"},
+		"wrong PIN":     {PKCS11Config{Module: module, TokenLabel: "issuer", PINEnv: "TEST_PKCS11_WRONG_PIN", KeyLabel: "issuer"}, "could not open PKCS #11 token"},
+		"unknown token": {PKCS11Config{Module: module, TokenLabel: "other", PINEnv: "TEST_PKCS11_PIN", KeyLabel: "issuer"}, "could not open PKCS #11 token"},
+		"missing key":   {PKCS11Config{Module: module, TokenLabel: "issuer", PINEnv: "TEST_PKCS11_PIN", KeyLabel: "missing"}, "could not find the issuer key"},
+	}
+	for name, tc := range failures {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadSigner(JWTConfig{PKCS11: &tc.key})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected error containing %q, got: %v", tc.want, err)
+			}
+		})
+	}
+}
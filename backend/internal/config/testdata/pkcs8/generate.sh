@@ -0,0 +1,15 @@
+#!/bin/sh
+# Regenerates the encrypted PKCS #8 fixtures of TestDecryptPKCS8: key.pem
+# encrypted with every PBKDF2 PRF and AES-CBC cipher the loader supports, plus
+# two schemes it rejects. All use the passphrase "correct-horse".
+set -e
+cd "$(dirname "$0")"
+openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -out key.pem
+for prf in hmacWithSHA1 hmacWithSHA256 hmacWithSHA384 hmacWithSHA512; do
+	for cipher in aes-128-cbc aes-192-cbc aes-256-cbc; do
+		openssl pkcs8 -topk8 -in key.pem -v2 "$cipher" -v2prf "$prf" \
+			-passout pass:correct-horse -out "$prf-$cipher.pem"
+	done
+done
+openssl pkcs8 -topk8 -in key.pem -v2 des3 -passout pass:correct-horse -out unsupported-des3.pem
+openssl pkcs8 -topk8 -in key.pem -v1 PBE-SHA1-3DES -passout pass:correct-horse -out unsupported-pbes1.pem
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"net"
+	"strings"
+)
+
+// IPAggregation sets the prefix lengths client addresses are truncated to
+// before they are used as rate-limit keys. All addresses within the same
+// prefix share one counter, so a client cannot escape the per-IP limit by
+// rotating through the addresses it was assigned (typically a whole IPv6 /64).
+// A zero prefix disables aggregation for that address family.
+type IPAggregation struct {
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// IPPrefixLimit applies a dedicated limiter to every address within Network,
+// instead of the regular per-IP limiter. The whole range shares one counter,
+// which suits large NAT ranges where many users legitimately share addresses.
+type IPPrefixLimit struct {
+	Network *net.IPNet
+	Limiter RateLimiter
+}
+
+// NormalizeIP returns the canonical text form of ip: IPv4-mapped IPv6
+// addresses become dotted IPv4 and IPv6 addresses are compressed and
+// lowercased. Input that does not parse as an IP address is returned trimmed
+// but otherwise unchanged.
+func NormalizeIP(ip string) string {
+	ip = strings.TrimSpace(ip)
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	return parsed.String()
+}
+
+// Aggregate returns the rate-limit identity for ip: the address itself when no
+// aggregation applies, or the enclosing network in CIDR notation otherwise.
+func (a IPAggregation) Aggregate(ip string) string {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return ip
+	}
+
+	bits, prefix := 128, a.IPv6Prefix
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, bits, prefix = v4, 32, a.IPv4Prefix
+	}
+	if prefix <= 0 || prefix >= bits {
+		return parsed.String()
+	}
+
+	network := &net.IPNet{IP: parsed.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return network.String()
+}
+
+// prefixLimitFor returns the most specific configured prefix limit that
+// contains ip, or nil when none does.
+func (l *TotalRateLimiter) prefixLimitFor(ip string) *IPPrefixLimit {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return nil
+	}
+
+	var best *IPPrefixLimit
+	bestOnes := -1
+	for i := range l.IPPrefixLimits {
+		pl := &l.IPPrefixLimits[i]
+		if pl.Network == nil || !pl.Network.Contains(parsed) {
+			continue
+		}
+		if ones, _ := pl.Network.Mask.Size(); ones > bestOnes {
+			best, bestOnes = pl, ones
+		}
+	}
+	return best
+}
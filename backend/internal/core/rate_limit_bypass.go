@@ -0,0 +1,43 @@
+package core
+
+import (
+	"backend/internal/validators"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// RateLimitBypass lists trusted clients that are exempt from the send rate
+// limits, such as QA environments and partner integrations that legitimately
+// send many verifications. A request is exempt when its client IP falls within
+// one of Networks, its email address is one of Emails, or its email domain
+// matches one of Domains (exact or "*.example.com" wildcard).
+type RateLimitBypass struct {
+	Networks []*net.IPNet
+	Emails   []string
+	Domains  []string
+}
+
+// Match reports whether a request from ip for email is exempt and, if so,
+// which entry matched. Email addresses are expected in normalised form.
+func (b *RateLimitBypass) Match(ip, email string) (reason string, ok bool) {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, network := range b.Networks {
+			if network.Contains(parsed) {
+				return fmt.Sprintf("ip in %s", network), true
+			}
+		}
+	}
+
+	for _, e := range b.Emails {
+		if strings.EqualFold(e, email) {
+			return "email on bypass list", true
+		}
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	if validators.MatchesAnyDomain(domain, b.Domains) {
+		return fmt.Sprintf("domain %s on bypass list", domain), true
+	}
+	return "", false
+}
@@ -2,8 +2,12 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,10 +16,34 @@ import (
 
 // ----------- Abstract Rate Limiter Interface -----------
 type RateLimiter interface {
-	Allow(key string) (allow bool, timeout time.Duration, err error)
+	// Allow counts a request for key and reports whether it may proceed. The
+	// methods pass ctx to the backend and log with it, so log lines carry
+	// the request's ID.
+	Allow(ctx context.Context, key string) (allow bool, timeout time.Duration, err error)
 	// Reset clears any recorded usage for key, so the next Allow starts a
 	// fresh window. Resetting a key that has no recorded usage is a no-op.
-	Reset(key string) error
+	Reset(ctx context.Context, key string) error
+	// Status reports the usage recorded for key in the current window without
+	// counting a request. A key without recorded usage has a zero count.
+	Status(ctx context.Context, key string) (RateLimitStatus, error)
+	// ListBlocked returns the keys starting with prefix that are currently
+	// over the limit, one page at a time. Pass an empty cursor for the first
+	// page and the returned cursor for the next; an empty returned cursor means
+	// there are no more pages. limit is the desired page size; a backend may
+	// return slightly more or fewer entries per page.
+	ListBlocked(ctx context.Context, prefix, cursor string, limit int) (blocked []RateLimitStatus, nextCursor string, err error)
+}
+
+// ErrInvalidCursor is returned by ListBlocked for a cursor it did not issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// RateLimitStatus describes the current usage of a single rate-limit key.
+type RateLimitStatus struct {
+	Key     string
+	Count   int
+	Limit   int
+	TTL     time.Duration
+	Blocked bool
 }
 
 type RateLimitingPolicy struct {
@@ -35,6 +63,24 @@ type Clock interface {
 type TotalRateLimiter struct {
 	Email RateLimiter
 	IP    RateLimiter
+	// Domain limits requests per email domain, so that many different
+	// addresses at one domain cannot be used to flood it. Nil disables the
+	// per-domain limit.
+	Domain RateLimiter
+	// IPAggregation groups client addresses into prefixes before they are
+	// counted by IP. The zero value keys on the exact address.
+	IPAggregation IPAggregation
+	// IPPrefixLimits route addresses within specific ranges to a dedicated
+	// limiter instead of IP. The most specific matching range wins.
+	IPPrefixLimits []IPPrefixLimit
+	// Bypass exempts trusted clients from every limit. Nil exempts no one.
+	Bypass *RateLimitBypass
+	// OnReject, when set, is called with the dimension (DimensionEmail,
+	// DimensionIP or DimensionDomain) of every limit that rejects a request.
+	OnReject func(dimension string)
+	// Logger receives the log lines of the limiter. Nil logs to
+	// slog.Default().
+	Logger *slog.Logger
 }
 
 func NewTotalRateLimiter(email, ip RateLimiter) *TotalRateLimiter {
@@ -43,32 +89,148 @@ func NewTotalRateLimiter(email, ip RateLimiter) *TotalRateLimiter {
 
 func emailKeyFor(email string) string { return fmt.Sprintf("email:%s", email) }
 func ipKeyFor(ip string) string       { return fmt.Sprintf("ip:%s", ip) }
+func domainKeyFor(email string) string {
+	return fmt.Sprintf("domain:%s", email[strings.LastIndex(email, "@")+1:])
+}
+
+// ipLimiterFor returns the limiter and key that count requests from ip. An
+// address inside a configured prefix limit is counted against that range as a
+// whole; any other address is aggregated to its prefix and counted by IP.
+func (l *TotalRateLimiter) ipLimiterFor(ip string) (RateLimiter, string) {
+	if pl := l.prefixLimitFor(ip); pl != nil {
+		return pl.Limiter, ipKeyFor(pl.Network.String())
+	}
+	return l.IP, ipKeyFor(l.IPAggregation.Aggregate(ip))
+}
+
+func (l *TotalRateLimiter) Allow(ctx context.Context, ip, email string) (allow bool, timeoutRemaining time.Duration) {
+	// Exempt requests are not counted at all. Log every one so that bypasses
+	// stay visible and a too-broad entry is easy to spot.
+	if l.Bypass != nil {
+		if reason, ok := l.Bypass.Match(ip, email); ok {
+			loggerOrDefault(l.Logger).InfoContext(ctx, "ratelimit: bypassed", "ip", ip, "email", email, "reason", reason)
+			return true, 0
+		}
+	}
 
-func (l *TotalRateLimiter) Allow(ip, email string) (allow bool, timeoutRemaining time.Duration) {
-	ipKey := ipKeyFor(ip)
+	ipLimiter, ipKey := l.ipLimiterFor(ip)
 	emailKey := emailKeyFor(email)
 
-	allowEmail, timeRemainingEmail, err := l.Email.Allow(emailKey)
+	allowEmail, timeRemainingEmail, err := l.Email.Allow(ctx, emailKey)
 	if err != nil {
 		return false, 30 * time.Minute
 	}
 
-	allowIp, timeRemainingIp, err := l.IP.Allow(ipKey)
+	allowIp, timeRemainingIp, err := ipLimiter.Allow(ctx, ipKey)
 	if err != nil {
 		return false, 30 * time.Minute
 	}
 
-	if !allowIp || !allowEmail {
-		return false, maxDuration(timeRemainingIp, timeRemainingEmail)
+	allowDomain, timeRemainingDomain := true, time.Duration(0)
+	if l.Domain != nil {
+		allowDomain, timeRemainingDomain, err = l.Domain.Allow(ctx, domainKeyFor(email))
+		if err != nil {
+			return false, 30 * time.Minute
+		}
+	}
+
+	if !allowIp || !allowEmail || !allowDomain {
+		l.rejected(DimensionEmail, !allowEmail)
+		l.rejected(DimensionIP, !allowIp)
+		l.rejected(DimensionDomain, !allowDomain)
+		return false, maxDuration(maxDuration(timeRemainingIp, timeRemainingEmail), timeRemainingDomain)
 	}
 	return true, 0
 }
 
+func (l *TotalRateLimiter) rejected(dimension string, rejected bool) {
+	if rejected && l.OnReject != nil {
+		l.OnReject(dimension)
+	}
+}
+
 // ResetEmail clears the rate-limit counter for a single email address, so a
 // user who locked themselves out can send again immediately. It only touches
 // the per-email limiter; the per-IP limiter is left untouched.
-func (l *TotalRateLimiter) ResetEmail(email string) error {
-	return l.Email.Reset(emailKeyFor(email))
+func (l *TotalRateLimiter) ResetEmail(ctx context.Context, email string) error {
+	return l.Email.Reset(ctx, emailKeyFor(email))
+}
+
+// ResetIP clears the rate-limit counter that ip is counted against. With IP
+// aggregation or a matching prefix limit this unblocks the whole prefix or
+// range, since all of its addresses share one counter.
+func (l *TotalRateLimiter) ResetIP(ctx context.Context, ip string) error {
+	limiter, key := l.ipLimiterFor(ip)
+	return limiter.Reset(ctx, key)
+}
+
+// EmailStatus reports the per-email usage for email.
+func (l *TotalRateLimiter) EmailStatus(ctx context.Context, email string) (RateLimitStatus, error) {
+	return l.Email.Status(ctx, emailKeyFor(email))
+}
+
+// IPStatus reports the usage of the counter that ip is counted against.
+func (l *TotalRateLimiter) IPStatus(ctx context.Context, ip string) (RateLimitStatus, error) {
+	limiter, key := l.ipLimiterFor(ip)
+	return limiter.Status(ctx, key)
+}
+
+// Rate-limit dimensions accepted by ListBlocked.
+const (
+	DimensionEmail  = "email"
+	DimensionIP     = "ip"
+	DimensionDomain = "domain"
+)
+
+// ListBlocked returns a page of currently blocked keys for one dimension. See
+// RateLimiter.ListBlocked for the cursor semantics. Blocked prefix-limit
+// ranges are reported on the first page of the IP dimension.
+func (l *TotalRateLimiter) ListBlocked(ctx context.Context, dimension, cursor string, limit int) ([]RateLimitStatus, string, error) {
+	switch dimension {
+	case DimensionEmail:
+		return l.Email.ListBlocked(ctx, "email:", cursor, limit)
+	case DimensionDomain:
+		if l.Domain == nil {
+			return nil, "", nil
+		}
+		return l.Domain.ListBlocked(ctx, "domain:", cursor, limit)
+	case DimensionIP:
+		return l.listBlockedIPs(ctx, cursor, limit)
+	default:
+		return nil, "", fmt.Errorf("unknown rate-limit dimension %q", dimension)
+	}
+}
+
+func (l *TotalRateLimiter) listBlockedIPs(ctx context.Context, cursor string, limit int) ([]RateLimitStatus, string, error) {
+	var blocked []RateLimitStatus
+	rangeKeys := make(map[string]bool, len(l.IPPrefixLimits))
+	for _, pl := range l.IPPrefixLimits {
+		key := ipKeyFor(pl.Network.String())
+		rangeKeys[key] = true
+		if cursor != "" {
+			continue
+		}
+		status, err := pl.Limiter.Status(ctx, key)
+		if err != nil {
+			return nil, "", err
+		}
+		if status.Blocked {
+			blocked = append(blocked, status)
+		}
+	}
+
+	page, next, err := l.IP.ListBlocked(ctx, "ip:", cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	// Prefix-limit ranges may share the backend (and key space) with the
+	// regular IP limiter; they were reported above against their own limit.
+	for _, status := range page {
+		if !rangeKeys[status.Key] {
+			blocked = append(blocked, status)
+		}
+	}
+	return blocked, next, nil
 }
 
 // Redis rate limiter
@@ -76,33 +238,34 @@ func (l *TotalRateLimiter) ResetEmail(email string) error {
 type RedisRateLimiter struct {
 	rclient   *redis.Client
 	namespace string
-	ctx       context.Context
 	policy    RateLimitingPolicy
+	// Logger receives the Redis errors of the limiter. Nil logs to
+	// slog.Default().
+	Logger *slog.Logger
 }
 
 func NewRedisRateLimiter(redis *redis.Client, namespace string, policy RateLimitingPolicy) *RedisRateLimiter {
 	return &RedisRateLimiter{
 		rclient:   redis,
-		ctx:       context.Background(),
 		policy:    policy,
 		namespace: namespace,
 	}
 }
 
-func (r *RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
+func (r *RedisRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
 
 	key = fmt.Sprintf("%s:%s", r.namespace, key)
-	count, err := r.rclient.Incr(r.ctx, key).Result()
+	count, err := r.rclient.Incr(ctx, key).Result()
 	if err != nil {
-		log.Printf("Redis Incr failed: %v\n", err)
+		loggerOrDefault(r.Logger).ErrorContext(ctx, "ratelimit: redis INCR failed", "error", err)
 		return false, 0, err
 	}
 
 	if count == 1 {
 		// First request: set expiry
-		err = r.rclient.Expire(r.ctx, key, r.policy.Window).Err()
+		err = r.rclient.Expire(ctx, key, r.policy.Window).Err()
 		if err != nil {
-			log.Printf("Redis Expire failed: %v\n", err)
+			loggerOrDefault(r.Logger).ErrorContext(ctx, "ratelimit: redis EXPIRE failed", "error", err)
 			return false, 0, err
 		}
 	}
@@ -112,7 +275,7 @@ func (r *RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
 	// requests per window and blocks the (N+1)-th. Using > rather than >=
 	// keeps both backends in agreement when storage_type is switched.
 	if count > int64(r.policy.Limit) {
-		timeRemaining, err := r.rclient.TTL(r.ctx, key).Result()
+		timeRemaining, err := r.rclient.TTL(ctx, key).Result()
 		if err != nil {
 			return false, 0, err
 		}
@@ -122,15 +285,77 @@ func (r *RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
 	return true, 0, nil
 }
 
-func (r *RedisRateLimiter) Reset(key string) error {
+func (r *RedisRateLimiter) Reset(ctx context.Context, key string) error {
 	key = fmt.Sprintf("%s:%s", r.namespace, key)
-	if err := r.rclient.Del(r.ctx, key).Err(); err != nil {
-		log.Printf("Redis Del failed: %v\n", err)
+	if err := r.rclient.Del(ctx, key).Err(); err != nil {
+		loggerOrDefault(r.Logger).ErrorContext(ctx, "ratelimit: redis DEL failed", "error", err)
 		return err
 	}
 	return nil
 }
 
+func (r *RedisRateLimiter) Status(ctx context.Context, key string) (RateLimitStatus, error) {
+	status := RateLimitStatus{Key: key, Limit: r.policy.Limit}
+	nsKey := fmt.Sprintf("%s:%s", r.namespace, key)
+
+	count, err := r.rclient.Get(ctx, nsKey).Int()
+	if errors.Is(err, redis.Nil) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	ttl, err := r.rclient.TTL(ctx, nsKey).Result()
+	if err != nil {
+		return status, err
+	}
+
+	status.Count = count
+	status.TTL = max(ttl, 0)
+	status.Blocked = count > r.policy.Limit
+	return status, nil
+}
+
+// ListBlocked walks the keyspace with SCAN, so it never blocks Redis. The
+// cursor is Redis' own SCAN cursor; a page holds the blocked keys found in
+// however many SCAN batches it took to reach limit.
+func (r *RedisRateLimiter) ListBlocked(ctx context.Context, prefix, cursor string, limit int) ([]RateLimitStatus, string, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		c, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w %q: %v", ErrInvalidCursor, cursor, err)
+		}
+		scanCursor = c
+	}
+
+	nsPrefix := fmt.Sprintf("%s:", r.namespace)
+	var blocked []RateLimitStatus
+	for {
+		keys, next, err := r.rclient.Scan(ctx, scanCursor, nsPrefix+prefix+"*", int64(limit)).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		for _, nsKey := range keys {
+			status, err := r.Status(ctx, strings.TrimPrefix(nsKey, nsPrefix))
+			if err != nil {
+				return nil, "", err
+			}
+			if status.Blocked {
+				blocked = append(blocked, status)
+			}
+		}
+
+		scanCursor = next
+		if scanCursor == 0 {
+			return blocked, "", nil
+		}
+		if len(blocked) >= limit {
+			return blocked, strconv.FormatUint(scanCursor, 10), nil
+		}
+	}
+}
+
 // Memory rate limiter
 
 type InMemoryRateLimiter struct {
@@ -140,7 +365,7 @@ type InMemoryRateLimiter struct {
 	clock  Clock
 }
 
-func (r *InMemoryRateLimiter) Allow(key string) (allow bool, timeout time.Duration, err error) {
+func (r *InMemoryRateLimiter) Allow(_ context.Context, key string) (allow bool, timeout time.Duration, err error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
@@ -217,13 +442,59 @@ func (r *InMemoryRateLimiter) StartJanitor(interval time.Duration) (stop func())
 	return func() { close(done) }
 }
 
-func (r *InMemoryRateLimiter) Reset(key string) error {
+func (r *InMemoryRateLimiter) Reset(_ context.Context, key string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	delete(r.memory, key)
 	return nil
 }
 
+func (r *InMemoryRateLimiter) Status(_ context.Context, key string) (RateLimitStatus, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.statusLocked(key, r.clock.GetTime()), nil
+}
+
+func (r *InMemoryRateLimiter) statusLocked(key string, now time.Time) RateLimitStatus {
+	status := RateLimitStatus{Key: key, Limit: r.policy.Limit}
+	entry, exists := r.memory[key]
+	if !exists || !entry.Expiry.After(now) {
+		return status
+	}
+	status.Count = entry.Count
+	status.TTL = entry.Expiry.Sub(now)
+	status.Blocked = entry.Count > r.policy.Limit
+	return status
+}
+
+// ListBlocked pages through the blocked keys in lexical order. The cursor is
+// the last key of the previous page.
+func (r *InMemoryRateLimiter) ListBlocked(_ context.Context, prefix, cursor string, limit int) ([]RateLimitStatus, string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.clock.GetTime()
+	var keys []string
+	for key := range r.memory {
+		if strings.HasPrefix(key, prefix) && key > cursor && r.statusLocked(key, now).Blocked {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	blocked := make([]RateLimitStatus, 0, len(keys))
+	for _, key := range keys {
+		blocked = append(blocked, r.statusLocked(key, now))
+	}
+	return blocked, next, nil
+}
+
 func NewInMemoryRateLimiter(clock Clock, policy RateLimitingPolicy) *InMemoryRateLimiter {
 	return &InMemoryRateLimiter{
 		memory: map[string]*RateLimiterEntry{},
@@ -240,6 +511,14 @@ type SystemClock struct{}
 func NewSystemClock() *SystemClock        { return &SystemClock{} }
 func (c *SystemClock) GetTime() time.Time { return time.Now() }
 
+// loggerOrDefault returns logger, or slog.Default() when it is nil.
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
 func maxDuration(a, b time.Duration) time.Duration {
 	if a >= b {
 		return a
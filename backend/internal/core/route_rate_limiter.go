@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RouteRateLimiter limits how often a single client may call individual HTTP
+// routes, independently of the email/IP limits applied when sending a code.
+// Each route has its own limiter (and therefore its own policy); routes
+// without a limiter are not limited.
+type RouteRateLimiter struct {
+	// Routes maps a route's path template (e.g. "/api/verify") to its limiter.
+	Routes map[string]RateLimiter
+	// IPAggregation groups client addresses before they are counted, exactly
+	// like TotalRateLimiter.IPAggregation.
+	IPAggregation IPAggregation
+}
+
+func NewRouteRateLimiter(routes map[string]RateLimiter, aggregation IPAggregation) *RouteRateLimiter {
+	return &RouteRateLimiter{Routes: routes, IPAggregation: aggregation}
+}
+
+func routeKeyFor(route, ip string) string { return fmt.Sprintf("route:%s:%s", route, ip) }
+
+// Allow counts a request from ip to route and reports whether it may proceed.
+// Like TotalRateLimiter.Allow it fails closed: a backend error blocks the
+// request.
+func (l *RouteRateLimiter) Allow(ctx context.Context, route, ip string) (allow bool, timeoutRemaining time.Duration) {
+	limiter, ok := l.Routes[route]
+	if !ok {
+		return true, 0
+	}
+
+	allow, timeoutRemaining, err := limiter.Allow(ctx, routeKeyFor(route, l.IPAggregation.Aggregate(ip)))
+	if err != nil {
+		return false, 30 * time.Minute
+	}
+	return allow, timeoutRemaining
+}
@@ -4,7 +4,7 @@ import (
 	crand "crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
 )
 
@@ -38,7 +38,7 @@ func NewRandomTokenGenerator() *RandomTokenGenerator {
 func generateRandomNumber(max int) (int, error) {
 	num, err := crand.Int(crand.Reader, big.NewInt(int64(max)))
 	if err != nil {
-		log.Printf("failed to generate random number (max %v): %v", max, err)
+		slog.Error("failed to generate random number", "max", max, "error", err)
 		return 0, fmt.Errorf("failed to generate random number: %w", err)
 	}
 	return int(num.Int64()), nil
@@ -2,7 +2,9 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -12,13 +14,34 @@ import (
 type InMemoryTokenStorage struct {
 	TokenMap     map[string]string
 	LinkTokenMap map[string]string
-	mutex        sync.Mutex
+	DoneTokenMap map[string]string
+	SessionMap   map[string]string
+	// RevocationKeyMap holds the revocation keys of the credentials issued
+	// to each email address.
+	RevocationKeyMap map[string][]RevocationKey
+	// revocationKeyExpiry holds when each revocation key in RevocationKeyMap
+	// expires, indexed by the key itself.
+	revocationKeyExpiry map[string]time.Time
+	// doneTokenExpiry holds when each done token in DoneTokenMap expires.
+	doneTokenExpiry map[string]time.Time
+	// linkTokensByEmail indexes LinkTokenMap by email address, oldest first.
+	linkTokensByEmail map[string][]string
+	// now returns the current time; tests replace it.
+	now   func() time.Time
+	mutex sync.Mutex
 }
 
 func NewInMemoryTokenStorage() *InMemoryTokenStorage {
 	return &InMemoryTokenStorage{
-		TokenMap:     make(map[string]string),
-		LinkTokenMap: make(map[string]string),
+		TokenMap:            make(map[string]string),
+		LinkTokenMap:        make(map[string]string),
+		DoneTokenMap:        make(map[string]string),
+		SessionMap:          make(map[string]string),
+		RevocationKeyMap:    make(map[string][]RevocationKey),
+		revocationKeyExpiry: make(map[string]time.Time),
+		doneTokenExpiry:     make(map[string]time.Time),
+		linkTokensByEmail:   make(map[string][]string),
+		now:                 time.Now,
 	}
 }
 
@@ -43,10 +66,19 @@ type TokenStorage interface {
 	// and return an error in any case where it fails to do so.
 	RetrieveToken(email string) (string, error)
 
-	// Should remove the token and return an error if it fails to do so.
-	// The value not being there should also be considered an error.
+	// Should remove the token, and the session it is bound to, and return an
+	// error if it fails to do so. The value not being there should also be
+	// considered an error.
 	RemoveToken(email string) error
 
+	// StoreSession binds the token of the given email address to the browser
+	// session that requested it, replacing any earlier session.
+	StoreSession(email, sessionID string) error
+
+	// RetrieveSession returns the session the token of the given email
+	// address is bound to, or an error if there is none.
+	RetrieveSession(email string) (string, error)
+
 	// StoreLinkToken stores a reverse mapping from an opaque link token to an
 	// email address. This lets the verification link carry only the opaque
 	// token while the email is looked up server-side, keeping the email out of
@@ -60,6 +92,52 @@ type TokenStorage interface {
 	// RemoveLinkToken removes the given link token mapping. The value not being
 	// there should also be considered an error.
 	RemoveLinkToken(linkToken string) error
+
+	// ListLinkTokens returns the unexpired link tokens that map to the given
+	// email address, oldest first.
+	ListLinkTokens(email string) ([]string, error)
+
+	// RemoveLinkTokensForEmail removes every link token that maps to the given
+	// email address and returns how many were removed. No link tokens being
+	// there is not an error.
+	RemoveLinkTokensForEmail(email string) (int, error)
+
+	// TrimLinkTokens removes all but the newest keep link tokens of the given
+	// email address and returns how many were removed.
+	TrimLinkTokens(email string, keep int) (int, error)
+
+	// StoreDoneToken stores a mapping from an opaque done token, handed out
+	// on successful verification, to the verified email address. Only the
+	// holder of the done token may clean up that verification.
+	StoreDoneToken(doneToken, email string) error
+
+	// RetrieveEmailByDoneToken returns the email address associated with the
+	// given done token, or an error if it is unknown or expired.
+	RetrieveEmailByDoneToken(doneToken string) (string, error)
+
+	// RemoveDoneToken removes the given done token mapping. The value not
+	// being there should also be considered an error.
+	RemoveDoneToken(doneToken string) error
+
+	// StoreRevocationKey records the revocation key of a credential issued
+	// to the given email address. It is kept for at least ttl, the validity
+	// of the credential.
+	StoreRevocationKey(email string, key RevocationKey, ttl time.Duration) error
+
+	// ListRevocationKeys returns the revocation keys of the credentials
+	// issued to the given email address.
+	ListRevocationKeys(email string) ([]RevocationKey, error)
+
+	// RemoveRevocationKey removes a revocation key of the given email
+	// address, once the credential has been revoked.
+	RemoveRevocationKey(email, key string) error
+}
+
+// RevocationKey identifies an issued credential at the IRMA server.
+type RevocationKey struct {
+	// Credential is the full credential type ID.
+	Credential string
+	Key        string
 }
 
 // ------------------------------------------------------------------------------
@@ -68,12 +146,37 @@ func createKey(namespace, email string) string {
 	return fmt.Sprintf("%s:token:%s", namespace, email)
 }
 
+func createSessionKey(namespace, email string) string {
+	return fmt.Sprintf("%s:session:%s", namespace, email)
+}
+
 func createLinkKey(namespace, linkToken string) string {
 	return fmt.Sprintf("%s:linktoken:%s", namespace, linkToken)
 }
 
+// createLinkIndexKey names the sorted set of link tokens issued for an email
+// address, scored by the time they were stored. Its members may outlive the
+// link tokens themselves, so readers check that each link key still exists.
+func createLinkIndexKey(namespace, email string) string {
+	return fmt.Sprintf("%s:linktokens:%s", namespace, email)
+}
+
+func createDoneKey(namespace, doneToken string) string {
+	return fmt.Sprintf("%s:donetoken:%s", namespace, doneToken)
+}
+
+// createRevocationKey names the hash of revocation keys of an email address,
+// mapping each key to its credential type.
+func createRevocationKey(namespace, email string) string {
+	return fmt.Sprintf("%s:revocation:%s", namespace, email)
+}
+
 const Timeout time.Duration = 24 * time.Hour
 
+// DoneTokenTimeout bounds how long after verification the issuance may be
+// cleaned up.
+const DoneTokenTimeout time.Duration = time.Hour
+
 func (s *RedisTokenStorage) StoreToken(email, token string) error {
 	ctx := context.Background()
 	return s.client.Set(ctx, createKey(s.namespace, email), token, Timeout).Err()
@@ -86,12 +189,30 @@ func (s *RedisTokenStorage) RetrieveToken(email string) (string, error) {
 
 func (s *RedisTokenStorage) RemoveToken(email string) error {
 	ctx := context.Background()
-	return s.client.Del(ctx, createKey(s.namespace, email)).Err()
+	return s.client.Del(ctx, createKey(s.namespace, email), createSessionKey(s.namespace, email)).Err()
+}
+
+func (s *RedisTokenStorage) StoreSession(email, sessionID string) error {
+	ctx := context.Background()
+	return s.client.Set(ctx, createSessionKey(s.namespace, email), sessionID, Timeout).Err()
+}
+
+func (s *RedisTokenStorage) RetrieveSession(email string) (string, error) {
+	ctx := context.Background()
+	return s.client.Get(ctx, createSessionKey(s.namespace, email)).Result()
 }
 
 func (s *RedisTokenStorage) StoreLinkToken(linkToken, email string) error {
 	ctx := context.Background()
-	return s.client.Set(ctx, createLinkKey(s.namespace, linkToken), email, Timeout).Err()
+	indexKey := createLinkIndexKey(s.namespace, email)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, createLinkKey(s.namespace, linkToken), email, Timeout)
+		pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(time.Now().UnixNano()), Member: linkToken})
+		// The index lives as long as the newest link token in it.
+		pipe.Expire(ctx, indexKey, Timeout)
+		return nil
+	})
+	return err
 }
 
 func (s *RedisTokenStorage) RetrieveEmailByLinkToken(linkToken string) (string, error) {
@@ -101,7 +222,180 @@ func (s *RedisTokenStorage) RetrieveEmailByLinkToken(linkToken string) (string,
 
 func (s *RedisTokenStorage) RemoveLinkToken(linkToken string) error {
 	ctx := context.Background()
-	return s.client.Del(ctx, createLinkKey(s.namespace, linkToken)).Err()
+	linkKey := createLinkKey(s.namespace, linkToken)
+	email, err := s.client.Get(ctx, linkKey).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, linkKey)
+		pipe.ZRem(ctx, createLinkIndexKey(s.namespace, email), linkToken)
+		return nil
+	})
+	return err
+}
+
+func (s *RedisTokenStorage) ListLinkTokens(email string) ([]string, error) {
+	return s.listLinkTokens(context.Background(), s.client, email)
+}
+
+func (s *RedisTokenStorage) listLinkTokens(ctx context.Context, c redis.Cmdable, email string) ([]string, error) {
+	members, err := c.ZRange(ctx, createLinkIndexKey(s.namespace, email), 0, -1).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(members))
+	for i, linkToken := range members {
+		keys[i] = createLinkKey(s.namespace, linkToken)
+	}
+	values, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var linkTokens []string
+	for i, v := range values {
+		// Skip link tokens that expired or were removed but are still in the
+		// index.
+		if stored, ok := v.(string); ok && stored == email {
+			linkTokens = append(linkTokens, members[i])
+		}
+	}
+	return linkTokens, nil
+}
+
+// maxLinkIndexAttempts bounds how often an update of a link index is tried
+// while concurrent requests keep changing the index.
+const maxLinkIndexAttempts = 10
+
+// updateLinkIndex lists the link tokens of email and hands them to update,
+// which queues its changes on pipe. The index is watched while it is read, so
+// when a link is stored for email in between, the transaction fails and is
+// tried again; otherwise that link could lose its index entry and stay
+// redeemable after the links of email were revoked.
+func (s *RedisTokenStorage) updateLinkIndex(email string, update func(pipe redis.Pipeliner, linkTokens []string)) (int, error) {
+	ctx := context.Background()
+	for range maxLinkIndexAttempts {
+		var n int
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			linkTokens, err := s.listLinkTokens(ctx, tx, email)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				n = len(linkTokens)
+				update(pipe, linkTokens)
+				return nil
+			})
+			return err
+		}, createLinkIndexKey(s.namespace, email))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return n, err
+		}
+	}
+	return 0, fmt.Errorf("link token index kept changing, gave up after %d attempts", maxLinkIndexAttempts)
+}
+
+func (s *RedisTokenStorage) RemoveLinkTokensForEmail(email string) (int, error) {
+	ctx := context.Background()
+	return s.updateLinkIndex(email, func(pipe redis.Pipeliner, linkTokens []string) {
+		keys := []string{createLinkIndexKey(s.namespace, email)}
+		for _, linkToken := range linkTokens {
+			keys = append(keys, createLinkKey(s.namespace, linkToken))
+		}
+		pipe.Del(ctx, keys...)
+	})
+}
+
+func (s *RedisTokenStorage) TrimLinkTokens(email string, keep int) (int, error) {
+	ctx := context.Background()
+	stale := 0
+	_, err := s.updateLinkIndex(email, func(pipe redis.Pipeliner, linkTokens []string) {
+		stale = max(len(linkTokens)-keep, 0)
+		if stale == 0 {
+			return
+		}
+		keys := make([]string, stale)
+		members := make([]any, stale)
+		for i, linkToken := range linkTokens[:stale] {
+			keys[i] = createLinkKey(s.namespace, linkToken)
+			members[i] = linkToken
+		}
+		pipe.Del(ctx, keys...)
+		pipe.ZRem(ctx, createLinkIndexKey(s.namespace, email), members...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return stale, nil
+}
+
+func (s *RedisTokenStorage) StoreDoneToken(doneToken, email string) error {
+	ctx := context.Background()
+	return s.client.Set(ctx, createDoneKey(s.namespace, doneToken), email, DoneTokenTimeout).Err()
+}
+
+func (s *RedisTokenStorage) RetrieveEmailByDoneToken(doneToken string) (string, error) {
+	ctx := context.Background()
+	return s.client.Get(ctx, createDoneKey(s.namespace, doneToken)).Result()
+}
+
+func (s *RedisTokenStorage) RemoveDoneToken(doneToken string) error {
+	ctx := context.Background()
+	n, err := s.client.Del(ctx, createDoneKey(s.namespace, doneToken)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to remove done token, because it wasn't there")
+	}
+	return nil
+}
+
+func (s *RedisTokenStorage) StoreRevocationKey(email string, key RevocationKey, ttl time.Duration) error {
+	ctx := context.Background()
+	hashKey := createRevocationKey(s.namespace, email)
+	if err := s.client.HSet(ctx, hashKey, key.Key, key.Credential).Err(); err != nil {
+		return err
+	}
+	// The hash expires with the longest-lived credential in it.
+	current, err := s.client.TTL(ctx, hashKey).Result()
+	if err != nil {
+		return err
+	}
+	if current < ttl {
+		return s.client.Expire(ctx, hashKey, ttl).Err()
+	}
+	return nil
+}
+
+func (s *RedisTokenStorage) ListRevocationKeys(email string) ([]RevocationKey, error) {
+	ctx := context.Background()
+	fields, err := s.client.HGetAll(ctx, createRevocationKey(s.namespace, email)).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]RevocationKey, 0, len(fields))
+	for key, credential := range fields {
+		keys = append(keys, RevocationKey{Credential: credential, Key: key})
+	}
+	return keys, nil
+}
+
+func (s *RedisTokenStorage) RemoveRevocationKey(email, key string) error {
+	ctx := context.Background()
+	n, err := s.client.HDel(ctx, createRevocationKey(s.namespace, email), key).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to remove revocation key, because it wasn't there")
+	}
+	return nil
 }
 
 // ------------------------------------------------------------------------------
@@ -131,17 +425,38 @@ func (s *InMemoryTokenStorage) RemoveToken(email string) error {
 
 	if _, ok := s.TokenMap[email]; ok {
 		delete(s.TokenMap, email)
+		delete(s.SessionMap, email)
 		return nil
 	} else {
 		return fmt.Errorf("failed to remove token for %s, because it wasn't there", email)
 	}
 }
 
+func (s *InMemoryTokenStorage) StoreSession(email, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.SessionMap[email] = sessionID
+	return nil
+}
+
+func (s *InMemoryTokenStorage) RetrieveSession(email string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if sessionID, ok := s.SessionMap[email]; ok {
+		return sessionID, nil
+	} else {
+		return "", fmt.Errorf("failed to find session for %s", email)
+	}
+}
+
 func (s *InMemoryTokenStorage) StoreLinkToken(linkToken, email string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	s.LinkTokenMap[linkToken] = email
+	s.linkTokensByEmail[email] = append(s.linkTokensByEmail[email], linkToken)
 	return nil
 }
 
@@ -160,10 +475,176 @@ func (s *InMemoryTokenStorage) RemoveLinkToken(linkToken string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	if _, ok := s.LinkTokenMap[linkToken]; ok {
+	if email, ok := s.LinkTokenMap[linkToken]; ok {
 		delete(s.LinkTokenMap, linkToken)
+		s.unindexLinkToken(email, linkToken)
 		return nil
 	} else {
 		return fmt.Errorf("failed to remove link token, because it wasn't there")
 	}
 }
+
+func (s *InMemoryTokenStorage) unindexLinkToken(email, linkToken string) {
+	s.linkTokensByEmail[email] = slices.DeleteFunc(s.linkTokensByEmail[email], func(t string) bool { return t == linkToken })
+	if len(s.linkTokensByEmail[email]) == 0 {
+		delete(s.linkTokensByEmail, email)
+	}
+}
+
+func (s *InMemoryTokenStorage) ListLinkTokens(email string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.linkTokensByEmail[email]), nil
+}
+
+func (s *InMemoryTokenStorage) RemoveLinkTokensForEmail(email string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	n := len(s.linkTokensByEmail[email])
+	for _, linkToken := range s.linkTokensByEmail[email] {
+		delete(s.LinkTokenMap, linkToken)
+	}
+	delete(s.linkTokensByEmail, email)
+	return n, nil
+}
+
+func (s *InMemoryTokenStorage) TrimLinkTokens(email string, keep int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	linkTokens := s.linkTokensByEmail[email]
+	if len(linkTokens) <= keep {
+		return 0, nil
+	}
+	stale := linkTokens[:len(linkTokens)-keep]
+	for _, linkToken := range stale {
+		delete(s.LinkTokenMap, linkToken)
+	}
+	if keep == 0 {
+		delete(s.linkTokensByEmail, email)
+	} else {
+		s.linkTokensByEmail[email] = slices.Clone(linkTokens[len(stale):])
+	}
+	return len(stale), nil
+}
+
+func (s *InMemoryTokenStorage) StoreDoneToken(doneToken, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Drop the expired done tokens, so the tokens of clients that never
+	// called /api/done do not pile up.
+	s.pruneDoneTokens()
+	s.DoneTokenMap[doneToken] = email
+	s.doneTokenExpiry[doneToken] = s.now().Add(DoneTokenTimeout)
+	return nil
+}
+
+// pruneDoneTokens removes the expired done tokens. The caller must hold the
+// mutex.
+func (s *InMemoryTokenStorage) pruneDoneTokens() {
+	now := s.now()
+	for doneToken, expiry := range s.doneTokenExpiry {
+		if !now.Before(expiry) {
+			delete(s.DoneTokenMap, doneToken)
+			delete(s.doneTokenExpiry, doneToken)
+		}
+	}
+}
+
+// doneTokenLocked returns the email address of doneToken, dropping the token
+// when it expired. The caller must hold the mutex.
+func (s *InMemoryTokenStorage) doneTokenLocked(doneToken string) (string, bool) {
+	email, ok := s.DoneTokenMap[doneToken]
+	if ok && !s.now().Before(s.doneTokenExpiry[doneToken]) {
+		delete(s.DoneTokenMap, doneToken)
+		delete(s.doneTokenExpiry, doneToken)
+		return "", false
+	}
+	return email, ok
+}
+
+func (s *InMemoryTokenStorage) RetrieveEmailByDoneToken(doneToken string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if email, ok := s.doneTokenLocked(doneToken); ok {
+		return email, nil
+	} else {
+		return "", fmt.Errorf("failed to find email for done token")
+	}
+}
+
+func (s *InMemoryTokenStorage) RemoveDoneToken(doneToken string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.doneTokenLocked(doneToken); ok {
+		delete(s.DoneTokenMap, doneToken)
+		delete(s.doneTokenExpiry, doneToken)
+		return nil
+	} else {
+		return fmt.Errorf("failed to remove done token, because it wasn't there")
+	}
+}
+
+func (s *InMemoryTokenStorage) StoreRevocationKey(email string, key RevocationKey, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Drop the expired keys of every address, so keys of credentials that
+	// are no longer valid do not pile up.
+	for e := range s.RevocationKeyMap {
+		s.pruneRevocationKeys(e)
+	}
+	s.RevocationKeyMap[email] = append(s.RevocationKeyMap[email], key)
+	s.revocationKeyExpiry[key.Key] = s.now().Add(ttl)
+	return nil
+}
+
+func (s *InMemoryTokenStorage) ListRevocationKeys(email string) ([]RevocationKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pruneRevocationKeys(email)
+	return slices.Clone(s.RevocationKeyMap[email]), nil
+}
+
+// pruneRevocationKeys removes the expired revocation keys of email. The
+// caller must hold the mutex.
+func (s *InMemoryTokenStorage) pruneRevocationKeys(email string) {
+	now := s.now()
+	keys := slices.DeleteFunc(s.RevocationKeyMap[email], func(k RevocationKey) bool {
+		if now.Before(s.revocationKeyExpiry[k.Key]) {
+			return false
+		}
+		delete(s.revocationKeyExpiry, k.Key)
+		return true
+	})
+	if len(keys) == 0 {
+		delete(s.RevocationKeyMap, email)
+	} else {
+		s.RevocationKeyMap[email] = keys
+	}
+}
+
+func (s *InMemoryTokenStorage) RemoveRevocationKey(email, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := s.RevocationKeyMap[email]
+	i := slices.IndexFunc(keys, func(k RevocationKey) bool { return k.Key == key })
+	if i < 0 {
+		return fmt.Errorf("failed to remove revocation key, because it wasn't there")
+	}
+	keys = slices.Delete(keys, i, i+1)
+	delete(s.revocationKeyExpiry, key)
+	if len(keys) == 0 {
+		delete(s.RevocationKeyMap, email)
+	} else {
+		s.RevocationKeyMap[email] = keys
+	}
+	return nil
+}
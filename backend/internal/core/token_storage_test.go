@@ -1,9 +1,13 @@
 package core
 
 import (
+	"context"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
 )
 
@@ -74,3 +78,294 @@ func TestInMemoryLinkTokenIndependentFromCode(t *testing.T) {
 
 	require.False(t, strings.Contains("link", "@"))
 }
+
+func testLinkTokenIndex(t *testing.T, s TokenStorage) {
+	t.Helper()
+	require.NoError(t, s.StoreLinkToken("link-1", "user@example.com"))
+	require.NoError(t, s.StoreLinkToken("link-2", "user@example.com"))
+	require.NoError(t, s.StoreLinkToken("link-3", "other@example.com"))
+
+	linkTokens, err := s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"link-1", "link-2"}, linkTokens)
+
+	// Removing a single link token also drops it from the index.
+	require.NoError(t, s.RemoveLinkToken("link-1"))
+	linkTokens, err = s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"link-2"}, linkTokens)
+
+	n, err := s.RemoveLinkTokensForEmail("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	_, err = s.RetrieveEmailByLinkToken("link-2")
+	require.Error(t, err)
+	linkTokens, err = s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.Empty(t, linkTokens)
+
+	// Other addresses are unaffected, and an address without link tokens is
+	// not an error.
+	email, err := s.RetrieveEmailByLinkToken("link-3")
+	require.NoError(t, err)
+	require.Equal(t, "other@example.com", email)
+	n, err = s.RemoveLinkTokensForEmail("nobody@example.com")
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestInMemoryLinkTokenIndex(t *testing.T) {
+	testLinkTokenIndex(t, NewInMemoryTokenStorage())
+}
+
+func TestRedisLinkTokenIndex(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	s := NewRedisTokenStorage(client, "test")
+
+	testLinkTokenIndex(t, s)
+
+	// Link tokens that expired are no longer listed, even though the index
+	// still holds them.
+	require.NoError(t, s.StoreLinkToken("link-4", "expiring@example.com"))
+	mr.Del(createLinkKey("test", "link-4"))
+	linkTokens, err := s.ListLinkTokens("expiring@example.com")
+	require.NoError(t, err)
+	require.Empty(t, linkTokens)
+}
+
+// storeOnceHook stores a link token through other right before the first
+// MGET of the client it is added to, like a concurrent /api/send would.
+type storeOnceHook struct {
+	other *RedisTokenStorage
+	done  bool
+}
+
+func (h *storeOnceHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *storeOnceHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "mget" && !h.done {
+			h.done = true
+			if err := h.other.StoreLinkToken("link-late", "user@example.com"); err != nil {
+				return err
+			}
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *storeOnceHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisRemoveLinkTokensRacingStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = other.Close() })
+	s := NewRedisTokenStorage(client, "test")
+	require.NoError(t, s.StoreLinkToken("link-1", "user@example.com"))
+
+	// A link stored while the index is read must not survive the removal
+	// without an index entry.
+	client.AddHook(&storeOnceHook{other: NewRedisTokenStorage(other, "test")})
+	n, err := s.RemoveLinkTokensForEmail("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	_, err = s.RetrieveEmailByLinkToken("link-late")
+	require.Error(t, err)
+	require.False(t, mr.Exists(createLinkIndexKey("test", "user@example.com")))
+}
+
+func TestRedisTrimLinkTokensRacingStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = other.Close() })
+	s := NewRedisTokenStorage(client, "test")
+	require.NoError(t, s.StoreLinkToken("link-1", "user@example.com"))
+	require.NoError(t, s.StoreLinkToken("link-2", "user@example.com"))
+	require.NoError(t, s.StoreLinkToken("link-3", "user@example.com"))
+
+	// The link stored while the index is read counts towards keep.
+	client.AddHook(&storeOnceHook{other: NewRedisTokenStorage(other, "test")})
+	n, err := s.TrimLinkTokens("user@example.com", 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	linkTokens, err := s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"link-3", "link-late"}, linkTokens)
+}
+
+func testTrimLinkTokens(t *testing.T, s TokenStorage) {
+	t.Helper()
+	for _, link := range []string{"link-1", "link-2", "link-3"} {
+		require.NoError(t, s.StoreLinkToken(link, "user@example.com"))
+		// Keep the store times distinct so the order is well defined.
+		time.Sleep(time.Millisecond)
+	}
+
+	n, err := s.TrimLinkTokens("user@example.com", 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	linkTokens, err := s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"link-2", "link-3"}, linkTokens)
+	_, err = s.RetrieveEmailByLinkToken("link-1")
+	require.Error(t, err)
+
+	// Trimming to more than there are is a no-op.
+	n, err = s.TrimLinkTokens("user@example.com", 5)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	n, err = s.TrimLinkTokens("user@example.com", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	linkTokens, err = s.ListLinkTokens("user@example.com")
+	require.NoError(t, err)
+	require.Empty(t, linkTokens)
+}
+
+func TestInMemoryTrimLinkTokens(t *testing.T) {
+	testTrimLinkTokens(t, NewInMemoryTokenStorage())
+}
+
+func TestRedisTrimLinkTokens(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	testTrimLinkTokens(t, NewRedisTokenStorage(client, "test"))
+}
+
+func testDoneTokenRoundTrip(t *testing.T, s TokenStorage) {
+	t.Helper()
+	_, err := s.RetrieveEmailByDoneToken("done")
+	require.Error(t, err)
+
+	require.NoError(t, s.StoreDoneToken("done", "user@example.com"))
+	email, err := s.RetrieveEmailByDoneToken("done")
+	require.NoError(t, err)
+	require.Equal(t, "user@example.com", email)
+
+	require.NoError(t, s.RemoveDoneToken("done"))
+	_, err = s.RetrieveEmailByDoneToken("done")
+	require.Error(t, err)
+	require.Error(t, s.RemoveDoneToken("done"))
+}
+
+func TestInMemoryDoneTokenRoundTrip(t *testing.T) {
+	s := NewInMemoryTokenStorage()
+	testDoneTokenRoundTrip(t, s)
+
+	// Done tokens expire after DoneTokenTimeout, like in Redis, also when
+	// they are never used.
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.StoreDoneToken("unused", "user@example.com"))
+	now = now.Add(DoneTokenTimeout - time.Second)
+	_, err := s.RetrieveEmailByDoneToken("unused")
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = s.RetrieveEmailByDoneToken("unused")
+	require.Error(t, err)
+
+	// Storing a token drops the expired ones.
+	require.NoError(t, s.StoreDoneToken("abandoned", "user@example.com"))
+	now = now.Add(DoneTokenTimeout)
+	require.NoError(t, s.StoreDoneToken("done", "user@example.com"))
+	require.Equal(t, map[string]string{"done": "user@example.com"}, s.DoneTokenMap)
+	require.Len(t, s.doneTokenExpiry, 1)
+}
+
+func TestRedisDoneTokenRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	testDoneTokenRoundTrip(t, NewRedisTokenStorage(client, "test"))
+}
+
+func testSessionRoundTrip(t *testing.T, s TokenStorage) {
+	t.Helper()
+	_, err := s.RetrieveSession("user@example.com")
+	require.Error(t, err)
+
+	require.NoError(t, s.StoreToken("user@example.com", "ABC123"))
+	require.NoError(t, s.StoreSession("user@example.com", "session-1"))
+	require.NoError(t, s.StoreSession("user@example.com", "session-2"))
+	sessionID, err := s.RetrieveSession("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, "session-2", sessionID)
+
+	// The session is spent together with the code.
+	require.NoError(t, s.RemoveToken("user@example.com"))
+	_, err = s.RetrieveSession("user@example.com")
+	require.Error(t, err)
+}
+
+func TestInMemorySessionRoundTrip(t *testing.T) {
+	testSessionRoundTrip(t, NewInMemoryTokenStorage())
+}
+
+func TestRedisSessionRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	testSessionRoundTrip(t, NewRedisTokenStorage(client, "test"))
+}
+
+func testRevocationKeys(t *testing.T, s TokenStorage) {
+	t.Helper()
+	keys, err := s.ListRevocationKeys("user@example.com")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	first := RevocationKey{Credential: "pbdf.sidn-pbdf.email", Key: "key-1"}
+	second := RevocationKey{Credential: "irma-demo.sidn-pbdf.email", Key: "key-2"}
+	require.NoError(t, s.StoreRevocationKey("user@example.com", first, time.Hour))
+	require.NoError(t, s.StoreRevocationKey("user@example.com", second, time.Minute))
+	keys, err = s.ListRevocationKeys("user@example.com")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []RevocationKey{first, second}, keys)
+
+	require.NoError(t, s.RemoveRevocationKey("user@example.com", "key-1"))
+	require.Error(t, s.RemoveRevocationKey("user@example.com", "key-1"))
+	keys, err = s.ListRevocationKeys("user@example.com")
+	require.NoError(t, err)
+	require.Equal(t, []RevocationKey{second}, keys)
+}
+
+func TestInMemoryRevocationKeys(t *testing.T) {
+	s := NewInMemoryTokenStorage()
+	testRevocationKeys(t, s)
+
+	// Each key expires with its own credential.
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.StoreRevocationKey("other@example.com", RevocationKey{Credential: "pbdf.sidn-pbdf.email", Key: "key-3"}, time.Hour))
+	now = now.Add(2 * time.Minute)
+	keys, err := s.ListRevocationKeys("user@example.com")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	require.Len(t, s.RevocationKeyMap["other@example.com"], 1)
+
+	// Storing a key drops the expired keys of other addresses as well.
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, s.StoreRevocationKey("user@example.com", RevocationKey{Credential: "pbdf.sidn-pbdf.email", Key: "key-4"}, time.Hour))
+	require.NotContains(t, s.RevocationKeyMap, "other@example.com")
+	require.Len(t, s.revocationKeyExpiry, 1)
+}
+
+func TestRedisRevocationKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	testRevocationKeys(t, NewRedisTokenStorage(client, "test"))
+
+	// The keys expire with the longest-lived credential.
+	require.Equal(t, time.Hour, mr.TTL("test:revocation:user@example.com"))
+}
@@ -0,0 +1,265 @@
+package httpapi
+
+import (
+	"backend/internal/audit"
+	"backend/internal/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// adminCredential is a parsed config.AdminCredential.
+type adminCredential struct {
+	name      string
+	tokenHash []byte
+	scopes    []string
+}
+
+// adminPrincipal is an authenticated admin caller.
+type adminPrincipal struct {
+	// identity is recorded in the audit log: the credential name for static
+	// tokens, "cert:<name>" for client certificates and "jwt:<sub>" for JWT
+	// access tokens.
+	identity string
+	scopes   []string
+}
+
+// adminJWTVerifier validates JWT access tokens against the keys of a local
+// JWKS file.
+type adminJWTVerifier struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// adminAuth is the complete set of admin authentication methods. It is
+// swapped atomically by ReloadAdminCredentials.
+type adminAuth struct {
+	tokens []adminCredential
+	// certSubjects maps a client certificate subject to its principal.
+	certSubjects map[string]adminPrincipal
+	// jwt is nil when JWT access tokens are not accepted.
+	jwt *adminJWTVerifier
+}
+
+func (a *adminAuth) enabled() bool {
+	return len(a.tokens) > 0 || len(a.certSubjects) > 0 || a.jwt != nil
+}
+
+// buildAdminAuth turns the admin settings of the app config into their parsed
+// form. The legacy admin_token becomes a credential with every scope. Entries
+// that fail to parse are skipped; the config is validated at load time, so
+// that should not happen. An error is returned when the JWKS file cannot be
+// loaded, together with the other methods so callers can decide whether to
+// use them.
+func buildAdminAuth(app config.AppConfig, logger *slog.Logger) (*adminAuth, error) {
+	auth := &adminAuth{}
+	if app.AdminToken != "" {
+		sum := sha256.Sum256([]byte(app.AdminToken))
+		auth.tokens = append(auth.tokens, adminCredential{
+			name:      config.LegacyAdminCredentialName,
+			tokenHash: sum[:],
+			scopes:    config.AdminScopes,
+		})
+	}
+	for _, c := range app.AdminCredentials {
+		hash, err := hex.DecodeString(c.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			logger.Warn("admin: ignoring admin credential with invalid token_sha256", "credential", c.Name)
+			continue
+		}
+		auth.tokens = append(auth.tokens, adminCredential{name: c.Name, tokenHash: hash, scopes: c.Scopes})
+	}
+
+	if cc := app.AdminClientCerts; cc != nil {
+		auth.certSubjects = make(map[string]adminPrincipal, len(cc.Subjects))
+		for _, s := range cc.Subjects {
+			auth.certSubjects[s.Subject] = adminPrincipal{identity: "cert:" + s.Name, scopes: s.Scopes}
+		}
+	}
+
+	if aj := app.AdminJWT; aj != nil {
+		keys, err := config.LoadJWKS(aj.JWKSPath)
+		if err != nil {
+			return auth, err
+		}
+		auth.jwt = &adminJWTVerifier{keys: keys, issuer: aj.Issuer, audience: aj.Audience}
+	}
+	return auth, nil
+}
+
+// ReloadAdminCredentials swaps in the admin credentials of app, so tokens,
+// certificate subjects and JWKS keys can be rotated without a restart.
+// Requests that are already being authorized finish against the previous set.
+// When the JWKS file cannot be loaded the previous set is kept.
+func (a *API) ReloadAdminCredentials(app config.AppConfig) {
+	auth, err := buildAdminAuth(app, a.logger)
+	if err != nil {
+		a.logger.Error("admin: keeping previous admin credentials", "error", err)
+		return
+	}
+	a.adminAuth.Store(auth)
+	a.logger.Info("admin: loaded admin credentials",
+		"tokens", len(auth.tokens), "certificate_subjects", len(auth.certSubjects), "jwt", auth.jwt != nil)
+}
+
+// authorizeAdmin authenticates the request and checks that the caller carries
+// scope. It accepts, in this order, a verified client certificate with a
+// configured subject, a JWT access token and a static bearer token. On
+// success it returns the caller's identity, for the audit log. Otherwise it
+// writes the appropriate error response and returns ok=false.
+func (a *API) authorizeAdmin(w http.ResponseWriter, r *http.Request, scope string) (identity string, ok bool) {
+	auth := a.adminAuth.Load()
+	if !auth.enabled() {
+		a.writeError(w, r, http.StatusForbidden, "admin_endpoint_disabled")
+		return "", false
+	}
+
+	principal, err := auth.authenticate(r)
+	if err != nil {
+		// Log rejected attempts so repeated failures (e.g. token guessing)
+		// against this network-reachable route are visible in the logs.
+		a.logger.WarnContext(r.Context(), "admin: rejected request", "ip", a.clientIP(r), "error", err)
+		a.recordAudit(r, audit.Event{Type: audit.EventAdminRejected, Outcome: audit.OutcomeFailure, Reason: "unauthorized",
+			Details: map[string]string{"scope": scope, "error": err.Error()}})
+		a.writeError(w, r, http.StatusUnauthorized, "unauthorized")
+		return "", false
+	}
+
+	if !slices.Contains(principal.scopes, scope) {
+		a.logger.WarnContext(r.Context(), "admin: rejected request, missing scope", "admin", principal.identity, "ip", a.clientIP(r), "scope", scope)
+		a.recordAudit(r, audit.Event{Type: audit.EventAdminRejected, Outcome: audit.OutcomeFailure, Actor: principal.identity, Reason: "insufficient_scope",
+			Details: map[string]string{"scope": scope}})
+		a.writeError(w, r, http.StatusForbidden, "insufficient_scope")
+		return "", false
+	}
+	return principal.identity, true
+}
+
+func (a *adminAuth) authenticate(r *http.Request) (adminPrincipal, error) {
+	// Client certificates are only present in VerifiedChains after the TLS
+	// handshake checked them against the configured CA.
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(a.certSubjects) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.String()
+		if p, ok := a.certSubjects[subject]; ok {
+			return p, nil
+		}
+		if r.Header.Get("Authorization") == "" {
+			return adminPrincipal{}, fmt.Errorf("unknown certificate subject %q", subject)
+		}
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.jwt != nil && strings.Count(provided, ".") == 2 {
+		return a.jwt.verify(provided)
+	}
+	return a.matchToken(provided)
+}
+
+// matchToken compares the SHA-256 hash of the provided token in constant time
+// against every static credential, so the timing does not reveal which one
+// (if any) matched.
+func (a *adminAuth) matchToken(provided string) (adminPrincipal, error) {
+	providedHash := sha256.Sum256([]byte(provided))
+
+	var match *adminCredential
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(providedHash[:], a.tokens[i].tokenHash) == 1 {
+			match = &a.tokens[i]
+		}
+	}
+	if match == nil {
+		return adminPrincipal{}, errors.New("invalid token")
+	}
+	return adminPrincipal{identity: match.name, scopes: match.scopes}, nil
+}
+
+// verify validates the signature, expiry, issuer and audience of an access
+// token and returns its subject and scopes.
+func (v *adminJWTVerifier) verify(tokenString string) (adminPrincipal, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, v.keyFor)
+	if err != nil {
+		return adminPrincipal{}, fmt.Errorf("invalid JWT: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return adminPrincipal{}, errors.New("invalid JWT: missing or expired exp")
+	}
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return adminPrincipal{}, errors.New("invalid JWT: wrong issuer")
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return adminPrincipal{}, errors.New("invalid JWT: wrong audience")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return adminPrincipal{}, errors.New("invalid JWT: missing sub")
+	}
+	return adminPrincipal{identity: "jwt:" + sub, scopes: jwtScopes(claims)}, nil
+}
+
+// keyFor selects the verification key named by the token's kid header. A
+// token without kid is accepted when the JWKS holds a single key. The signing
+// method must match the key type, so an RSA key can never be used to verify
+// e.g. an HMAC signature.
+func (v *adminJWTVerifier) keyFor(token *jwt.Token) (interface{}, error) {
+	var key crypto.PublicKey
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = v.keys[kid]
+	} else if len(v.keys) == 1 {
+		for _, k := range v.keys {
+			key = k
+		}
+	}
+	if key == nil {
+		return nil, errors.New("unknown key")
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing method %s does not match the key", token.Method.Alg())
+}
+
+// jwtScopes reads the scopes from the space-separated "scope" claim (RFC 8693)
+// or, failing that, the "scp" claim as used by several identity providers.
+func jwtScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	switch scp := claims["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []interface{}:
+		var scopes []string
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package httpapi
+
+import (
+	"backend/internal/audit"
+	"backend/internal/config"
+	"backend/internal/core"
+	"backend/internal/issue"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultBlockedPageSize and maxBlockedPageSize bound the page size of
+	// the blocked-keys listing.
+	defaultBlockedPageSize = 50
+	maxBlockedPageSize     = 500
+)
+
+// rateLimitTarget is the request body of the per-user rate-limit admin
+// endpoints. Exactly one of Email and IP must be set. The target is sent in a
+// POST body rather than a query string so email addresses stay out of access
+// logs.
+type rateLimitTarget struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// decodeRateLimitTarget reads and validates a rateLimitTarget. On success it
+// returns the normalised email address or IP (the other one is empty). It
+// writes the error response and returns ok=false otherwise.
+func (a *API) decodeRateLimitTarget(w http.ResponseWriter, r *http.Request) (email, ip string, ok bool) {
+	var req rateLimitTarget
+	// Before IP targets existed a missing target was reported as
+	// email_required; clients may still branch on that code.
+	if err := decodeJSON(w, r, &req); err != nil || (req.Email == "" && req.IP == "") {
+		a.writeError(w, r, http.StatusBadRequest, "email_required")
+		return "", "", false
+	}
+	if req.Email != "" && req.IP != "" {
+		a.writeError(w, r, http.StatusBadRequest, "email_and_ip_exclusive")
+		return "", "", false
+	}
+
+	if req.IP != "" {
+		if net.ParseIP(strings.TrimSpace(req.IP)) == nil {
+			a.writeError(w, r, http.StatusBadRequest, "error_ip_format")
+			return "", "", false
+		}
+		return "", core.NormalizeIP(req.IP), true
+	}
+
+	valid, parsedAddress, errCode := a.emailValidator.ParseAndValidateEmailAddressContext(r.Context(), req.Email)
+	if !valid {
+		a.writeError(w, r, http.StatusBadRequest, *errCode)
+		return "", "", false
+	}
+	return *parsedAddress, "", true
+}
+
+// handleResetRateLimit clears the rate-limit counter for a single email
+// address or IP address. It is meant for operators to unblock a user who
+// locked themselves out by mistake, or an office behind a shared NAT address.
+// Resetting an IP clears the counter of the prefix or range it is aggregated
+// into. Access requires an admin credential with the ratelimit:reset scope,
+// passed as "Authorization: Bearer <token>" (see authorizeAdmin). When no
+// admin credential is configured the endpoint is disabled.
+func (a *API) handleResetRateLimit(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeRateLimitReset)
+	if !ok {
+		return
+	}
+
+	email, ip, ok := a.decodeRateLimitTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if a.limiter == nil {
+		a.writeError(w, r, http.StatusInternalServerError, "rate_limiter_not_configured")
+		return
+	}
+
+	target := email
+	var err error
+	if ip != "" {
+		target = ip
+		err = a.limiter.ResetIP(r.Context(), ip)
+	} else {
+		err = a.limiter.ResetEmail(r.Context(), email)
+	}
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_resetting_rate_limit")
+		return
+	}
+
+	// Audit trail: admin reset actions are privileged, so record who was
+	// unblocked, by which credential and from where.
+	a.logger.InfoContext(r.Context(), "admin: rate limit reset", "target", target, "admin", identity, "ip", a.clientIP(r))
+	a.auditAdminAction(r, identity, "ratelimit_reset", email, ip)
+
+	jserr := writeJSON(w, http.StatusOK, map[string]any{
+		"message": "rate_limit_reset",
+	})
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// handleRateLimitStatus reports the current count and remaining window of the
+// counter for an email address or IP address, without counting a request.
+func (a *API) handleRateLimitStatus(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeStatsRead)
+	if !ok {
+		return
+	}
+
+	email, ip, ok := a.decodeRateLimitTarget(w, r)
+	if !ok {
+		return
+	}
+
+	if a.limiter == nil {
+		a.writeError(w, r, http.StatusInternalServerError, "rate_limiter_not_configured")
+		return
+	}
+
+	var status core.RateLimitStatus
+	var err error
+	if ip != "" {
+		status, err = a.limiter.IPStatus(r.Context(), ip)
+	} else {
+		status, err = a.limiter.EmailStatus(r.Context(), email)
+	}
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_reading_rate_limit")
+		return
+	}
+	a.auditAdminAction(r, identity, "ratelimit_status", email, ip)
+
+	jserr := writeJSON(w, http.StatusOK, rateLimitStatusJSON(status))
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// handleListBlocked lists the keys of one rate-limit dimension (email, ip or
+// domain) that are currently blocked. Results are paginated: pass the
+// returned next_cursor as the cursor query parameter to fetch the next page.
+func (a *API) handleListBlocked(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeStatsRead)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	dimension := query.Get("dimension")
+	switch dimension {
+	case core.DimensionEmail, core.DimensionIP, core.DimensionDomain:
+	default:
+		a.writeError(w, r, http.StatusBadRequest, "dimension_required")
+		return
+	}
+
+	limit := defaultBlockedPageSize
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxBlockedPageSize {
+			a.writeError(w, r, http.StatusBadRequest, "invalid_limit")
+			return
+		}
+		limit = n
+	}
+
+	if a.limiter == nil {
+		a.writeError(w, r, http.StatusInternalServerError, "rate_limiter_not_configured")
+		return
+	}
+
+	blocked, next, err := a.limiter.ListBlocked(r.Context(), dimension, query.Get("cursor"), limit)
+	if errors.Is(err, core.ErrInvalidCursor) {
+		a.writeError(w, r, http.StatusBadRequest, "invalid_cursor")
+		return
+	}
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_listing_rate_limits")
+		return
+	}
+	a.recordAudit(r, audit.Event{Type: audit.EventAdminAction, Outcome: audit.OutcomeSuccess, Actor: identity,
+		Details: map[string]string{"action": "ratelimit_list", "dimension": dimension}})
+
+	keys := make([]map[string]any, 0, len(blocked))
+	for _, status := range blocked {
+		keys = append(keys, rateLimitStatusJSON(status))
+	}
+
+	jserr := writeJSON(w, http.StatusOK, map[string]any{
+		"keys":        keys,
+		"next_cursor": next,
+	})
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// decodeAdminEmail reads the {"email": ...} body of the verification admin
+// endpoints and returns the normalised address. It writes the error response
+// and returns ok=false otherwise.
+func (a *API) decodeAdminEmail(w http.ResponseWriter, r *http.Request) (email string, ok bool) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil || req.Email == "" {
+		a.writeError(w, r, http.StatusBadRequest, "email_required")
+		return "", false
+	}
+
+	valid, parsedAddress, errCode := a.emailValidator.ParseAndValidateEmailAddressContext(r.Context(), req.Email)
+	if !valid {
+		a.writeError(w, r, http.StatusBadRequest, *errCode)
+		return "", false
+	}
+	return *parsedAddress, true
+}
+
+// handlePendingVerification reports whether an email address has an
+// outstanding verification code and how many verification links for it are
+// still valid. The code and link tokens themselves are never returned.
+func (a *API) handlePendingVerification(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeStatsRead)
+	if !ok {
+		return
+	}
+
+	email, ok := a.decodeAdminEmail(w, r)
+	if !ok {
+		return
+	}
+
+	_, codeErr := a.tokenStorage.RetrieveToken(email)
+	linkTokens, err := a.tokenStorage.ListLinkTokens(email)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_reading_tokens")
+		return
+	}
+	a.auditAdminAction(r, identity, "verification_status", email, "")
+
+	jserr := writeJSON(w, http.StatusOK, map[string]any{
+		"pending_code": codeErr == nil,
+		"link_tokens":  len(linkTokens),
+	})
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// handleRevokeVerification invalidates the outstanding verification code and
+// every verification link of an email address, e.g. after a user reports a
+// mis-sent verification email. Access requires the tokens:revoke scope.
+func (a *API) handleRevokeVerification(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeTokensRevoke)
+	if !ok {
+		return
+	}
+
+	email, ok := a.decodeAdminEmail(w, r)
+	if !ok {
+		return
+	}
+
+	// RemoveToken may report a missing code as an error, so check for one
+	// first.
+	codeRevoked := false
+	if _, err := a.tokenStorage.RetrieveToken(email); err == nil {
+		if err := a.tokenStorage.RemoveToken(email); err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, "error_removing_token")
+			return
+		}
+		codeRevoked = true
+	}
+	linkTokensRevoked, err := a.tokenStorage.RemoveLinkTokensForEmail(email)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_removing_token")
+		return
+	}
+
+	a.logger.InfoContext(r.Context(), "admin: verification revoked", "email", email, "admin", identity, "ip", a.clientIP(r),
+		"code_revoked", codeRevoked, "link_tokens_revoked", linkTokensRevoked)
+	a.auditAdminAction(r, identity, "verification_revoke", email, "")
+
+	jserr := writeJSON(w, http.StatusOK, map[string]any{
+		"message":             "verification_revoked",
+		"code_revoked":        codeRevoked,
+		"link_tokens_revoked": linkTokensRevoked,
+	})
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// handleRevokeCredential revokes every credential issued to an email address
+// that has a stored revocation key, e.g. after an address changed hands. Each
+// key is removed once the IRMA server confirmed its revocation, or reported
+// that it never issued a credential with it, e.g. for a session that was
+// abandoned. A key that fails to revoke is kept and the others are still
+// tried; the response then is a 502 that counts both, so the request can
+// simply be retried. Access requires the tokens:revoke scope.
+func (a *API) handleRevokeCredential(w http.ResponseWriter, r *http.Request) {
+	identity, ok := a.authorizeAdmin(w, r, config.ScopeTokensRevoke)
+	if !ok {
+		return
+	}
+
+	email, ok := a.decodeAdminEmail(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := a.tokenStorage.ListRevocationKeys(email)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_reading_tokens")
+		return
+	}
+
+	var jwtCreator *issue.DefaultJwtCreator
+	if len(keys) > 0 {
+		jwtCreator, err = issue.NewIrmaJwtCreator(a.cfg.JWT)
+		if err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, "jwt_creator_error")
+			return
+		}
+	}
+
+	revoked, unknown, failed := 0, 0, 0
+	for _, key := range keys {
+		err := jwtCreator.Revoke(a.irmaClient, a.cfg.JWT.IRMAServerURL, key.Credential, key.Key)
+		switch {
+		case errors.Is(err, issue.ErrUnknownRevocationKey):
+			unknown++
+		case err != nil:
+			a.logger.ErrorContext(r.Context(), "admin: revoking credential failed", "credential", key.Credential, "email", email, "error", err)
+			failed++
+			continue
+		default:
+			revoked++
+		}
+		if err := a.tokenStorage.RemoveRevocationKey(email, key.Key); err != nil {
+			a.logger.WarnContext(r.Context(), "failed to remove revocation key after revocation", "error", err)
+		}
+	}
+
+	details := map[string]string{"action": "credential_revoke", "revoked": strconv.Itoa(revoked), "unknown": strconv.Itoa(unknown)}
+	response := map[string]any{
+		"message":             "credential_revoked",
+		"credentials_revoked": revoked,
+		"unknown_keys":        unknown,
+	}
+	code := http.StatusOK
+	if failed > 0 {
+		details["failed"] = strconv.Itoa(failed)
+		a.recordAudit(r, audit.Event{Type: audit.EventAdminAction, Outcome: audit.OutcomeFailure, Actor: identity, Email: email,
+			Reason: "error_revoking_credential", Details: details})
+		delete(response, "message")
+		response["error"] = "error_revoking_credential"
+		response["credentials_failed"] = failed
+		code = http.StatusBadGateway
+	} else {
+		a.logger.InfoContext(r.Context(), "admin: credentials revoked", "count", revoked, "unknown", unknown, "email", email, "admin", identity, "ip", a.clientIP(r))
+		a.recordAudit(r, audit.Event{Type: audit.EventAdminAction, Outcome: audit.OutcomeSuccess, Actor: identity, Email: email, Details: details})
+	}
+
+	jserr := writeJSON(w, code, response)
+	if jserr != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// auditAdminAction records a successful admin action on an email address or
+// IP address target.
+func (a *API) auditAdminAction(r *http.Request, identity, action, email, ip string) {
+	details := map[string]string{"action": action}
+	if ip != "" {
+		details["target_ip"] = ip
+	}
+	a.recordAudit(r, audit.Event{Type: audit.EventAdminAction, Outcome: audit.OutcomeSuccess, Actor: identity, Email: email, Details: details})
+}
+
+func rateLimitStatusJSON(status core.RateLimitStatus) map[string]any {
+	return map[string]any{
+		"key":         status.Key,
+		"count":       status.Count,
+		"limit":       status.Limit,
+		"ttl_seconds": int(status.TTL.Seconds()),
+		"blocked":     status.Blocked,
+	}
+}
@@ -1,15 +1,25 @@
 package httpapi
 
 import (
+	"backend/internal/audit"
 	"backend/internal/config"
 	"backend/internal/core"
+	"backend/internal/logging"
 	"backend/internal/mail"
+	"backend/internal/metrics"
+	"backend/internal/validators"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -23,34 +33,84 @@ type API struct {
 	// trustedProxies holds the parsed CIDR ranges of reverse proxies whose
 	// client-IP headers we are willing to trust. See config.TrustedProxies.
 	trustedProxies []*net.IPNet
+	// emailValidator parses and normalises email addresses; domainPolicy then
+	// restricts which of their domains may be verified.
+	emailValidator validators.EmailValidator
+	domainPolicy   validators.DomainPolicy
+	// routeLimiter limits individual routes per client IP. Nil disables route
+	// limits.
+	routeLimiter *core.RouteRateLimiter
+	// adminAuth holds the parsed admin credentials, certificate subjects and
+	// JWT verifier. It is swapped atomically by ReloadAdminCredentials.
+	adminAuth atomic.Pointer[adminAuth]
+	// audit records sends, verifications, issuance and admin actions. Nil
+	// disables the audit log.
+	audit *audit.Logger
+	// metrics counts emails, verifications, rate-limit rejections and
+	// issuance, and times requests. Nil disables metrics.
+	metrics *metrics.Metrics
+	// logger receives the log lines of the API. Lines logged with a request
+	// context carry its request ID.
+	logger *slog.Logger
+	// irmaClient sends session and revocation requests to the IRMA server.
+	irmaClient *http.Client
+	// sessions tracks the issuance sessions started by the backend. Nil
+	// leaves them untracked.
+	sessions *sessionTracker
+	// readiness runs and caches the dependency checks of /api/ready.
+	readiness *readiness
 }
 
+// irmaRequestTimeout bounds requests to the IRMA server.
+const irmaRequestTimeout = 10 * time.Second
+
 func NewAPI(cfg *config.Config, limiter *core.TotalRateLimiter, mailer mail.Mailer, tokenGenerator core.TokenGenerator, tokenStorage core.TokenStorage) *API {
 	trustedProxies, err := config.ParseTrustedProxies(cfg.App.TrustedProxies)
 	if err != nil {
 		// The config is validated at load time, so this should not happen; log
 		// and continue with proxy headers untrusted rather than crashing.
-		log.Printf("warning: ignoring trusted_proxies: %s", err)
+		slog.Warn("ignoring trusted_proxies", "error", err)
+	}
+	domainPolicy := validators.DomainPolicy{Allow: cfg.App.AllowedEmailDomains, Deny: cfg.App.DeniedEmailDomains}
+	a := &API{cfg: cfg, limiter: limiter, mailer: mailer, tokenGenerator: tokenGenerator, tokenStorage: tokenStorage, trustedProxies: trustedProxies, domainPolicy: domainPolicy,
+		logger: slog.Default(), irmaClient: &http.Client{Timeout: irmaRequestTimeout},
+		readiness: newReadiness(cfg.Readiness.CacheTTLOrDefault(), signingKeyCheck(cfg.JWT), templatesCheck(cfg.Mail))}
+	adminAuth, err := buildAdminAuth(cfg.App, a.logger)
+	if err != nil {
+		// As above: validated at load time. Continue without JWT access
+		// tokens; the other admin credentials still work.
+		a.logger.Warn("ignoring admin_jwt", "error", err)
 	}
-	return &API{cfg: cfg, limiter: limiter, mailer: mailer, tokenGenerator: tokenGenerator, tokenStorage: tokenStorage, trustedProxies: trustedProxies}
+	a.adminAuth.Store(adminAuth)
+	return a
 }
 
 // Routes returns app's router
 
 func (a *API) Routes() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(a.traceRoutes)
+	r.Use(a.assignRequestID)
+	r.Use(a.instrumentRoutes)
+	r.Use(a.rateLimitRoutes)
 
 	r.HandleFunc("/api/health", a.handleHealthCheck).Methods("GET")
+	r.HandleFunc("/api/ready", a.handleReady).Methods("GET")
 	r.HandleFunc("/api/verify", a.handleVerifyEmail).Methods("POST")
 	r.HandleFunc("/api/verify-link", a.handleVerifyLink).Methods("POST")
-	r.HandleFunc("/api/done", a.handleVerifyDone).Methods("GET")
+	r.HandleFunc("/api/done", a.handleVerifyDone).Methods("POST")
 	r.HandleFunc("/api/send", a.handleSendEmail).Methods("POST")
 
 	r.HandleFunc("/api/embedded/send", a.handleSendEmail).Methods("POST")
 	r.HandleFunc("/api/embedded/verify", a.handleVerifyEmail).Methods("POST")
 	r.HandleFunc("/api/embedded/verify-link", a.handleVerifyLink).Methods("POST")
 
-	r.HandleFunc("/api/admin/reset-rate-limit", a.handleResetRateLimit).Methods("POST")
+	// With a separate admin listener the admin routes are only served by
+	// AdminRoutes, so they are not reachable on the public port at all. The
+	// metrics are never served here: they are unauthenticated.
+	if a.cfg.App.AdminAddr == "" {
+		a.registerAdminRoutes(r)
+	}
 
 	spa := spaHandler{StaticPath: "../frontend/build", IndexPath: "index.html", FileServer: http.FileServer(http.Dir("../frontend/build"))}
 
@@ -59,6 +119,128 @@ func (a *API) Routes() *mux.Router {
 	return r
 }
 
+// AdminRoutes returns the router for the separate admin listener configured
+// with app.admin_addr: the admin API, the metrics and the health and
+// readiness checks. It is the only router that serves the metrics.
+func (a *API) AdminRoutes() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(a.traceRoutes)
+	r.Use(a.assignRequestID)
+	r.Use(a.instrumentRoutes)
+
+	r.HandleFunc("/api/health", a.handleHealthCheck).Methods("GET")
+	r.HandleFunc("/api/ready", a.handleAdminReady).Methods("GET")
+	r.Handle("/metrics", a.metrics.Handler()).Methods("GET")
+	a.registerAdminRoutes(r)
+
+	return r
+}
+
+func (a *API) registerAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/api/admin/reset-rate-limit", a.handleResetRateLimit).Methods("POST")
+	r.HandleFunc("/api/admin/rate-limit-status", a.handleRateLimitStatus).Methods("POST")
+	r.HandleFunc("/api/admin/rate-limits/blocked", a.handleListBlocked).Methods("GET")
+	r.HandleFunc("/api/admin/pending-verification", a.handlePendingVerification).Methods("POST")
+	r.HandleFunc("/api/admin/revoke-verification", a.handleRevokeVerification).Methods("POST")
+	r.HandleFunc("/api/admin/revoke-credential", a.handleRevokeCredential).Methods("POST")
+}
+
+// instrumentRoutes is router middleware that times every request by its
+// route's path template, so requests for different link tokens or static
+// files do not each get a series of their own.
+func (a *API) instrumentRoutes(next http.Handler) http.Handler {
+	if a.metrics == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		a.metrics.RequestServed(routeTemplate(r), r.Method, sw.status, time.Since(start))
+	})
+}
+
+// routeTemplate returns the path template of the route r matched.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDHeader carries the request ID, both from a proxy that assigned
+// one and back to the client.
+const requestIDHeader = "X-Request-ID"
+
+// assignRequestID is router middleware that gives every request an ID, which
+// is added to every line logged with the request's context and returned in
+// the X-Request-ID response header. An ID set in that header by a trusted
+// proxy is kept if it is safe to log; clients cannot choose their own.
+func (a *API) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !a.fromTrustedProxy(r) || !isRequestID(id) {
+			id = rand.Text()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// isRequestID reports whether id is a plausible request ID: short and made
+// of characters that cannot break up a log line.
+func isRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// rateLimitRoutes is router middleware that applies the per-route limits of
+// routeLimiter. Routes are identified by their path template, so the limit
+// configured for "/api/verify" applies to that route only and not to its
+// "/api/embedded/verify" twin.
+func (a *API) rateLimitRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.routeLimiter != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					allow, timeout := a.routeLimiter.Allow(r.Context(), tmpl, a.clientIP(r))
+					if !allow {
+						a.metrics.RateLimitRejected("route")
+						w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(timeout.Seconds()))))
+						a.writeError(w, r, http.StatusTooManyRequests, "error_ratelimit")
+						return
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // --------------------------------- HELPERS -------------------------------------------
 
 func writeJSON(w http.ResponseWriter, code int, v any) error {
@@ -71,10 +253,10 @@ func writeJSON(w http.ResponseWriter, code int, v any) error {
 	return nil
 }
 
-func writeError(w http.ResponseWriter, code int, msg string) {
+func (a *API) writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
 	err := writeJSON(w, code, map[string]string{"error": msg})
 	if err != nil {
-		log.Println(err)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", err)
 	}
 }
 
@@ -0,0 +1,26 @@
+package httpapi
+
+import (
+	"backend/internal/audit"
+	"net/http"
+)
+
+// recordAudit records ev, attributed to the client that sent r. It is a no-op
+// when the audit log is disabled.
+func (a *API) recordAudit(r *http.Request, ev audit.Event) {
+	if a.audit == nil {
+		return
+	}
+	ev.IP = a.clientIP(r)
+	a.audit.Record(ev)
+}
+
+// auditFailure records a failed event of type typ for email.
+func (a *API) auditFailure(r *http.Request, typ, email, reason string) {
+	a.recordAudit(r, audit.Event{Type: typ, Outcome: audit.OutcomeFailure, Email: email, Reason: reason})
+}
+
+// auditSuccess records a successful event of type typ for email.
+func (a *API) auditSuccess(r *http.Request, typ, email string, details map[string]string) {
+	a.recordAudit(r, audit.Event{Type: typ, Outcome: audit.OutcomeSuccess, Email: email, Details: details})
+}
@@ -1,25 +1,28 @@
 package httpapi
 
 import (
+	"backend/internal/audit"
+	"backend/internal/config"
 	"backend/internal/core"
 	"backend/internal/issue"
 	"backend/internal/mail"
-	"backend/internal/validators"
-	"crypto/subtle"
+	"backend/internal/metrics"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (a *API) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte("ok"))
 	if err != nil {
-		log.Printf("error: %s", err)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", err)
 	}
 }
 
@@ -51,95 +54,76 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// otherwise, use http.FileServer to serve the static file
 	h.FileServer.ServeHTTP(w, r)
 }
+
+// handleVerifyDone ends a verification once the frontend has finished (or
+// abandoned) issuance: it clears whatever is still pending for the verified
+// address, such as a code from a later send in another tab. The caller must
+// present the done token returned by a successful verify, so only the browser
+// that completed the verification can clean it up.
 func (a *API) handleVerifyDone(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Email string `json:"email"`
+		DoneToken string `json:"done_token"`
 	}
 	decode_err := decodeJSON(w, r, &req)
-	if decode_err != nil || req.Email == "" {
-		writeError(w, http.StatusBadRequest, "email_required")
-		return
-	}
-
-	validator := validators.EmailValidator{}
-	valid, parsedAddress, errCode := validator.ParseAndValidateEmailAddress(req.Email)
-	if !valid {
-		writeError(w, http.StatusBadRequest, *errCode)
-		return
-	}
-
-	remove_err := a.tokenStorage.RemoveToken(*parsedAddress)
-	if remove_err != nil {
-		writeError(w, http.StatusInternalServerError, "error_removing_token")
-		return
-	}
-
-}
-
-// handleResetRateLimit clears the rate-limit counter for a single email
-// address. It is meant for operators to unblock a user who locked themselves
-// out by mistake. Access requires the admin token configured in app.admin_token,
-// passed as "Authorization: Bearer <token>". When no admin token is configured
-// the endpoint is disabled; when set, the token must meet the minimum length
-// enforced at startup (config.MinAdminTokenLength).
-func (a *API) handleResetRateLimit(w http.ResponseWriter, r *http.Request) {
-	if !a.authorizeAdmin(w, r) {
+	if decode_err != nil || req.DoneToken == "" {
+		a.writeError(w, r, http.StatusBadRequest, "done_token_required")
 		return
 	}
 
-	var req struct {
-		Email string `json:"email"`
-	}
-	if err := decodeJSON(w, r, &req); err != nil || req.Email == "" {
-		writeError(w, http.StatusBadRequest, "email_required")
+	email, retrieve_err := a.tokenStorage.RetrieveEmailByDoneToken(req.DoneToken)
+	if retrieve_err != nil {
+		a.writeError(w, r, http.StatusBadRequest, "error_token_invalid")
 		return
 	}
 
-	validator := validators.EmailValidator{}
-	valid, parsedAddress, errCode := validator.ParseAndValidateEmailAddress(req.Email)
-	if !valid {
-		writeError(w, http.StatusBadRequest, *errCode)
+	if remove_err := a.tokenStorage.RemoveDoneToken(req.DoneToken); remove_err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_removing_token")
 		return
 	}
-
-	if a.limiter == nil {
-		writeError(w, http.StatusInternalServerError, "rate_limiter_not_configured")
-		return
+	if _, retrieve_err := a.tokenStorage.RetrieveToken(email); retrieve_err == nil {
+		if remove_err := a.tokenStorage.RemoveToken(email); remove_err != nil {
+			a.writeError(w, r, http.StatusInternalServerError, "error_removing_token")
+			return
+		}
 	}
-
-	if err := a.limiter.ResetEmail(*parsedAddress); err != nil {
-		writeError(w, http.StatusInternalServerError, "error_resetting_rate_limit")
+	if _, remove_err := a.tokenStorage.RemoveLinkTokensForEmail(email); remove_err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_removing_token")
 		return
 	}
 
-	// Audit trail: admin reset actions are privileged, so record who was
-	// unblocked and from where.
-	log.Printf("admin: rate limit reset for %q from %s", *parsedAddress, a.clientIP(r))
-
 	jserr := writeJSON(w, http.StatusOK, map[string]any{
-		"message": "rate_limit_reset",
+		"message": "done",
 	})
 	if jserr != nil {
-		log.Printf("error: %s", jserr)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
 	}
 }
 
-// authorizeAdmin checks the bearer token against the configured admin token in
-// constant time. It writes the appropriate error response and returns false
-// when the request is not authorized.
-func (a *API) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
-	configured := a.cfg.App.AdminToken
-	if configured == "" {
-		writeError(w, http.StatusForbidden, "admin_endpoint_disabled")
-		return false
+// issueDoneToken hands out the done token that authorizes handleVerifyDone
+// for email. Failing to store one must not block issuance, so it only logs
+// and returns an empty token.
+func (a *API) issueDoneToken(r *http.Request, email string) string {
+	doneToken, err := core.GenerateLinkToken()
+	if err == nil {
+		err = a.tokenStorage.StoreDoneToken(doneToken, email)
+	}
+	if err != nil {
+		a.logger.WarnContext(r.Context(), "failed to issue done token", "error", err)
+		return ""
 	}
+	return doneToken
+}
 
-	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if subtle.ConstantTimeCompare([]byte(provided), []byte(configured)) != 1 {
-		// Log rejected attempts so repeated failures (e.g. token guessing)
-		// against this network-reachable route are visible in the logs.
-		log.Printf("admin: rejected request with invalid token from %s", a.clientIP(r))
-		writeError(w, http.StatusUnauthorized, "unauthorized")
+// checkDomainPolicy enforces the configured email domain allow/deny lists on a
+// normalised address. The lists are checked when a code is sent and again when
+// it is redeemed, so a domain that is blocked in between can no longer
+// complete issuance. It writes the error response and returns false when the
+// domain is not allowed.
+func (a *API) checkDomainPolicy(w http.ResponseWriter, r *http.Request, email string) bool {
+	allowed, errCode := a.domainPolicy.CheckEmailAddress(email)
+	if !allowed {
+		a.metrics.ValidatorRejected(*errCode)
+		a.writeError(w, r, http.StatusForbidden, *errCode)
 		return false
 	}
 	return true
@@ -148,19 +132,32 @@ func (a *API) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
 func (a *API) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 	// token is passed in the body as JSON from the frontend
 	var req struct {
-		Token string `json:"token"`
-		Email string `json:"email"`
+		Token     string `json:"token"`
+		Email     string `json:"email"`
+		SessionID string `json:"session_id"`
+		// Credential optionally selects one of the configured credentials.
+		Credential string `json:"credential"`
 	}
 	decode_err := decodeJSON(w, r, &req)
 	if decode_err != nil || req.Token == "" || req.Email == "" {
-		writeError(w, http.StatusBadRequest, "token_or_email_required")
+		a.writeError(w, r, http.StatusBadRequest, "token_or_email_required")
+		return
+	}
+	credential, ok := a.resolveCredential(req.Credential)
+	if !ok {
+		a.writeError(w, r, http.StatusBadRequest, "error_unknown_credential")
 		return
 	}
 	// Validate and normalize the email address
-	validator := validators.EmailValidator{}
-	valid, parsedAddress, errCode := validator.ParseAndValidateEmailAddress(req.Email)
+	valid, parsedAddress, errCode := a.emailValidator.ParseAndValidateEmailAddressContext(r.Context(), req.Email)
 	if !valid {
-		writeError(w, http.StatusBadRequest, *errCode)
+		a.metrics.ValidatorRejected(*errCode)
+		a.writeError(w, r, http.StatusBadRequest, *errCode)
+		return
+	}
+	if !a.checkDomainPolicy(w, r, *parsedAddress) {
+		a.auditFailure(r, audit.EventVerifyCode, *parsedAddress, "domain_policy")
+		a.metrics.Verification(metrics.MethodCode, false)
 		return
 	}
 
@@ -168,26 +165,53 @@ func (a *API) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "token generator not configured", http.StatusInternalServerError)
 		return
 	}
+	span := a.storageSpan(r, "storage.retrieve_code")
 	expectedToken, retrieve_err := a.tokenStorage.RetrieveToken(*parsedAddress)
+	endSpan(span, nil)
 	if retrieve_err != nil {
-		writeError(w, http.StatusBadRequest, "error_token_invalid")
+		a.auditFailure(r, audit.EventVerifyCode, *parsedAddress, "error_token_invalid")
+		a.metrics.Verification(metrics.MethodCode, false)
+		a.writeError(w, r, http.StatusBadRequest, "error_token_invalid")
+		return
+	}
+
+	// Only the browser that requested the code may redeem it.
+	if !a.sessionMatches(*parsedAddress, requestSession(r, req.SessionID)) {
+		a.auditFailure(r, audit.EventVerifyCode, *parsedAddress, "error_session_mismatch")
+		a.metrics.Verification(metrics.MethodCode, false)
+		a.writeError(w, r, http.StatusForbidden, "error_session_mismatch")
 		return
 	}
 
 	if expectedToken != req.Token {
-		writeError(w, http.StatusBadRequest, "error_invalid_token")
+		a.auditFailure(r, audit.EventVerifyCode, *parsedAddress, "error_invalid_token")
+		a.metrics.Verification(metrics.MethodCode, false)
+		a.writeError(w, r, http.StatusBadRequest, "error_invalid_token")
 		return
 	}
 
 	jwtCreator, creator_err := issue.NewIrmaJwtCreator(a.cfg.JWT)
 	if creator_err != nil {
-		writeError(w, http.StatusInternalServerError, "jwt_creator_error")
+		a.writeError(w, r, http.StatusInternalServerError, "jwt_creator_error")
 		return
 	}
 
-	jwt, create_err := jwtCreator.CreateJwt(*parsedAddress)
+	span = a.startSpan(r, "jwt.issue", attribute.String("credential", credential))
+	issuance, create_err := jwtCreator.Issue(credential, *parsedAddress)
+	endSpan(span, create_err)
 	if create_err != nil {
-		writeError(w, http.StatusInternalServerError, "jwt_creation_error")
+		a.writeError(w, r, http.StatusInternalServerError, "jwt_creation_error")
+		return
+	}
+	a.metrics.JWTIssued(credential)
+	if !a.storeRevocationKey(w, r, *parsedAddress, issuance) {
+		return
+	}
+	details := map[string]string{"method": "code", "credential": credential}
+	response, start_err := a.startIssuance(r, *parsedAddress, issuance, details)
+	if start_err != nil {
+		a.logger.ErrorContext(r.Context(), "failed to start issuance session", "error", start_err)
+		a.writeError(w, r, http.StatusBadGateway, "error_starting_session")
 		return
 	}
 
@@ -196,17 +220,67 @@ func (a *API) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 	// used again. If we cannot invalidate it we must not hand out the JWT,
 	// otherwise the code would remain reusable until it expires.
 	if remove_err := a.tokenStorage.RemoveToken(*parsedAddress); remove_err != nil {
-		writeError(w, http.StatusInternalServerError, "error_invalidating_token")
+		a.writeError(w, r, http.StatusInternalServerError, "error_invalidating_token")
+		return
+	}
+	// The verification links sent along with the code are spent as well.
+	if _, remove_err := a.tokenStorage.RemoveLinkTokensForEmail(*parsedAddress); remove_err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_invalidating_token")
 		return
 	}
 
-	jserr := writeJSON(w, http.StatusOK, map[string]any{
-		"jwt":             jwt,
-		"irma_server_url": a.cfg.JWT.IRMAServerURL,
-	})
+	a.auditSuccess(r, audit.EventVerifyCode, *parsedAddress, nil)
+	a.metrics.Verification(metrics.MethodCode, true)
+	a.auditIssued(r, *parsedAddress, details)
+
+	response["done_token"] = a.issueDoneToken(r, *parsedAddress)
+	jserr := writeJSON(w, http.StatusOK, response)
 	if jserr != nil {
-		log.Printf("error: %s", jserr)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
+	}
+}
+
+// resolveCredential returns the name of the credential a client selected, or
+// of the default credential when name is empty. It returns ok=false when no
+// credential with that name is configured.
+func (a *API) resolveCredential(name string) (resolved string, ok bool) {
+	credentials := a.cfg.JWT.CredentialsOrDefault()
+	if name == "" {
+		return credentials[0].Name, true
 	}
+	ok = slices.ContainsFunc(credentials, func(c config.CredentialConfig) bool {
+		return c.Name == name
+	})
+	return name, ok
+}
+
+// storeRevocationKey records the revocation key of a credential whose signed
+// request is about to be handed to the frontend. Whether the frontend
+// completes issuance is unknown, so the key is stored up front; revocation
+// drops keys the IRMA server never saw. A credential whose key was not stored
+// could never be revoked, so on failure the error response is written and
+// false is returned. With a server-side session it does nothing, as
+// issuanceFinished stores the key once the session completed.
+func (a *API) storeRevocationKey(w http.ResponseWriter, r *http.Request, email string, issuance issue.Issuance) bool {
+	if a.cfg.JWT.ServerSideSession {
+		return true
+	}
+	if err := a.saveRevocationKey(email, issuance); err != nil {
+		a.logger.ErrorContext(r.Context(), "failed to store revocation key", "error", err)
+		a.writeError(w, r, http.StatusInternalServerError, "error_storing_revocation_key")
+		return false
+	}
+	return true
+}
+
+// saveRevocationKey stores the revocation key of issuance, if it has one, for
+// as long as the credential is valid.
+func (a *API) saveRevocationKey(email string, issuance issue.Issuance) error {
+	if issuance.RevocationKey == "" {
+		return nil
+	}
+	key := core.RevocationKey{Credential: issuance.Credential, Key: issuance.RevocationKey}
+	return a.tokenStorage.StoreRevocationKey(email, key, issuance.Validity)
 }
 
 // handleVerifyLink verifies an email address from an opaque link token embedded
@@ -216,11 +290,19 @@ func (a *API) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 // in a URL) so the frontend can finish issuance and clean up the code.
 func (a *API) handleVerifyLink(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		LinkToken string `json:"link_token"`
+		LinkToken  string `json:"link_token"`
+		SessionID  string `json:"session_id"`
+		Credential string `json:"credential"`
 	}
 	decode_err := decodeJSON(w, r, &req)
 	if decode_err != nil || req.LinkToken == "" {
-		writeError(w, http.StatusBadRequest, "token_required")
+		a.writeError(w, r, http.StatusBadRequest, "token_required")
+		return
+	}
+	// Check the credential before the link token is spent.
+	credential, ok := a.resolveCredential(req.Credential)
+	if !ok {
+		a.writeError(w, r, http.StatusBadRequest, "error_unknown_credential")
 		return
 	}
 
@@ -229,9 +311,23 @@ func (a *API) handleVerifyLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span := a.storageSpan(r, "storage.retrieve_link_token")
 	email, retrieve_err := a.tokenStorage.RetrieveEmailByLinkToken(req.LinkToken)
+	endSpan(span, nil)
 	if retrieve_err != nil {
-		writeError(w, http.StatusBadRequest, "error_token_invalid")
+		a.auditFailure(r, audit.EventVerifyLink, "", "error_token_invalid")
+		a.metrics.Verification(metrics.MethodLink, false)
+		a.writeError(w, r, http.StatusBadRequest, "error_token_invalid")
+		return
+	}
+
+	// Unless cross-device completion is allowed, the link only works in the
+	// browser that requested it. Check before the link token is spent, so
+	// opening it elsewhere does not burn it.
+	if !a.cfg.App.AllowCrossDeviceLink && !a.sessionMatches(email, requestSession(r, req.SessionID)) {
+		a.auditFailure(r, audit.EventVerifyLink, email, "error_session_mismatch")
+		a.metrics.Verification(metrics.MethodLink, false)
+		a.writeError(w, r, http.StatusForbidden, "error_session_mismatch")
 		return
 	}
 
@@ -240,36 +336,67 @@ func (a *API) handleVerifyLink(w http.ResponseWriter, r *http.Request) {
 	// a URL that may linger in history, logs, or the Referer header). A failure
 	// here must not block the legitimate user, so we only log it.
 	if remove_err := a.tokenStorage.RemoveLinkToken(req.LinkToken); remove_err != nil {
-		log.Printf("warning: failed to invalidate link token after use: %s", remove_err)
+		a.logger.WarnContext(r.Context(), "failed to invalidate link token after use", "error", remove_err)
+	}
+
+	// The code sent along with the link, and any other links for the same
+	// address, are spent as well. As above, failures are only logged.
+	if _, remove_err := a.tokenStorage.RemoveLinkTokensForEmail(email); remove_err != nil {
+		a.logger.WarnContext(r.Context(), "failed to invalidate other link tokens after use", "error", remove_err)
+	}
+	if _, retrieve_err := a.tokenStorage.RetrieveToken(email); retrieve_err == nil {
+		if remove_err := a.tokenStorage.RemoveToken(email); remove_err != nil {
+			a.logger.WarnContext(r.Context(), "failed to invalidate code after link use", "error", remove_err)
+		}
 	}
 
 	// Re-validate and normalize the stored email defensively.
-	validator := validators.EmailValidator{}
-	valid, parsedAddress, errCode := validator.ParseAndValidateEmailAddress(email)
+	valid, parsedAddress, errCode := a.emailValidator.ParseAndValidateEmailAddressContext(r.Context(), email)
 	if !valid {
-		writeError(w, http.StatusBadRequest, *errCode)
+		a.metrics.ValidatorRejected(*errCode)
+		a.writeError(w, r, http.StatusBadRequest, *errCode)
+		return
+	}
+	if !a.checkDomainPolicy(w, r, *parsedAddress) {
+		a.auditFailure(r, audit.EventVerifyLink, *parsedAddress, "domain_policy")
+		a.metrics.Verification(metrics.MethodLink, false)
 		return
 	}
 
 	jwtCreator, creator_err := issue.NewIrmaJwtCreator(a.cfg.JWT)
 	if creator_err != nil {
-		writeError(w, http.StatusInternalServerError, "jwt_creator_error")
+		a.writeError(w, r, http.StatusInternalServerError, "jwt_creator_error")
 		return
 	}
 
-	jwt, create_err := jwtCreator.CreateJwt(*parsedAddress)
+	span = a.startSpan(r, "jwt.issue", attribute.String("credential", credential))
+	issuance, create_err := jwtCreator.Issue(credential, *parsedAddress)
+	endSpan(span, create_err)
 	if create_err != nil {
-		writeError(w, http.StatusInternalServerError, "jwt_creation_error")
+		a.writeError(w, r, http.StatusInternalServerError, "jwt_creation_error")
+		return
+	}
+	a.metrics.JWTIssued(credential)
+	if !a.storeRevocationKey(w, r, *parsedAddress, issuance) {
+		return
+	}
+	details := map[string]string{"method": "link", "credential": credential}
+	response, start_err := a.startIssuance(r, *parsedAddress, issuance, details)
+	if start_err != nil {
+		a.logger.ErrorContext(r.Context(), "failed to start issuance session", "error", start_err)
+		a.writeError(w, r, http.StatusBadGateway, "error_starting_session")
 		return
 	}
 
-	jserr := writeJSON(w, http.StatusOK, map[string]any{
-		"jwt":             jwt,
-		"irma_server_url": a.cfg.JWT.IRMAServerURL,
-		"email":           *parsedAddress,
-	})
+	a.auditSuccess(r, audit.EventVerifyLink, *parsedAddress, nil)
+	a.metrics.Verification(metrics.MethodLink, true)
+	a.auditIssued(r, *parsedAddress, details)
+
+	response["email"] = *parsedAddress
+	response["done_token"] = a.issueDoneToken(r, *parsedAddress)
+	jserr := writeJSON(w, http.StatusOK, response)
 	if jserr != nil {
-		log.Printf("error: %s", jserr)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
 	}
 }
 
@@ -281,22 +408,44 @@ func (a *API) handleSendEmail(w http.ResponseWriter, r *http.Request) {
 
 	var in input
 	if err := decodeJSON(w, r, &in); err != nil {
-		writeError(w, http.StatusBadRequest, "email_required")
+		a.writeError(w, r, http.StatusBadRequest, "email_required")
 		return
 	}
 
 	// Validate email address format
-	validator := validators.EmailValidator{}
-	valid, parsedAddress, errCode := validator.ParseAndValidateEmailAddress(in.Email)
+	valid, parsedAddress, errCode := a.emailValidator.ParseAndValidateEmailAddressContext(r.Context(), in.Email)
 	if !valid {
-		writeError(w, http.StatusBadRequest, *errCode)
+		a.metrics.ValidatorRejected(*errCode)
+		a.writeError(w, r, http.StatusBadRequest, *errCode)
+		return
+	}
+	if !a.checkDomainPolicy(w, r, *parsedAddress) {
+		a.auditFailure(r, audit.EventEmailSent, *parsedAddress, "domain_policy")
 		return
 	}
 
+	// Rate limit before anything is stored: a rejected request must not
+	// replace the pending code, rebind the session or revoke earlier links,
+	// or anyone could invalidate someone else's verification for free.
+	if a.limiter != nil {
+		ip := a.clientIP(r)
+		span := a.storageSpan(r, "ratelimit.allow")
+		allow, _ := a.limiter.Allow(r.Context(), ip, *parsedAddress)
+		span.SetAttributes(attribute.Bool("ratelimit.allowed", allow))
+		span.End()
+		if !allow {
+			a.auditFailure(r, audit.EventEmailSent, *parsedAddress, "error_ratelimit")
+			a.writeError(w, r, http.StatusTooManyRequests, "error_ratelimit")
+			return
+		}
+	}
+
 	// render email template and prepare the email
-	mailTmpl, ok := a.cfg.Mail.MailTemplates[in.Language]
+	language := in.Language
+	mailTmpl, ok := a.cfg.Mail.MailTemplates[language]
 	if !ok {
-		mailTmpl = a.cfg.Mail.MailTemplates["en"]
+		language = "en"
+		mailTmpl = a.cfg.Mail.MailTemplates[language]
 	}
 
 	if a.tokenGenerator == nil {
@@ -305,14 +454,28 @@ func (a *API) handleSendEmail(w http.ResponseWriter, r *http.Request) {
 	}
 	tok, err := a.tokenGenerator.GenerateToken()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "error_generating_token")
+		a.writeError(w, r, http.StatusInternalServerError, "error_generating_token")
 		return
 	}
 
 	// Make sure we use the parsed email address from the validator, to ensure that we e.g. trim any whitespace and remove any full name from the RFC-5322 format
+	span := a.storageSpan(r, "storage.store_code")
 	err = a.tokenStorage.StoreToken(*parsedAddress, tok)
+	endSpan(span, err)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_storing_token")
+		return
+	}
+	sessionID, err := a.startSession(w, r)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "error_storing_token")
+		a.writeError(w, r, http.StatusInternalServerError, "error_generating_token")
+		return
+	}
+	span = a.storageSpan(r, "storage.store_session")
+	err = a.tokenStorage.StoreSession(*parsedAddress, sessionID)
+	endSpan(span, err)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_storing_token")
 		return
 	}
 
@@ -322,51 +485,56 @@ func (a *API) handleSendEmail(w http.ResponseWriter, r *http.Request) {
 	// in browser history, server logs, or the Referer header) — see issue #44.
 	linkTok, err := core.GenerateLinkToken()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "error_generating_token")
+		a.writeError(w, r, http.StatusInternalServerError, "error_generating_token")
 		return
 	}
-	if err = a.tokenStorage.StoreLinkToken(linkTok, *parsedAddress); err != nil {
-		writeError(w, http.StatusInternalServerError, "error_storing_token")
+	span = a.storageSpan(r, "storage.store_link_token")
+	err = a.tokenStorage.StoreLinkToken(linkTok, *parsedAddress)
+	if err == nil {
+		// StoreToken replaced any earlier code, so earlier links must stop
+		// working as well; only the newest few stay valid.
+		_, err = a.tokenStorage.TrimLinkTokens(*parsedAddress, a.cfg.App.MaxLinkTokensPerEmailOrDefault())
+	}
+	endSpan(span, err)
+	if err != nil {
+		a.writeError(w, r, http.StatusInternalServerError, "error_storing_token")
 		return
 	}
 
 	baseURL := strings.TrimSuffix(a.cfg.App.BaseURL, "/")
 	verifyURL := fmt.Sprintf("%s/%s/enroll#token:%s", baseURL, in.Language, linkTok)
 
+	span = a.startSpan(r, "mail.render_template", attribute.String("mail.language", language))
 	tmplStr, err := mail.RenderHTMLtemplate(mailTmpl.TemplateDir, verifyURL, tok)
-
+	endSpan(span, err)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "template_render_error")
+		a.writeError(w, r, http.StatusInternalServerError, "template_render_error")
 		return
 	}
 
 	// For sending the email, we can used the unparsed email address from the input, since the mailer will use the parsed email address from the validator as the "To" address. This allows us to e.g. keep the full name in the "To" field if the user provided an RFC-5322 formatted email address.
 	emData := mail.Email{From: a.cfg.Mail.From, To: in.Email,
-		Subject: mailTmpl.Subject,
-		Body:    tmplStr,
+		Subject:  mailTmpl.Subject,
+		Body:     tmplStr,
+		Language: language,
 	}
 
-	// rate limit for sending emails
-	if a.limiter != nil {
-		ip := a.clientIP(r)
-		allow, _ := a.limiter.Allow(ip, *parsedAddress)
-		if !allow {
-			writeError(w, http.StatusTooManyRequests, "error_ratelimit")
-			return
-		}
-	}
-
-	err = a.mailer.SendEmail(emData)
+	span = a.startSpan(r, "mail.send", attribute.String("mail.language", language))
+	err = a.mailer.SendEmail(r.Context(), emData)
+	endSpan(span, err)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "error_sending_email")
+		a.auditFailure(r, audit.EventEmailSent, *parsedAddress, "error_sending_email")
+		a.writeError(w, r, http.StatusInternalServerError, "error_sending_email")
 		return
 	}
+	a.auditSuccess(r, audit.EventEmailSent, *parsedAddress, nil)
 
 	jserr := writeJSON(w, http.StatusOK, map[string]any{
-		"message": "email_sent",
+		"message":    "email_sent",
+		"session_id": sessionID,
 	})
 	if jserr != nil {
-		log.Printf("error: %s", jserr)
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", jserr)
 	}
 
 }
@@ -378,15 +546,34 @@ func (a *API) handleSendEmail(w http.ResponseWriter, r *http.Request) {
 // their IP and bypass the IP-based rate limit. We therefore only consult those
 // headers when the immediate peer (the TCP connection's remote address) is a
 // configured trusted proxy. Otherwise, and whenever the headers yield no usable
-// address, we fall back to the connection's remote address.
+// address, we fall back to the connection's remote address. The result is
+// normalised (see core.NormalizeIP) so that equivalent spellings of the same
+// address always map to the same rate-limit key.
 func (a *API) clientIP(r *http.Request) string {
+	return core.NormalizeIP(a.peerOrForwardedIP(r))
+}
+
+// peerHost returns the address of the request's direct peer.
+func peerHost(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		host = r.RemoteAddr
+		return r.RemoteAddr
 	}
+	return host
+}
+
+// fromTrustedProxy reports whether the direct peer of r is a trusted proxy,
+// whose headers about the client may be believed.
+func (a *API) fromTrustedProxy(r *http.Request) bool {
+	peerIP := net.ParseIP(peerHost(r))
+	return peerIP != nil && a.isTrustedProxy(peerIP)
+}
 
-	peerIP := net.ParseIP(host)
-	if peerIP == nil || !a.isTrustedProxy(peerIP) {
+// peerOrForwardedIP implements the proxy-aware lookup behind clientIP and
+// returns the address exactly as it appeared on the wire.
+func (a *API) peerOrForwardedIP(r *http.Request) string {
+	host := peerHost(r)
+	if !a.fromTrustedProxy(r) {
 		// The direct peer is not a trusted proxy: ignore proxy headers.
 		return host
 	}
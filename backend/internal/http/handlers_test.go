@@ -1,11 +1,33 @@
 package httpapi
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"backend/internal/audit"
 	"backend/internal/config"
+	"backend/internal/core"
+	"backend/internal/logging"
+	"backend/internal/mail"
+	"backend/internal/metrics"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // newTestAPI builds an API whose trusted-proxy list is parsed from the given
@@ -103,6 +125,22 @@ func TestClientIP(t *testing.T) {
 			headers:    map[string]string{"X-Forwarded-For": "not-an-ip"},
 			want:       "10.1.2.3",
 		},
+		{
+			// IPv6 peers are reported in canonical form.
+			name:       "ipv6 peer is normalised",
+			trusted:    nil,
+			remoteAddr: "[2001:DB8:0:0::1]:44444",
+			headers:    nil,
+			want:       "2001:db8::1",
+		},
+		{
+			// IPv4-mapped IPv6 addresses from a trusted proxy collapse to IPv4.
+			name:       "ipv4-mapped forwarded address is normalised",
+			trusted:    []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:55555",
+			headers:    map[string]string{"X-Forwarded-For": "::ffff:1.2.3.4"},
+			want:       "1.2.3.4",
+		},
 		{
 			// RemoteAddr without a port is handled gracefully.
 			name:       "remote addr without port",
@@ -127,3 +165,753 @@ func TestClientIP(t *testing.T) {
 		})
 	}
 }
+
+// staticResolver treats every domain as able to receive mail, so handler tests
+// don't depend on real DNS.
+type staticResolver struct{}
+
+func (staticResolver) LookupMX(name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "mail." + name, Pref: 10}}, nil
+}
+func (staticResolver) LookupIP(string) ([]net.IP, error) { return nil, nil }
+
+func TestSendEmailEnforcesDomainPolicy(t *testing.T) {
+	cfg := &config.Config{App: config.AppConfig{
+		AllowedEmailDomains: []string{"*.example.com"},
+		DeniedEmailDomains:  []string{"spam.example.com"},
+	}}
+	a := NewAPI(cfg, nil, nil, nil, core.NewInMemoryTokenStorage())
+	a.emailValidator.Resolver = staticResolver{}
+
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{email: "user@example.org", want: "error_email_domain_not_allowed"},
+		{email: "user@spam.example.com", want: "error_email_domain_blocked"},
+	}
+	for _, tc := range tests {
+		body := strings.NewReader(`{"email":"` + tc.email + `","language":"en"}`)
+		r := httptest.NewRequest(http.MethodPost, "/api/send", body)
+		w := httptest.NewRecorder()
+		a.Routes().ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403, got %d", tc.email, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tc.want) {
+			t.Fatalf("%s: expected error %q, got %s", tc.email, tc.want, w.Body.String())
+		}
+	}
+}
+
+func TestRouteRateLimitMiddleware(t *testing.T) {
+	policy := core.RateLimitingPolicy{Window: 15 * time.Minute, Limit: 2}
+	a := NewAPI(&config.Config{}, nil, nil, nil, core.NewInMemoryTokenStorage())
+	a.routeLimiter = core.NewRouteRateLimiter(map[string]core.RateLimiter{
+		"/api/verify-link": core.NewInMemoryRateLimiter(core.NewSystemClock(), policy),
+	}, core.IPAggregation{})
+	router := a.Routes()
+
+	verifyLink := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"link_token":"guess"}`))
+		r.RemoteAddr = "203.0.113.5:44444"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for range 2 {
+		if w := verifyLink("/api/verify-link"); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for an unknown token within the limit, got %d", w.Code)
+		}
+	}
+
+	w := verifyLink("/api/verify-link")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the route limit is exceeded, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "error_ratelimit") {
+		t.Fatalf("expected error_ratelimit, got %s", w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+
+	// The embedded twin has no limit configured here.
+	if w := verifyLink("/api/embedded/verify-link"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected unconfigured route to be unaffected, got %d", w.Code)
+	}
+}
+
+func TestAuditRecordsVerificationFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFileSink(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	logger, err := audit.NewLogger(sink, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("failed to create audit logger: %v", err)
+	}
+
+	cfg := &config.Config{App: config.AppConfig{DeniedEmailDomains: []string{"spam.example.com"}}}
+	storage := core.NewInMemoryTokenStorage()
+	if err := storage.StoreToken("user@example.com", "ABC123"); err != nil {
+		t.Fatalf("failed to store token: %v", err)
+	}
+	if err := storage.StoreSession("user@example.com", "session-1"); err != nil {
+		t.Fatalf("failed to store session: %v", err)
+	}
+	a := NewAPI(cfg, nil, nil, nil, storage)
+	a.emailValidator.Resolver = staticResolver{}
+	a.audit = logger
+	router := a.Routes()
+
+	requests := []struct{ path, body string }{
+		{"/api/verify", `{"email":"user@example.com","token":"WRONG1","session_id":"session-1"}`},
+		{"/api/verify-link", `{"link_token":"guess"}`},
+		{"/api/send", `{"email":"user@spam.example.com","language":"en"}`},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body))
+		r.RemoteAddr = "203.0.113.5:44444"
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("failed to close audit log: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	if n, err := audit.Verify(bytes.NewReader(data)); err != nil || n != 3 {
+		t.Fatalf("expected 3 chained records, got %d: %v", n, err)
+	}
+
+	log := string(data)
+	for _, want := range []string{
+		`"type":"verify_code","outcome":"failure"`,
+		`"reason":"error_invalid_token"`,
+		`"type":"verify_link","outcome":"failure"`,
+		`"type":"email_sent","outcome":"failure"`,
+		`"reason":"domain_policy"`,
+		`"ip":"203.0.113.5"`,
+		logger.Pseudonymise("user@example.com"),
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("expected audit log to contain %s, got:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "user@example.com") {
+		t.Errorf("audit log must not contain email addresses in clear text:\n%s", log)
+	}
+}
+
+// linkMailer records the verification link token of every email it sends.
+type linkMailer struct{ linkTokens []string }
+
+func (m *linkMailer) SendEmail(_ context.Context, e mail.Email) error {
+	_, token, _ := strings.Cut(e.Body, "#token:")
+	m.linkTokens = append(m.linkTokens, token[:strings.IndexAny(token, "\"<")])
+	return nil
+}
+
+func newVerificationTestAPI(t *testing.T, app config.AppConfig) (*API, *linkMailer, *core.InMemoryTokenStorage) {
+	t.Helper()
+	cfg := &config.Config{
+		App: app,
+		Mail: config.MailConfig{MailTemplates: map[string]config.MailTemplate{
+			"en": {Subject: "Verify your email", TemplateDir: "../mail/templates/email_en.html"},
+		}},
+		JWT: config.JWTConfig{PrivateKeyPath: "../../tests/keys/priv.pem", IssuerID: "email-issuer", Credential: "irma-demo.sidn-pbdf.email"},
+	}
+	mailer := &linkMailer{}
+	storage := core.NewInMemoryTokenStorage()
+	a := NewAPI(cfg, nil, mailer, &core.StaticTokenGenerator{Token: "ABC123"}, storage)
+	a.emailValidator.Resolver = staticResolver{}
+	return a, mailer, storage
+}
+
+// testBrowser posts to a router and keeps the cookies it is given, like a
+// browser would.
+type testBrowser struct {
+	router  http.Handler
+	cookies []*http.Cookie
+}
+
+func (b *testBrowser) post(path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for _, c := range b.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	b.router.ServeHTTP(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) > 0 {
+		b.cookies = cookies
+	}
+	return w
+}
+
+func TestRateLimitedSendKeepsPendingVerification(t *testing.T) {
+	a, mailer, storage := newVerificationTestAPI(t, config.AppConfig{})
+	a.limiter = core.NewTotalRateLimiter(
+		core.NewInMemoryRateLimiter(core.NewSystemClock(), core.RateLimitingPolicy{Limit: 10, Window: time.Minute}),
+		core.NewInMemoryRateLimiter(core.NewSystemClock(), core.RateLimitingPolicy{Limit: 1, Window: time.Minute}),
+	)
+	victim := &testBrowser{router: a.Routes()}
+	if w := victim.post("/api/send", `{"email":"user@example.com","language":"en"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected send to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	session, _ := storage.RetrieveSession("user@example.com")
+
+	// Another browser asking for a code for the same address is rejected, and
+	// must not take over the pending verification.
+	attacker := &testBrowser{router: a.Routes()}
+	if w := attacker.post("/api/send", `{"email":"user@example.com","language":"en"}`); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second send to be rate limited, got %d %s", w.Code, w.Body.String())
+	}
+	if got, _ := storage.RetrieveSession("user@example.com"); got != session {
+		t.Fatal("expected the rate-limited send to leave the session binding intact")
+	}
+	if linkTokens, _ := storage.ListLinkTokens("user@example.com"); len(linkTokens) != 1 || linkTokens[0] != mailer.linkTokens[0] {
+		t.Fatalf("expected the rate-limited send to leave the link intact, got %v", linkTokens)
+	}
+	if w := victim.post("/api/verify-link", fmt.Sprintf(`{"link_token":%q}`, mailer.linkTokens[0])); w.Code != http.StatusOK {
+		t.Fatalf("expected the victim's link to still work, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendRevokesEarlierLinks(t *testing.T) {
+	a, mailer, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+
+	for range 2 {
+		if w := browser.post("/api/send", `{"email":"user@example.com","language":"en"}`); w.Code != http.StatusOK {
+			t.Fatalf("expected send to succeed, got %d %s", w.Code, w.Body.String())
+		}
+	}
+	if len(mailer.linkTokens) != 2 {
+		t.Fatalf("expected 2 emails, got %d", len(mailer.linkTokens))
+	}
+	if _, err := storage.RetrieveEmailByLinkToken(mailer.linkTokens[0]); err == nil {
+		t.Fatal("expected the link of the first email to be revoked")
+	}
+	if _, err := storage.RetrieveEmailByLinkToken(mailer.linkTokens[1]); err != nil {
+		t.Fatal("expected the link of the latest email to stay valid")
+	}
+
+	// With a higher maximum, earlier links stay valid up to that number.
+	a, mailer, storage = newVerificationTestAPI(t, config.AppConfig{MaxLinkTokensPerEmail: 2})
+	browser = &testBrowser{router: a.Routes()}
+	for range 3 {
+		browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	}
+	linkTokens, _ := storage.ListLinkTokens("user@example.com")
+	if len(linkTokens) != 2 || linkTokens[0] != mailer.linkTokens[1] || linkTokens[1] != mailer.linkTokens[2] {
+		t.Fatalf("expected the 2 newest links to stay valid, got %v of %v", linkTokens, mailer.linkTokens)
+	}
+}
+
+func TestVerifyingByCodeRevokesLink(t *testing.T) {
+	a, mailer, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+
+	if w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.RetrieveEmailByLinkToken(mailer.linkTokens[0]); err == nil {
+		t.Fatal("expected the link to be revoked once the code was used")
+	}
+}
+
+func TestVerifyingByLinkRevokesCode(t *testing.T) {
+	a, mailer, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+
+	if w := browser.post("/api/verify-link", `{"link_token":"`+mailer.linkTokens[0]+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.RetrieveToken("user@example.com"); err == nil {
+		t.Fatal("expected the code to be revoked once the link was used")
+	}
+	if w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected the code to be rejected, got %d", w.Code)
+	}
+}
+
+func TestVerifyDone(t *testing.T) {
+	a, _, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+
+	w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`)
+	var verified struct {
+		DoneToken string `json:"done_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &verified); err != nil || verified.DoneToken == "" {
+		t.Fatalf("expected a done token, got %s", w.Body.String())
+	}
+
+	// A new code sent in the meantime (e.g. from another tab) is pending.
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+
+	// The old API took an email address from anyone; that no longer works.
+	if w := browser.post("/api/done", `{"email":"user@example.com"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "done_token_required") {
+		t.Fatalf("expected done_token_required, got %d %s", w.Code, w.Body.String())
+	}
+	if w := browser.post("/api/done", `{"done_token":"guess"}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "error_token_invalid") {
+		t.Fatalf("expected error_token_invalid, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.RetrieveToken("user@example.com"); err != nil {
+		t.Fatal("expected the pending code to survive rejected cleanup requests")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/done", nil)
+	w = httptest.NewRecorder()
+	browser.router.ServeHTTP(w, r)
+	if w.Code == http.StatusOK {
+		t.Fatal("expected GET /api/done to be rejected")
+	}
+
+	body := `{"done_token":"` + verified.DoneToken + `"}`
+	if w := browser.post("/api/done", body); w.Code != http.StatusOK {
+		t.Fatalf("expected cleanup to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.RetrieveToken("user@example.com"); err == nil {
+		t.Fatal("expected the pending code to be removed")
+	}
+	if linkTokens, _ := storage.ListLinkTokens("user@example.com"); len(linkTokens) != 0 {
+		t.Fatalf("expected the pending links to be removed, got %v", linkTokens)
+	}
+
+	// The done token is single-use.
+	if w := browser.post("/api/done", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected a reused done token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestVerifyLinkReturnsDoneToken(t *testing.T) {
+	a, mailer, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+
+	w := browser.post("/api/verify-link", `{"link_token":"`+mailer.linkTokens[0]+`"}`)
+	var verified struct {
+		DoneToken string `json:"done_token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &verified); err != nil || verified.DoneToken == "" {
+		t.Fatalf("expected a done token, got %s", w.Body.String())
+	}
+	if email, err := storage.RetrieveEmailByDoneToken(verified.DoneToken); err != nil || email != "user@example.com" {
+		t.Fatalf("expected the done token to map to the verified address, got %q: %v", email, err)
+	}
+}
+
+func TestVerifyCodeIsBoundToRequestingSession(t *testing.T) {
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{})
+	router := a.Routes()
+	victim := &testBrowser{router: router}
+	attacker := &testBrowser{router: router}
+
+	w := victim.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly || cookies[0].Path != "/api" {
+		t.Fatalf("expected an HttpOnly session cookie, got %v", cookies)
+	}
+	var sent struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &sent); err != nil || sent.SessionID != cookies[0].Value {
+		t.Fatalf("expected the session ID in the response, got %s", w.Body.String())
+	}
+
+	// A phished code entered in another browser is rejected without spending
+	// it.
+	attacker.post("/api/send", `{"email":"attacker@example.com","language":"en"}`)
+	w = attacker.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "error_session_mismatch") {
+		t.Fatalf("expected error_session_mismatch, got %d %s", w.Code, w.Body.String())
+	}
+
+	// A client without cookies can pass the session ID in the body instead.
+	cookieless := &testBrowser{router: router}
+	w = cookieless.post("/api/verify", `{"email":"user@example.com","token":"ABC123","session_id":"`+sent.SessionID+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification with the session ID to succeed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendReusesSession(t *testing.T) {
+	a, _, storage := newVerificationTestAPI(t, config.AppConfig{})
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	first := browser.cookies[0].Value
+	browser.post("/api/send", `{"email":"other@example.com","language":"en"}`)
+	if browser.cookies[0].Value != first {
+		t.Fatal("expected the browser to keep its session across sends")
+	}
+	if sessionID, _ := storage.RetrieveSession("other@example.com"); sessionID != first {
+		t.Fatalf("expected the code to be bound to the session, got %q", sessionID)
+	}
+
+	// A forged cookie value is not adopted as session ID.
+	browser.cookies[0].Value = "forged"
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	if v := browser.cookies[0].Value; v == "forged" || v == first {
+		t.Fatalf("expected a fresh session ID, got %q", v)
+	}
+}
+
+func TestVerifyLinkSessionBinding(t *testing.T) {
+	a, mailer, _ := newVerificationTestAPI(t, config.AppConfig{})
+	router := a.Routes()
+	desktop := &testBrowser{router: router}
+	phone := &testBrowser{router: router}
+
+	desktop.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	body := `{"link_token":"` + mailer.linkTokens[0] + `"}`
+
+	if w := phone.post("/api/verify-link", body); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "error_session_mismatch") {
+		t.Fatalf("expected error_session_mismatch, got %d %s", w.Code, w.Body.String())
+	}
+	// The rejected attempt did not spend the link.
+	if w := desktop.post("/api/verify-link", body); w.Code != http.StatusOK {
+		t.Fatalf("expected the link to work in the requesting browser, got %d %s", w.Code, w.Body.String())
+	}
+
+	a, mailer, _ = newVerificationTestAPI(t, config.AppConfig{AllowCrossDeviceLink: true})
+	router = a.Routes()
+	desktop = &testBrowser{router: router}
+	phone = &testBrowser{router: router}
+
+	desktop.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	if w := phone.post("/api/verify-link", `{"link_token":"`+mailer.linkTokens[0]+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected cross-device link completion to be allowed, got %d %s", w.Code, w.Body.String())
+	}
+	// Codes stay bound to the requesting browser.
+	desktop.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	if w := phone.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the code to stay bound to the requesting browser, got %d", w.Code)
+	}
+}
+
+func TestVerifySelectsCredential(t *testing.T) {
+	a, mailer, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.cfg.JWT.Credentials = []config.CredentialConfig{
+		{Name: "demo", Credential: "irma-demo.sidn-pbdf.email", Attributes: config.EmailCredentialAttributes{Email: "email"}},
+		{Name: "production", Credential: "pbdf.sidn-pbdf.email", Attributes: config.EmailCredentialAttributes{Email: "email"}},
+	}
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	body := `{"link_token":"` + mailer.linkTokens[0] + `","credential":"staging"}`
+	if w := browser.post("/api/verify-link", body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "error_unknown_credential") {
+		t.Fatalf("expected error_unknown_credential, got %d %s", w.Code, w.Body.String())
+	}
+
+	// The rejected request did not spend the link.
+	body = `{"link_token":"` + mailer.linkTokens[0] + `","credential":"production"}`
+	w := browser.post("/api/verify-link", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the link to work, got %d %s", w.Code, w.Body.String())
+	}
+	var res struct {
+		JWT string `json:"jwt"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(res.JWT, claims); err != nil {
+		t.Fatalf("failed to parse issuance JWT: %v", err)
+	}
+	if !strings.Contains(fmt.Sprint(claims["iprequest"]), "credential:pbdf.sidn-pbdf.email") {
+		t.Fatalf("expected the production credential to be issued, got %v", claims["iprequest"])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	a, mailer, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.metrics = metrics.New()
+	a.mailer = mail.MeteredMailer{Mailer: mailer, Metrics: a.metrics}
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"xx"}`)
+	browser.post("/api/send", `{"email":"not an address","language":"en"}`)
+	browser.post("/api/verify", `{"email":"user@example.com","token":"WRONG1"}`)
+	if w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	browser.post("/api/verify-link", `{"link_token":"guess"}`)
+
+	body := scrapeMetrics(t, a.AdminRoutes())
+	for _, want := range []string{
+		`email_issuer_emails_sent_total{language="en"} 1`,
+		`email_issuer_smtp_send_duration_seconds_count 1`,
+		`email_issuer_validator_rejections_total{code="error_email_format"} 1`,
+		`email_issuer_verifications_total{method="code",result="failure"} 1`,
+		`email_issuer_verifications_total{method="code",result="success"} 1`,
+		`email_issuer_verifications_total{method="link",result="failure"} 1`,
+		`email_issuer_jwts_issued_total{credential="default"} 1`,
+		`email_issuer_http_request_duration_seconds_count{code="200",method="POST",route="/api/verify"} 1`,
+		`email_issuer_http_request_duration_seconds_count{code="400",method="POST",route="/api/verify"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %s, got:\n%s", want, body)
+		}
+	}
+
+	// The metrics are unauthenticated, so they are only served on the admin
+	// listener, also when the admin routes share the public port.
+	for _, adminAddr := range []string{"", "127.0.0.1:8081"} {
+		a.cfg.App.AdminAddr = adminAddr
+		w := httptest.NewRecorder()
+		a.Routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if strings.Contains(w.Body.String(), "email_issuer_") {
+			t.Fatalf("expected metrics not to be served on the public router with admin_addr %q", adminAddr)
+		}
+	}
+}
+
+func TestMetricsLabelUnknownMethodsAsOther(t *testing.T) {
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.metrics = metrics.New()
+	router := a.Routes()
+
+	// The catch-all route accepts any method, so a client can send as many
+	// different methods as it likes.
+	for i := range 5 {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(fmt.Sprintf("JUNK%d", i), "/", nil))
+	}
+
+	body := scrapeMetrics(t, a.AdminRoutes())
+	if strings.Contains(body, "JUNK") {
+		t.Fatalf("expected unknown methods not to become labels, got:\n%s", body)
+	}
+	if !strings.Contains(body, `method="other",route="/"} 5`) {
+		t.Errorf("expected unknown methods to be counted as other, got:\n%s", body)
+	}
+}
+
+func TestMetricsCountsRateLimitRejections(t *testing.T) {
+	a, mailer, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.metrics = metrics.New()
+	a.mailer = mail.MeteredMailer{Mailer: mailer, Metrics: a.metrics}
+	policy := core.RateLimitingPolicy{Limit: 1, Window: time.Minute}
+	a.limiter = core.NewTotalRateLimiter(
+		core.NewInMemoryRateLimiter(core.NewSystemClock(), policy),
+		core.NewInMemoryRateLimiter(core.NewSystemClock(), core.RateLimitingPolicy{Limit: 10, Window: time.Minute}),
+	)
+	a.limiter.OnReject = a.metrics.RateLimitRejected
+	a.routeLimiter = core.NewRouteRateLimiter(map[string]core.RateLimiter{
+		"/api/verify-link": core.NewInMemoryRateLimiter(core.NewSystemClock(), policy),
+	}, core.IPAggregation{})
+	browser := &testBrowser{router: a.Routes()}
+
+	for range 2 {
+		browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+		browser.post("/api/verify-link", `{"link_token":"guess"}`)
+	}
+
+	body := scrapeMetrics(t, a.AdminRoutes())
+	for _, want := range []string{
+		`email_issuer_rate_limit_rejections_total{dimension="email"} 1`,
+		`email_issuer_rate_limit_rejections_total{dimension="route"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %s, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `dimension="ip"`) {
+		t.Errorf("expected no rejections by ip, got:\n%s", body)
+	}
+}
+
+// scrapeMetrics returns the metrics served by router.
+func scrapeMetrics(t *testing.T, router http.Handler) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected metrics to be served, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestTracingSendEmail(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{StorageType: "inmemory"})
+	r := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{"email":"user@example.com","language":"en"}`))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	a.Routes().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected send to succeed, got %d %s", w.Code, w.Body.String())
+	}
+
+	spans := exporter.GetSpans()
+	var server tracetest.SpanStub
+	names := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		names[span.Name] = span
+		if span.Name == "POST /api/send" {
+			server = span
+		}
+	}
+	if server.Name == "" {
+		t.Fatalf("expected a server span for the route, got %v", names)
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("expected the span to continue trace %s, got %s", traceID, got)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("expected the caller's span as parent, got %s", got)
+	}
+	for _, name := range []string{"dns.lookup_mx", "storage.store_code", "storage.store_session", "storage.store_link_token", "mail.render_template", "mail.send"} {
+		span, ok := names[name]
+		if !ok {
+			t.Errorf("expected a %s span, got %v", name, names)
+			continue
+		}
+		if span.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("expected %s to be a child of the server span", name)
+		}
+	}
+}
+
+func TestRequestIDIsLoggedAndReturned(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(config.LoggingConfig{Level: "debug"}, &buf)
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{TrustedProxies: []string{"10.0.0.1"}})
+	a.logger = logger
+	a.mailer = mail.DummyMailer{Logger: logger}
+	router := a.Routes()
+
+	send := func(requestID, peer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(`{"email":"user@example.com","language":"en"}`))
+		r.RemoteAddr = peer + ":1234"
+		if requestID != "" {
+			r.Header.Set("X-Request-ID", requestID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected send to succeed, got %d %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := send("", "192.0.2.1")
+	id := w.Header().Get("X-Request-ID")
+	if id == "" {
+		t.Fatal("expected a request ID in the response")
+	}
+	log := buf.String()
+	if !strings.Contains(log, "request_id="+id) || strings.Count(log, "request_id=") != strings.Count(log, "\n") {
+		t.Fatalf("expected every line to carry request ID %s, got:\n%s", id, log)
+	}
+	if strings.Contains(log, "user@example.com") || strings.Contains(log, "ABC123") {
+		t.Fatalf("expected the address and code to be redacted, got:\n%s", log)
+	}
+
+	// A request ID assigned by a trusted proxy is kept, unless it is unsafe
+	// to log. Clients cannot pick their own.
+	if got := send("proxy-42", "10.0.0.1").Header().Get("X-Request-ID"); got != "proxy-42" {
+		t.Fatalf("expected the proxy's request ID to be kept, got %q", got)
+	}
+	if got := send("evil\nline", "10.0.0.1").Header().Get("X-Request-ID"); got == "evil\nline" {
+		t.Fatal("expected an unsafe request ID to be replaced")
+	}
+	if got := send("client-42", "192.0.2.1").Header().Get("X-Request-ID"); got == "client-42" {
+		t.Fatal("expected a request ID sent by a client to be replaced")
+	}
+}
+
+func getReady(t *testing.T, router http.Handler) (int, readinessReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/ready", nil))
+	var report readinessReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("failed to decode readiness report %q: %v", w.Body.String(), err)
+	}
+	return w.Code, report
+}
+
+func TestReady(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{StorageType: "redis"})
+	a.cfg.Redis = config.RedisConfig{Host: mr.Host(), Port: mustAtoi(t, mr.Port())}
+	a.readiness.add(buildReadinessChecks(a.cfg)...)
+	router := a.Routes()
+
+	code, report := getReady(t, router)
+	if code != http.StatusOK || report.Status != "ready" {
+		t.Fatalf("expected ready, got %d %+v", code, report)
+	}
+	for _, name := range []string{"redis", "signing_key", "templates"} {
+		if c, ok := report.Components[name]; !ok || c.Status != "ok" {
+			t.Errorf("expected component %s to be ok, got %+v", name, report.Components)
+		}
+	}
+
+	// The report is cached, so a Redis outage only shows once it expires.
+	redisAddr := mr.Addr()
+	mr.Close()
+	if code, _ := getReady(t, router); code != http.StatusOK {
+		t.Fatalf("expected the cached report, got %d", code)
+	}
+
+	a.readiness.ttl = 0
+	code, report = getReady(t, router)
+	if code != http.StatusServiceUnavailable || report.Status != "not_ready" {
+		t.Fatalf("expected not ready, got %d %+v", code, report)
+	}
+	// The public report leaves out the error, which names the Redis address;
+	// the admin listener reports it.
+	if c := report.Components["redis"]; c.Status != "error" || c.Error != "" {
+		t.Errorf("expected the redis component to fail without an error message, got %+v", c)
+	}
+	if c := report.Components["templates"]; c.Status != "ok" {
+		t.Errorf("expected the templates component to stay ok, got %+v", c)
+	}
+	code, report = getReady(t, a.AdminRoutes())
+	if c := report.Components["redis"]; code != http.StatusServiceUnavailable || c.Status != "error" || !strings.Contains(c.Error, redisAddr) {
+		t.Errorf("expected the admin report to carry the redis error, got %d %+v", code, c)
+	}
+}
+
+func TestReadyReportsMissingSigningKey(t *testing.T) {
+	a, _, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.cfg.JWT.PrivateKeyPath = filepath.Join(t.TempDir(), "missing.pem")
+	a.readiness = newReadiness(0, signingKeyCheck(a.cfg.JWT), templatesCheck(a.cfg.Mail))
+
+	code, report := getReady(t, a.Routes())
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", code)
+	}
+	if c := report.Components["signing_key"]; c.Status != "error" {
+		t.Errorf("expected the signing_key component to fail, got %+v", c)
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package httpapi
+
+import (
+	"backend/internal/audit"
+	"backend/internal/issue"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/privacybydesign/irmago/irma"
+)
+
+// startIssuance returns the fields of a successful verify response that let
+// the frontend run the issuance session. By default that is the signed
+// request, which the frontend posts to the IRMA server itself. With
+// jwt.server_side_session the backend starts the session and returns only the
+// session pointer and frontend request; the requestor token stays here and is
+// used to track whether issuance completed (see issuanceFinished).
+func (a *API) startIssuance(r *http.Request, email string, issuance issue.Issuance, details map[string]string) (map[string]any, error) {
+	if !a.cfg.JWT.ServerSideSession {
+		return map[string]any{
+			"jwt":             issuance.JWT,
+			"irma_server_url": a.cfg.JWT.IRMAServerURL,
+		}, nil
+	}
+
+	irmaServer := issue.IrmaServerClient{Client: a.irmaClient, URL: a.cfg.JWT.IRMAServerURL}
+	session, err := irmaServer.StartSession(issuance.JWT)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request is gone once the session completes, so capture what the
+	// audit event needs now.
+	ev := audit.Event{Type: audit.EventCredentialIssued, Email: email, IP: a.clientIP(r), Details: details}
+	a.sessions.track(r.Context(), irmaServer, session.Token, func(ctx context.Context, status irma.ServerStatus) {
+		a.issuanceFinished(ctx, status, ev, issuance)
+	})
+
+	return map[string]any{
+		"session_ptr":      session.SessionPtr,
+		"frontend_request": session.FrontendRequest,
+	}, nil
+}
+
+// issuanceFinished handles the outcome of a session started by the backend,
+// as reported by the session tracker: it counts the result and records in the
+// audit log whether the credential was actually issued. Only then is the
+// revocation key of the credential stored, so keys of sessions that were
+// cancelled or timed out do not pile up. An empty status means the session
+// could not be tracked to the end.
+func (a *API) issuanceFinished(ctx context.Context, status irma.ServerStatus, ev audit.Event, issuance issue.Issuance) {
+	result := "untracked"
+	if status.Finished() {
+		result = strings.ToLower(string(status))
+	}
+	a.metrics.IssuanceSession(result)
+	// An untracked session may still have completed, so its key is kept as
+	// well: revocation drops it if the IRMA server never saw it.
+	if status == irma.ServerStatusDone || !status.Finished() {
+		if err := a.saveRevocationKey(ev.Email, issuance); err != nil {
+			// The credential may be in the wallet already; all that is left
+			// is to make sure an operator notices it cannot be revoked.
+			a.logger.ErrorContext(ctx, "failed to store revocation key", "credential", issuance.Credential, "error", err)
+		}
+	}
+	if status == irma.ServerStatusDone {
+		ev.Outcome = audit.OutcomeSuccess
+	} else {
+		ev.Outcome, ev.Reason = audit.OutcomeFailure, "session_"+result
+	}
+	if ev.Outcome == audit.OutcomeFailure {
+		a.logger.InfoContext(ctx, "issuance session ended without issuing", "reason", ev.Reason)
+	}
+	// Record is a no-op when the audit log is disabled.
+	a.audit.Record(ev)
+}
+
+// auditIssued records a credential as issued when the signed request was
+// handed to the frontend. With a server-side session issuanceFinished records
+// it once the session finished instead.
+func (a *API) auditIssued(r *http.Request, email string, details map[string]string) {
+	if a.cfg.JWT.ServerSideSession {
+		return
+	}
+	a.auditSuccess(r, audit.EventCredentialIssued, email, details)
+}
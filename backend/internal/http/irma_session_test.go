@@ -0,0 +1,275 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/audit"
+	"backend/internal/config"
+	"backend/internal/issue"
+	"backend/internal/metrics"
+
+	"github.com/privacybydesign/irmago/irma"
+)
+
+// fakeIrmaServer is a stand-in for the requestor API of an IRMA server. Each
+// started session reports the statuses in order, repeating the last one.
+type fakeIrmaServer struct {
+	mu       sync.Mutex
+	statuses []string
+	started  []string
+	polls    int
+	fail     bool
+	// statusFailures is the number of status polls to fail before answering.
+	statusFailures int
+}
+
+func (f *fakeIrmaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/session":
+		if f.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.started = append(f.started, string(body))
+		_, _ = w.Write([]byte(`{"sessionPtr":{"u":"https://irma.example.com/irma/session/client-token","irmaqr":"issuing"},` +
+			`"token":"requestor-token","frontendRequest":{"authorization":"frontend-auth"}}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/session/requestor-token/status":
+		if f.statusFailures > 0 {
+			f.statusFailures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		status := f.statuses[min(f.polls, len(f.statuses)-1)]
+		f.polls++
+		_ = json.NewEncoder(w).Encode(status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newServerSideSessionAPI(t *testing.T, irma *fakeIrmaServer) (*API, *linkMailer, string) {
+	t.Helper()
+	srv := httptest.NewServer(irma)
+	t.Cleanup(srv.Close)
+
+	a, mailer, _ := newVerificationTestAPI(t, config.AppConfig{})
+	a.cfg.JWT.IRMAServerURL = srv.URL
+	a.cfg.JWT.ServerSideSession = true
+	a.sessions = newSessionTracker(time.Millisecond, a.logger)
+	t.Cleanup(func() { _ = a.sessions.Shutdown(context.Background()) })
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFileSink(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	a.audit, err = audit.NewLogger(sink, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("failed to create audit logger: %v", err)
+	}
+	t.Cleanup(func() { _ = a.audit.Close() })
+	return a, mailer, path
+}
+
+// waitForAudit waits until the audit log at path contains want.
+func waitForAudit(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), want) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	data, _ := os.ReadFile(path)
+	t.Fatalf("expected audit log to contain %s, got:\n%s", want, data)
+}
+
+func TestServerSideSessionReturnsOnlySessionPointer(t *testing.T) {
+	irma := &fakeIrmaServer{statuses: []string{"INITIALIZED", "CONNECTED", "DONE"}}
+	a, _, path := newServerSideSessionAPI(t, irma)
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+	}
+
+	var res map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if _, ok := res["jwt"]; ok {
+		t.Fatalf("the signed request must not be handed to the frontend: %v", res)
+	}
+	if strings.Contains(w.Body.String(), "requestor-token") {
+		t.Fatalf("the requestor token must stay on the server: %s", w.Body.String())
+	}
+	ptr, _ := res["session_ptr"].(map[string]any)
+	if ptr["u"] != "https://irma.example.com/irma/session/client-token" || ptr["irmaqr"] != "issuing" {
+		t.Fatalf("expected the session pointer, got %v", res["session_ptr"])
+	}
+	if fr, _ := res["frontend_request"].(map[string]any); fr["authorization"] != "frontend-auth" {
+		t.Fatalf("expected the frontend request, got %v", res["frontend_request"])
+	}
+	irma.mu.Lock()
+	started := irma.started
+	irma.mu.Unlock()
+	if len(started) != 1 || strings.Count(started[0], ".") != 2 {
+		t.Fatalf("expected the backend to post one signed request, got %v", started)
+	}
+
+	// The credential only counts as issued once the session is done.
+	waitForAudit(t, path, `"type":"credential_issued","outcome":"success"`)
+}
+
+func TestServerSideSessionRecordsCancelledIssuance(t *testing.T) {
+	irma := &fakeIrmaServer{statuses: []string{"INITIALIZED", "CANCELLED"}}
+	a, mailer, path := newServerSideSessionAPI(t, irma)
+	a.metrics = metrics.New()
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	if w := browser.post("/api/verify-link", `{"link_token":"`+mailer.linkTokens[0]+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	waitForAudit(t, path, `"type":"credential_issued","outcome":"failure"`)
+	waitForAudit(t, path, `"reason":"session_cancelled"`)
+	if body := scrapeMetrics(t, a.AdminRoutes()); !strings.Contains(body, `email_issuer_issuance_sessions_total{result="cancelled"} 1`) {
+		t.Errorf("expected the cancelled session to be counted, got:\n%s", body)
+	}
+}
+
+func TestServerSideSessionStoresRevocationKeyOnceDone(t *testing.T) {
+	for status, wantKeys := range map[string]int{"DONE": 1, "CANCELLED": 0} {
+		t.Run(status, func(t *testing.T) {
+			irma := &fakeIrmaServer{statuses: []string{"CONNECTED"}}
+			a, _, path := newServerSideSessionAPI(t, irma)
+			a.cfg.JWT.Credentials = []config.CredentialConfig{{
+				Name:       "production",
+				Credential: "irma-demo.sidn-pbdf.email",
+				Attributes: config.EmailCredentialAttributes{Email: "email"},
+				Revocation: true,
+			}}
+			browser := &testBrowser{router: a.Routes()}
+
+			browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+			if w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusOK {
+				t.Fatalf("expected verification to succeed, got %d %s", w.Code, w.Body.String())
+			}
+			// Nothing is stored while the wallet has not received the
+			// credential yet.
+			for polled := false; !polled; time.Sleep(time.Millisecond) {
+				irma.mu.Lock()
+				polled = irma.polls > 0
+				irma.mu.Unlock()
+			}
+			if keys, _ := a.tokenStorage.ListRevocationKeys("user@example.com"); len(keys) != 0 {
+				t.Fatalf("expected no revocation key before the session finished, got %+v", keys)
+			}
+
+			irma.mu.Lock()
+			irma.statuses = []string{status}
+			irma.mu.Unlock()
+			waitForAudit(t, path, `"type":"credential_issued"`)
+			if keys, _ := a.tokenStorage.ListRevocationKeys("user@example.com"); len(keys) != wantKeys {
+				t.Fatalf("expected %d revocation keys once the session was %s, got %+v", wantKeys, status, keys)
+			}
+		})
+	}
+}
+
+func TestServerSideSessionStartFailureKeepsCode(t *testing.T) {
+	irma := &fakeIrmaServer{fail: true}
+	a, _, _ := newServerSideSessionAPI(t, irma)
+	browser := &testBrowser{router: a.Routes()}
+
+	browser.post("/api/send", `{"email":"user@example.com","language":"en"}`)
+	w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "error_starting_session") {
+		t.Fatalf("expected error_starting_session, got %d %s", w.Code, w.Body.String())
+	}
+
+	// The code was not spent, so the user can try again.
+	irma.mu.Lock()
+	irma.fail = false
+	irma.statuses = []string{"DONE"}
+	irma.mu.Unlock()
+	if w := browser.post("/api/verify", `{"email":"user@example.com","token":"ABC123"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// trackOne tracks the session of fake with tracker and returns a channel that
+// receives its final status.
+func trackOne(t *testing.T, tracker *sessionTracker, fake *fakeIrmaServer) <-chan irma.ServerStatus {
+	t.Helper()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	finished := make(chan irma.ServerStatus, 1)
+	tracker.track(context.Background(), issue.IrmaServerClient{Client: srv.Client(), URL: srv.URL}, "requestor-token",
+		func(_ context.Context, status irma.ServerStatus) { finished <- status })
+	return finished
+}
+
+func TestSessionTrackerBacksOffWhileIrmaServerFails(t *testing.T) {
+	var logs bytes.Buffer
+	tracker := newSessionTracker(time.Millisecond, slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { _ = tracker.Shutdown(context.Background()) })
+
+	fake := &fakeIrmaServer{statuses: []string{"DONE"}, statusFailures: 5}
+	select {
+	case status := <-trackOne(t, tracker, fake):
+		if status != irma.ServerStatusDone {
+			t.Fatalf("expected the session to finish as done, got %q", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to finish once the IRMA server answers")
+	}
+
+	// Five failures back off 2, 4, 8, 16 and 32 poll intervals, and only the
+	// first one is logged as a warning.
+	if n := strings.Count(logs.String(), "level=WARN"); n != 1 {
+		t.Errorf("expected one warning, got %d:\n%s", n, logs.String())
+	}
+}
+
+func TestSessionTrackerShutdownFinishesPendingSessions(t *testing.T) {
+	tracker := newSessionTracker(time.Millisecond, slog.New(slog.DiscardHandler))
+	finished := trackOne(t, tracker, &fakeIrmaServer{statuses: []string{"CONNECTED"}})
+
+	if err := tracker.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	select {
+	case status := <-finished:
+		if status != "" {
+			t.Fatalf("expected the pending session to finish untracked, got %q", status)
+		}
+	default:
+		t.Fatal("expected shutdown to finish the pending session")
+	}
+
+	// Sessions started after shutdown are not tracked at all.
+	if status := <-trackOne(t, tracker, &fakeIrmaServer{statuses: []string{"DONE"}}); status != "" {
+		t.Fatalf("expected a session tracked after shutdown to finish untracked, got %q", status)
+	}
+}
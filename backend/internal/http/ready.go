@@ -0,0 +1,193 @@
+package httpapi
+
+import (
+	"backend/internal/config"
+	"backend/internal/mail"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// readinessCheckTimeout bounds each dependency check of /api/ready.
+const readinessCheckTimeout = 2 * time.Second
+
+// readinessCheck checks that one dependency is usable.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// componentStatus is the result of one readinessCheck.
+type componentStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status     string                     `json:"status"`
+	CheckedAt  time.Time                  `json:"checked_at"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// readiness runs the readiness checks and caches the report for ttl, so
+// frequent probes stay cheap. Concurrent probes wait for one run of the
+// checks rather than each starting their own.
+type readiness struct {
+	checks []readinessCheck
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	report *readinessReport
+}
+
+func newReadiness(ttl time.Duration, checks ...readinessCheck) *readiness {
+	return &readiness{checks: checks, ttl: ttl}
+}
+
+// add registers more checks. It must not be called once the API serves
+// requests.
+func (rd *readiness) add(checks ...readinessCheck) {
+	rd.checks = append(rd.checks, checks...)
+}
+
+// get returns the cached report, or runs the checks when it is older than
+// ttl. Failed checks are logged to logger when they run.
+func (rd *readiness) get(ctx context.Context, logger *slog.Logger) readinessReport {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.report != nil && time.Since(rd.report.CheckedAt) < rd.ttl {
+		return *rd.report
+	}
+
+	report := readinessReport{Status: "ready", CheckedAt: time.Now(), Components: make(map[string]componentStatus, len(rd.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range rd.checks {
+		wg.Go(func() {
+			checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(checkCtx)
+			status := componentStatus{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				status.Status, status.Error = "error", err.Error()
+				logger.WarnContext(ctx, "readiness check failed", "component", c.name, "error", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[c.name] = status
+			if err != nil {
+				report.Status = "not_ready"
+			}
+		})
+	}
+	wg.Wait()
+	rd.report = &report
+	return report
+}
+
+// handleReady reports whether the dependencies of the backend are usable:
+// 200 when all checks pass and 503 otherwise, with the result of each check.
+// Unlike /api/health it fails when e.g. Redis is unreachable, so it suits a
+// readiness probe. The errors of failed checks can name internal hosts and
+// paths, so they are left out here and only logged.
+func (a *API) handleReady(w http.ResponseWriter, r *http.Request) {
+	a.writeReadiness(w, r, false)
+}
+
+// handleAdminReady is handleReady for the admin listener, which also reports
+// the errors of failed checks.
+func (a *API) handleAdminReady(w http.ResponseWriter, r *http.Request) {
+	a.writeReadiness(w, r, true)
+}
+
+func (a *API) writeReadiness(w http.ResponseWriter, r *http.Request, withErrors bool) {
+	report := a.readiness.get(r.Context(), a.logger)
+	code := http.StatusOK
+	if report.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	if !withErrors {
+		// The report is shared with the cache, so copy the components.
+		components := make(map[string]componentStatus, len(report.Components))
+		for name, c := range report.Components {
+			c.Error = ""
+			components[name] = c
+		}
+		report.Components = components
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err := writeJSON(w, code, report); err != nil {
+		a.logger.ErrorContext(r.Context(), "writing response failed", "error", err)
+	}
+}
+
+// signingKeyCheck checks that the issuer key loads, as issuance loads it for
+// every credential it signs.
+func signingKeyCheck(jc config.JWTConfig) readinessCheck {
+	return readinessCheck{name: "signing_key", check: func(context.Context) error {
+		_, err := config.LoadSigner(jc)
+		return err
+	}}
+}
+
+// templatesCheck checks that every mail template renders.
+func templatesCheck(mc config.MailConfig) readinessCheck {
+	return readinessCheck{name: "templates", check: func(context.Context) error {
+		languages := make([]string, 0, len(mc.MailTemplates))
+		for language := range mc.MailTemplates {
+			languages = append(languages, language)
+		}
+		sort.Strings(languages)
+		for _, language := range languages {
+			if _, err := mail.RenderHTMLtemplate(mc.MailTemplates[language].TemplateDir, "https://example.com/", "CHECK"); err != nil {
+				return fmt.Errorf("%s: %w", language, err)
+			}
+		}
+		return nil
+	}}
+}
+
+// redisCheck pings the Redis server behind client.
+func redisCheck(client *redis.Client) readinessCheck {
+	return readinessCheck{name: "redis", check: func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}}
+}
+
+// smtpCheck connects to the SMTP server and waits for its greeting, without
+// authenticating or sending anything.
+func smtpCheck(mc config.MailConfig) readinessCheck {
+	return readinessCheck{name: "smtp", check: func(ctx context.Context) error {
+		addr := net.JoinHostPort(mc.Host, strconv.Itoa(mc.Port))
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		// Port 465 speaks TLS from the start, as the mailer assumes.
+		if mc.Port == 465 {
+			conn = tls.Client(conn, &tls.Config{ServerName: mc.Host, MinVersion: tls.VersionTLS12})
+		}
+		client, err := smtp.NewClient(conn, mc.Host)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		return client.Quit()
+	}}
+}
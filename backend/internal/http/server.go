@@ -1,51 +1,63 @@
 package httpapi
 
 import (
+	"backend/internal/audit"
 	"backend/internal/config"
 	"backend/internal/core"
 	"backend/internal/mail"
+	"backend/internal/metrics"
 	"backend/internal/storage"
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"time"
 )
 
-func buildTotalLimiter(cfg *config.Config) *core.TotalRateLimiter {
-	emailPolicy := core.RateLimitingPolicy{Limit: cfg.App.RateLimitCount["email"], Window: 30 * time.Minute}
-	ipPolicy := core.RateLimitingPolicy{Limit: cfg.App.RateLimitCount["ip"], Window: 30 * time.Minute}
+// rateLimiterFactory creates a RateLimiter for the given policy on the
+// configured storage backend.
+type rateLimiterFactory func(policy core.RateLimitingPolicy) core.RateLimiter
 
+func buildRateLimiterFactory(cfg *config.Config, logger *slog.Logger) rateLimiterFactory {
 	switch cfg.App.StorageType {
 	case "inmemory", "memory":
-		email := core.NewInMemoryRateLimiter(core.NewSystemClock(), emailPolicy)
-		ip := core.NewInMemoryRateLimiter(core.NewSystemClock(), ipPolicy)
-		// Periodically evict expired entries so the in-memory maps don't grow
-		// unbounded as new IPs/emails are seen. The limiters live for the
-		// process lifetime, so the stop functions are intentionally discarded.
-		email.StartJanitor(emailPolicy.Window)
-		ip.StartJanitor(ipPolicy.Window)
-		log.Print("Running in memory storage type for rate limiting")
-
-		return core.NewTotalRateLimiter(email, ip)
+		logger.Info("rate limiting with in-memory storage")
+		return func(policy core.RateLimitingPolicy) core.RateLimiter {
+			rl := core.NewInMemoryRateLimiter(core.NewSystemClock(), policy)
+			// Periodically evict expired entries so the in-memory maps don't
+			// grow unbounded as new IPs/emails are seen. The limiters live for
+			// the process lifetime, so the stop function is intentionally
+			// discarded.
+			rl.StartJanitor(policy.Window)
+			return rl
+		}
 
 	case "redis":
 		rc, err := storage.NewRedisClient(cfg)
 		if err != nil {
 			log.Fatalf("Error connecting to Redis: %v", err)
 		}
-		email := core.NewRedisRateLimiter(rc, cfg.Redis.Namespace, emailPolicy)
-		ip := core.NewRedisRateLimiter(rc, cfg.Redis.Namespace, ipPolicy)
-		log.Print("Running with redis storage type for rate limiting")
+		logger.Info("rate limiting with redis storage")
+		return func(policy core.RateLimitingPolicy) core.RateLimiter {
+			rl := core.NewRedisRateLimiter(rc, cfg.Redis.Namespace, policy)
+			rl.Logger = logger
+			return rl
+		}
 
-		return core.NewTotalRateLimiter(email, ip)
 	case "redis_sentinel":
 		sc, err := storage.NewRedisSentinelClient(cfg)
 		if err != nil {
 			log.Fatalf("Error connecting to Redis Sentinel: %v", err)
 		}
-		email := core.NewRedisRateLimiter(sc, cfg.RedisSentinel.Namespace, emailPolicy)
-		ip := core.NewRedisRateLimiter(sc, cfg.RedisSentinel.Namespace, ipPolicy)
-		log.Print("Running with redis sentinel storage type for rate limiting")
-		return core.NewTotalRateLimiter(email, ip)
+		logger.Info("rate limiting with redis sentinel storage")
+		return func(policy core.RateLimitingPolicy) core.RateLimiter {
+			rl := core.NewRedisRateLimiter(sc, cfg.RedisSentinel.Namespace, policy)
+			rl.Logger = logger
+			return rl
+		}
 
 	default:
 		log.Fatalf("Unsupported storage type for rate limiter: %s", cfg.App.StorageType)
@@ -53,24 +65,87 @@ func buildTotalLimiter(cfg *config.Config) *core.TotalRateLimiter {
 	}
 }
 
-func buildTokenStorage(cfg *config.Config) core.TokenStorage {
+func ipAggregation(cfg *config.Config) core.IPAggregation {
+	return core.IPAggregation{
+		IPv4Prefix: cfg.App.IPAggregation.IPv4PrefixOrDefault(),
+		IPv6Prefix: cfg.App.IPAggregation.IPv6PrefixOrDefault(),
+	}
+}
+
+func buildTotalLimiter(cfg *config.Config, newLimiter rateLimiterFactory, logger *slog.Logger) *core.TotalRateLimiter {
+	const window = 30 * time.Minute
+
+	email := newLimiter(core.RateLimitingPolicy{Limit: cfg.App.RateLimitCount["email"], Window: window})
+	ip := newLimiter(core.RateLimitingPolicy{Limit: cfg.App.RateLimitCount["ip"], Window: window})
+	total := core.NewTotalRateLimiter(email, ip)
+
+	// The per-domain limit is opt-in: without a configured count every domain
+	// is only subject to the email and IP limits.
+	if limit := cfg.App.RateLimitCount["domain"]; limit > 0 {
+		total.Domain = newLimiter(core.RateLimitingPolicy{Limit: limit, Window: window})
+	}
+
+	total.IPAggregation = ipAggregation(cfg)
+	total.Bypass = buildRateLimitBypass(cfg, logger)
+	total.Logger = logger
+	for _, pl := range cfg.App.IPPrefixLimits {
+		network, err := config.ParseCIDR(pl.CIDR)
+		if err != nil {
+			log.Fatalf("Invalid ip_prefix_limits CIDR %q: %v", pl.CIDR, err)
+		}
+		total.IPPrefixLimits = append(total.IPPrefixLimits, core.IPPrefixLimit{
+			Network: network,
+			Limiter: newLimiter(core.RateLimitingPolicy{Limit: pl.Limit, Window: window}),
+		})
+	}
+
+	return total
+}
+
+func buildRateLimitBypass(cfg *config.Config, logger *slog.Logger) *core.RateLimitBypass {
+	bc := cfg.App.RateLimitBypass
+	if len(bc.CIDRs) == 0 && len(bc.Emails) == 0 && len(bc.EmailDomains) == 0 {
+		return nil
+	}
+
+	networks := make([]*net.IPNet, 0, len(bc.CIDRs))
+	for _, entry := range bc.CIDRs {
+		network, err := config.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("Invalid rate_limit_bypass CIDR %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	logger.Info("rate limit bypass enabled", "cidrs", len(networks), "emails", len(bc.Emails), "email_domains", len(bc.EmailDomains))
+	return &core.RateLimitBypass{Networks: networks, Emails: bc.Emails, Domains: bc.EmailDomains}
+}
+
+func buildRouteLimiter(cfg *config.Config, newLimiter rateLimiterFactory) *core.RouteRateLimiter {
+	routes := make(map[string]core.RateLimiter)
+	for route, rl := range cfg.App.RouteRateLimitsOrDefault() {
+		routes[route] = newLimiter(core.RateLimitingPolicy{Limit: rl.Limit, Window: time.Duration(rl.Window)})
+	}
+	return core.NewRouteRateLimiter(routes, ipAggregation(cfg))
+}
+
+func buildTokenStorage(cfg *config.Config, logger *slog.Logger) core.TokenStorage {
 	switch cfg.App.StorageType {
 	case "inmemory", "memory":
-		log.Print("Running in memory storage type for token storage")
+		logger.Info("storing tokens in memory")
 		return core.NewInMemoryTokenStorage()
 	case "redis":
 		rc, err := storage.NewRedisClient(cfg)
 		if err != nil {
 			log.Fatalf("Error connecting to Redis: %v", err)
 		}
-		log.Print("Running with redis storage type for token storage")
+		logger.Info("storing tokens in redis")
 		return core.NewRedisTokenStorage(rc, cfg.Redis.Namespace)
 	case "redis_sentinel":
 		sc, err := storage.NewRedisSentinelClient(cfg)
 		if err != nil {
 			log.Fatalf("Error connecting to Redis Sentinel: %v", err)
 		}
-		log.Print("Running with redis sentinel storage type for token storage")
+		logger.Info("storing tokens in redis sentinel")
 		return core.NewRedisTokenStorage(sc, cfg.RedisSentinel.Namespace)
 	default:
 		log.Fatalf("Unsupported storage type for token storage: %s", cfg.App.StorageType)
@@ -78,36 +153,197 @@ func buildTokenStorage(cfg *config.Config) core.TokenStorage {
 	}
 }
 
+func buildAuditLogger(cfg *config.Config, logger *slog.Logger) *audit.Logger {
+	var sink audit.Sink
+	var err error
+	switch cfg.Audit.Sink {
+	case "":
+		return nil
+	case "file":
+		sink, err = audit.NewFileSink(cfg.Audit.FilePath)
+	case "syslog":
+		sink, err = audit.NewSyslogSink(cfg.Audit.SyslogNetwork, cfg.Audit.SyslogAddr)
+	case "redis":
+		sink, err = buildAuditRedisSink(cfg)
+	default:
+		log.Fatalf("Unsupported audit sink: %s", cfg.Audit.Sink)
+	}
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+
+	auditLogger, err := audit.NewLogger(sink, []byte(cfg.Audit.PseudonymKey))
+	if err != nil {
+		log.Fatalf("Error opening audit log: %v", err)
+	}
+	logger.Info("writing audit log", "sink", cfg.Audit.Sink)
+	return auditLogger
+}
+
+func buildAuditRedisSink(cfg *config.Config) (audit.Sink, error) {
+	stream := cfg.Audit.RedisStreamOrDefault()
+	if cfg.App.StorageType == "redis_sentinel" {
+		sc, err := storage.NewRedisSentinelClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return audit.NewRedisStreamSink(sc, cfg.RedisSentinel.Namespace+":"+stream), nil
+	}
+	rc, err := storage.NewRedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewRedisStreamSink(rc, cfg.Redis.Namespace+":"+stream), nil
+}
+
+// buildReadinessChecks returns the checks of /api/ready that NewAPI does not
+// add itself: the Redis connection and, with readiness.check_smtp, the SMTP
+// server.
+func buildReadinessChecks(cfg *config.Config) []readinessCheck {
+	var checks []readinessCheck
+	switch cfg.App.StorageType {
+	case "redis":
+		rc, err := storage.NewRedisClient(cfg)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis: %v", err)
+		}
+		checks = append(checks, redisCheck(rc))
+	case "redis_sentinel":
+		sc, err := storage.NewRedisSentinelClient(cfg)
+		if err != nil {
+			log.Fatalf("Error connecting to Redis Sentinel: %v", err)
+		}
+		checks = append(checks, redisCheck(sc))
+	}
+	if cfg.Readiness.CheckSMTP {
+		checks = append(checks, smtpCheck(cfg.Mail))
+	}
+	return checks
+}
+
 type Server struct {
 	cfg    *config.Config
+	logger *slog.Logger
+	api    *API
 	server *http.Server
+	// adminServer serves the admin routes when app.admin_addr is set.
+	adminServer *http.Server
 }
 
-func NewServer(cfg *config.Config) *Server {
+// NewServer builds the server for cfg. Everything it sets up logs to logger.
+func NewServer(cfg *config.Config, logger *slog.Logger) *Server {
 
-	totalLimiter := buildTotalLimiter(cfg)
+	m := metrics.New()
+	newLimiter := buildRateLimiterFactory(cfg, logger)
+	totalLimiter := buildTotalLimiter(cfg, newLimiter, logger)
+	totalLimiter.OnReject = m.RateLimitRejected
 	smtpMailer := mail.NewSmtpMailer(&cfg.Mail)
+	smtpMailer.Logger = logger
+	mailer := mail.MeteredMailer{Mailer: smtpMailer, Metrics: m}
 	tokenGenerator := core.NewRandomTokenGenerator()
-	tokenStorage := buildTokenStorage(cfg)
+	tokenStorage := buildTokenStorage(cfg, logger)
 
-	router := NewAPI(cfg, totalLimiter, smtpMailer, tokenGenerator, tokenStorage)
+	router := NewAPI(cfg, totalLimiter, mailer, tokenGenerator, tokenStorage)
+	router.routeLimiter = buildRouteLimiter(cfg, newLimiter)
+	router.audit = buildAuditLogger(cfg, logger)
+	router.metrics = m
+	router.logger = logger
+	router.readiness.add(buildReadinessChecks(cfg)...)
+	if cfg.JWT.ServerSideSession {
+		router.sessions = newSessionTracker(defaultSessionPollInterval, logger)
+	}
 
 	s := &Server{
-		cfg: cfg,
+		cfg:    cfg,
+		logger: logger,
+		api:    router,
 		server: &http.Server{
 			Addr:              cfg.App.Addr,
 			Handler:           router.Routes(),
 			ReadHeaderTimeout: 5 * time.Second,
 		},
 	}
+	if cfg.App.AdminAddr != "" {
+		s.adminServer = &http.Server{
+			Addr:              cfg.App.AdminAddr,
+			Handler:           router.AdminRoutes(),
+			ReadHeaderTimeout: 5 * time.Second,
+			TLSConfig:         buildAdminTLSConfig(cfg),
+		}
+	} else {
+		logger.Info("metrics are only served on the admin listener, set app.admin_addr to scrape them")
+	}
 	return s
 }
 
+// buildAdminTLSConfig returns the TLS config of the admin listener, or nil
+// when it serves plain HTTP. With admin_client_certs, client certificates are
+// requested and verified against the configured CA; requests without one can
+// still authenticate with a bearer token. The CA is only read at startup.
+func buildAdminTLSConfig(cfg *config.Config) *tls.Config {
+	if cfg.App.AdminTLSCertPath == "" {
+		return nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cc := cfg.App.AdminClientCerts; cc != nil {
+		pool, err := config.LoadCertPool(cc.CAPath)
+		if err != nil {
+			log.Fatalf("Error loading admin client CA: %v", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig
+}
+
+// Reload applies the reloadable parts of a freshly loaded config to the
+// running server. Currently that is the set of admin credentials, so they can
+// be rotated without downtime; every other setting requires a restart.
+func (s *Server) Reload(cfg *config.Config) {
+	s.api.ReloadAdminCredentials(cfg.App)
+}
+
+// ListenAndServe serves the public listener and, when configured, the admin
+// listener. It returns as soon as either of them fails.
 func (s *Server) ListenAndServe() error {
+	if s.adminServer == nil {
+		return s.listenAndServePublic()
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		// The admin listener is meant to be bound to localhost or an internal
+		// interface, so it serves plain HTTP unless admin TLS is configured.
+		if s.adminServer.TLSConfig == nil {
+			s.logger.Info("admin listening", "addr", s.adminServer.Addr)
+			errs <- s.adminServer.ListenAndServe()
+			return
+		}
+		s.logger.Info("admin listening with TLS", "addr", s.adminServer.Addr)
+		errs <- s.adminServer.ListenAndServeTLS(s.cfg.App.AdminTLSCertPath, s.cfg.App.AdminTLSKeyPath)
+	}()
+	go func() {
+		errs <- s.listenAndServePublic()
+	}()
+	return <-errs
+}
+
+// Shutdown stops the listeners gracefully and stops tracking issuance
+// sessions. ListenAndServe then returns http.ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	errs := []error{s.server.Shutdown(ctx)}
+	if s.adminServer != nil {
+		errs = append(errs, s.adminServer.Shutdown(ctx))
+	}
+	errs = append(errs, s.api.sessions.Shutdown(ctx))
+	return errors.Join(errs...)
+}
+
+func (s *Server) listenAndServePublic() error {
 	if !s.cfg.App.UseTLS {
-		log.Printf("Running without TLS")
+		s.logger.Info("running without TLS")
 		return s.server.ListenAndServe()
 	}
-	log.Printf("Running with TLS")
+	s.logger.Info("running with TLS")
 	return s.server.ListenAndServeTLS(s.cfg.App.TLSCertPath, s.cfg.App.TLSPrivKeyPath)
 }
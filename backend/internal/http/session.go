@@ -0,0 +1,76 @@
+package httpapi
+
+import (
+	"backend/internal/core"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// sessionCookieName is the cookie that carries the verification session ID.
+const sessionCookieName = "email_issuer_session"
+
+// startSession returns the verification session ID of the browser that sent
+// r, issuing a new one when it has none, and (re)sets the session cookie. The
+// session ID binds a verification code to the browser that requested it, so a
+// phished code cannot be redeemed from another browser.
+func (a *API) startSession(w http.ResponseWriter, r *http.Request) (string, error) {
+	sessionID := ""
+	if c, err := r.Cookie(sessionCookieName); err == nil && isSessionID(c.Value) {
+		sessionID = c.Value
+	} else {
+		sessionID, err = core.GenerateLinkToken()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionID,
+		Path:     "/api",
+		MaxAge:   int(core.Timeout.Seconds()),
+		HttpOnly: true,
+		Secure:   a.cfg.App.UseTLS || strings.HasPrefix(a.cfg.App.BaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sessionID, nil
+}
+
+// requestSession returns the session ID presented with r: the session_id from
+// the request body when the client passed one (for clients without cookies),
+// otherwise the session cookie.
+func requestSession(r *http.Request, bodySessionID string) string {
+	if bodySessionID != "" {
+		return bodySessionID
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// sessionMatches reports whether sessionID is the session the pending code of
+// email is bound to.
+func (a *API) sessionMatches(email, sessionID string) bool {
+	expected, err := a.tokenStorage.RetrieveSession(email)
+	if err != nil || sessionID == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(sessionID)) == 1
+}
+
+// isSessionID reports whether s looks like an ID issued by startSession (32
+// random bytes, base64url-encoded), so arbitrary cookie values are not adopted
+// as session IDs.
+func isSessionID(s string) bool {
+	if len(s) != 43 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
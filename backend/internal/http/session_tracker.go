@@ -0,0 +1,201 @@
+package httpapi
+
+import (
+	"backend/internal/issue"
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/privacybydesign/irmago/irma"
+)
+
+const (
+	// defaultSessionPollInterval is how often the status of a session started
+	// by the backend is polled while the IRMA server answers.
+	defaultSessionPollInterval = 2 * time.Second
+	// maxSessionPollInterval caps the backoff between polls while the IRMA
+	// server fails to answer.
+	maxSessionPollInterval = time.Minute
+	// sessionTrackTimeout bounds how long such a session is tracked. The IRMA
+	// server times sessions out well before that.
+	sessionTrackTimeout = 15 * time.Minute
+	// maxTrackedSessions bounds both the sessions being polled and the
+	// sessions waiting to be; sessions beyond that are not tracked.
+	maxTrackedSessions = 1000
+	// sessionPollConcurrency bounds the status requests in flight at once.
+	sessionPollConcurrency = 8
+)
+
+// trackedSession is a session started by the backend, followed by a
+// sessionTracker until it finishes.
+type trackedSession struct {
+	// ctx only carries the values of the request that started the session,
+	// such as its request ID.
+	ctx    context.Context
+	server issue.IrmaServerClient
+	token  string
+	// onFinish is called once with the final status of the session, or with
+	// an empty status when it could not be tracked to the end.
+	onFinish func(ctx context.Context, status irma.ServerStatus)
+
+	deadline time.Time
+	next     time.Time
+	interval time.Duration
+	failures int
+	finished bool
+}
+
+func (s *trackedSession) finish(status irma.ServerStatus) {
+	s.finished = true
+	s.onFinish(s.ctx, status)
+}
+
+// sessionTracker polls the sessions started by the backend from a single
+// loop, so the number of sessions it follows and of status requests in flight
+// stay bounded. While the IRMA server fails to answer, the polls of a session
+// back off up to maxSessionPollInterval. Shutdown stops the tracker; sessions
+// that are still pending then finish untracked.
+//
+// A nil *sessionTracker tracks nothing: every session finishes untracked.
+type sessionTracker struct {
+	pollInterval time.Duration
+	logger       *slog.Logger
+	queue        chan *trackedSession
+
+	ctx     context.Context
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// newSessionTracker starts a tracker that polls sessions every pollInterval.
+func newSessionTracker(pollInterval time.Duration, logger *slog.Logger) *sessionTracker {
+	ctx, stop := context.WithCancel(context.Background())
+	t := &sessionTracker{
+		pollInterval: pollInterval,
+		logger:       logger,
+		queue:        make(chan *trackedSession, maxTrackedSessions),
+		ctx:          ctx,
+		stop:         stop,
+		stopped:      make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// track queues a session for tracking. onFinish is called from the tracker's
+// goroutines once the session finished, timed out or could not be tracked.
+func (t *sessionTracker) track(ctx context.Context, server issue.IrmaServerClient, token string, onFinish func(ctx context.Context, status irma.ServerStatus)) {
+	s := &trackedSession{ctx: context.WithoutCancel(ctx), server: server, token: token, onFinish: onFinish}
+	if t == nil || t.ctx.Err() != nil {
+		s.finish("")
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		t.logger.WarnContext(ctx, "too many IRMA sessions to track, not tracking this one")
+		s.finish("")
+	}
+}
+
+// Shutdown stops polling and finishes the pending sessions untracked. It
+// waits for the tracker to stop until ctx is done.
+func (t *sessionTracker) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.stop()
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *sessionTracker) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+
+	var active []*trackedSession
+	for {
+		// Leave new sessions in the queue while the tracker is full.
+		queue := t.queue
+		if len(active) >= maxTrackedSessions {
+			queue = nil
+		}
+		select {
+		case <-t.ctx.Done():
+			for _, s := range active {
+				s.finish("")
+			}
+			for {
+				select {
+				case s := <-t.queue:
+					s.finish("")
+				default:
+					return
+				}
+			}
+		case s := <-queue:
+			now := time.Now()
+			s.deadline, s.next, s.interval = now.Add(sessionTrackTimeout), now.Add(t.pollInterval), t.pollInterval
+			active = append(active, s)
+		case now := <-ticker.C:
+			t.poll(active, now)
+			active = slices.DeleteFunc(active, func(s *trackedSession) bool { return s.finished })
+		}
+	}
+}
+
+// poll polls the sessions in active that are due and waits for the results.
+func (t *sessionTracker) poll(active []*trackedSession, now time.Time) {
+	sem := make(chan struct{}, sessionPollConcurrency)
+	var wg sync.WaitGroup
+	for _, s := range active {
+		if now.Before(s.next) {
+			continue
+		}
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			t.pollSession(s, now)
+		})
+	}
+	wg.Wait()
+}
+
+func (t *sessionTracker) pollSession(s *trackedSession, now time.Time) {
+	status, err := s.server.SessionStatus(t.ctx, s.token)
+	switch {
+	case err == nil && status.Finished():
+		s.finish(status)
+		return
+	case err == nil:
+		if s.failures > 0 {
+			t.logger.InfoContext(s.ctx, "polling IRMA session status recovered", "failures", s.failures)
+		}
+		s.failures, s.interval = 0, t.pollInterval
+	case t.ctx.Err() != nil:
+		// Shutting down; run finishes the session.
+		return
+	default:
+		// Only the first failure is worth a warning; an outage of the IRMA
+		// server would otherwise log one for every poll of every session.
+		s.failures++
+		if s.failures == 1 {
+			t.logger.WarnContext(s.ctx, "failed to poll IRMA session status, backing off", "error", err)
+		} else {
+			t.logger.DebugContext(s.ctx, "failed to poll IRMA session status", "error", err, "failures", s.failures)
+		}
+		s.interval = min(2*s.interval, maxSessionPollInterval)
+	}
+	if !now.Before(s.deadline) {
+		s.finish("")
+		return
+	}
+	s.next = now.Add(s.interval)
+}
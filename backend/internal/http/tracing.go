@@ -0,0 +1,59 @@
+package httpapi
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("backend/internal/http")
+
+// traceRoutes is router middleware that records a server span for every
+// request, named after its route. A W3C traceparent header on the request
+// makes the span part of the caller's trace.
+func (a *API) traceRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.HTTPRoute(route)),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// startSpan starts a span for an operation performed while serving r, such
+// as a group of storage calls. The span is not added to r, so call it for
+// leaf operations only.
+func (a *API) startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := tracer.Start(r.Context(), name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// storageSpan starts a span for token storage calls, labelled with the
+// configured storage backend.
+func (a *API) storageSpan(r *http.Request, name string) trace.Span {
+	return a.startSpan(r, name, attribute.String("storage.type", a.cfg.App.StorageType))
+}
+
+// endSpan ends span, marking it failed when err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
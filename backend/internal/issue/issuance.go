@@ -2,54 +2,198 @@ package issue
 
 import (
 	"backend/internal/config"
-	"crypto/rsa"
+	"backend/internal/core"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/irmago/irma"
 )
 
+// ErrUnknownCredential is returned when a client asks for a credential that is
+// not configured.
+var ErrUnknownCredential = errors.New("unknown credential")
+
+// ErrUnknownRevocationKey is returned by Revoke when the IRMA server has no
+// credential issued with the key, e.g. because the session it was created for
+// never completed.
+var ErrUnknownRevocationKey = errors.New("unknown revocation key")
+
 type JwtCreator interface {
+	// CreateJwt creates an issuance request for the default credential.
 	CreateJwt(email string) (jwt string, err error)
+	// CreateJwtForCredential creates an issuance request for the credential
+	// with the given name, or the default credential when name is empty.
+	CreateJwtForCredential(name, email string) (jwt string, err error)
+	// Issue is like CreateJwtForCredential, but also returns the revocation
+	// key and validity of the credential.
+	Issue(name, email string) (Issuance, error)
+}
+
+// Issuance is a signed issuance request for one credential.
+type Issuance struct {
+	JWT string
+	// Credential is the full credential type ID.
+	Credential string
+	// RevocationKey is empty unless the credential supports revocation.
+	RevocationKey string
+	// Validity is how long the credential will be valid.
+	Validity time.Duration
 }
 
 func NewIrmaJwtCreator(cfg config.JWTConfig) (*DefaultJwtCreator, error) {
-	privateKey, err := config.LoadRSAPrivateKey(cfg.PrivateKeyPath)
+	privateKey, err := config.LoadSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewJwtCreatorWithSigner(cfg, privateKey)
+}
+
+// NewJwtCreatorWithSigner is like NewIrmaJwtCreator, but signs with the given
+// key instead of the one configured in cfg. The key may be any crypto.Signer,
+// such as one backed by a hardware security module.
+func NewJwtCreatorWithSigner(cfg config.JWTConfig, privateKey crypto.Signer) (*DefaultJwtCreator, error) {
+	signingMethod, err := config.SigningMethod(privateKey, cfg.SigningAlgorithm)
 	if err != nil {
 		return nil, err
 	}
 
 	return &DefaultJwtCreator{
-		issuerId:   cfg.IssuerID,
-		privateKey: privateKey,
-		credential: cfg.Credential,
-		attributes: cfg.Attributes,
+		issuerId:      cfg.IssuerID,
+		privateKey:    privateKey,
+		signingMethod: signingMethod,
+		credentials:   cfg.CredentialsOrDefault(),
+		now:           time.Now,
 	}, nil
 }
 
 type DefaultJwtCreator struct {
-	privateKey *rsa.PrivateKey
-	issuerId   string
-	credential string
-	attributes config.EmailCredentialAttributes
+	privateKey    crypto.Signer
+	signingMethod jwt.SigningMethod
+	issuerId      string
+	credentials   []config.CredentialConfig
+	now           func() time.Time
 }
 
 func (jc *DefaultJwtCreator) CreateJwt(email string) (string, error) {
-	issuanceRequest := irma.NewIssuanceRequest([]*irma.CredentialRequest{
-		{
-			CredentialTypeID: irma.NewCredentialTypeIdentifier(jc.credential),
-			Attributes: map[string]string{
-				jc.attributes.Email:       email,
-				jc.attributes.EmailDomain: email[strings.Index(email, "@")+1:],
-			},
-			SdJwtBatchSize: 200,
-		},
-	})
+	return jc.CreateJwtForCredential("", email)
+}
 
-	return irma.SignSessionRequest(
-		issuanceRequest,
-		jwt.GetSigningMethod(jwt.SigningMethodRS256.Alg()),
+func (jc *DefaultJwtCreator) CreateJwtForCredential(name, email string) (string, error) {
+	issuance, err := jc.Issue(name, email)
+	return issuance.JWT, err
+}
+
+func (jc *DefaultJwtCreator) Issue(name, email string) (Issuance, error) {
+	credential, err := jc.credential(name)
+	if err != nil {
+		return Issuance{}, err
+	}
+
+	request := &irma.CredentialRequest{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier(credential.Credential),
+		Attributes:       jc.attributes(credential.Attributes, email),
+		SdJwtBatchSize:   uint(credential.BatchSizeOrDefault()),
+	}
+	if credential.Validity != 0 {
+		validity := irma.Timestamp(jc.now().Add(time.Duration(credential.Validity)))
+		request.Validity = &validity
+	}
+	if credential.Revocation {
+		if request.RevocationKey, err = core.GenerateLinkToken(); err != nil {
+			return Issuance{}, err
+		}
+	}
+
+	token, err := irma.SignSessionRequest(
+		irma.NewIssuanceRequest([]*irma.CredentialRequest{request}),
+		jc.signingMethod,
 		jc.privateKey,
 		jc.issuerId,
 	)
+	if err != nil {
+		return Issuance{}, err
+	}
+	return Issuance{
+		JWT:           token,
+		Credential:    credential.Credential,
+		RevocationKey: request.RevocationKey,
+		Validity:      credential.ValidityOrDefault(),
+	}, nil
+}
+
+// Revoke asks the IRMA server at serverURL to revoke the credential of type
+// credential that was issued with the given revocation key. The request is
+// signed with the issuer key, like issuance requests.
+func (jc *DefaultJwtCreator) Revoke(client *http.Client, serverURL, credential, key string) error {
+	claims := &irma.RevocationJwt{
+		ServerJwt: irma.ServerJwt{
+			Type:       "revocation_request",
+			ServerName: jc.issuerId,
+			IssuedAt:   irma.Timestamp(jc.now()),
+		},
+		Request: &irma.RevocationRequest{
+			LDContext:      irma.LDContextRevocationRequest,
+			CredentialType: irma.NewCredentialTypeIdentifier(credential),
+			Key:            key,
+		},
+	}
+	token, err := claims.Sign(jc.signingMethod, jc.privateKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(strings.TrimSuffix(serverURL, "/")+"/revocation", "text/plain", strings.NewReader(token))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		var rerr irma.RemoteError
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if json.Unmarshal(body, &rerr) == nil && rerr.ErrorName == "UNKNOWN_REVOCATION_KEY" {
+			return ErrUnknownRevocationKey
+		}
+		return fmt.Errorf("IRMA server rejected revocation: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return checkResponse(resp, "revocation")
+}
+
+func (jc *DefaultJwtCreator) credential(name string) (config.CredentialConfig, error) {
+	if name == "" {
+		return jc.credentials[0], nil
+	}
+	for _, c := range jc.credentials {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return config.CredentialConfig{}, ErrUnknownCredential
+}
+
+// attributes derives the attribute values of a credential from the verified
+// email address.
+func (jc *DefaultJwtCreator) attributes(names config.EmailCredentialAttributes, email string) map[string]string {
+	at := strings.LastIndex(email, "@")
+	values := map[string]string{}
+	if names.Email != "" {
+		values[names.Email] = email
+	}
+	if names.EmailDomain != "" {
+		values[names.EmailDomain] = email[at+1:]
+	}
+	if names.LocalPart != "" {
+		values[names.LocalPart] = email[:at]
+	}
+	if names.VerifiedAt != "" {
+		values[names.VerifiedAt] = strconv.FormatInt(jc.now().Unix(), 10)
+	}
+	return values
 }
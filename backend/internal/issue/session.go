@@ -0,0 +1,88 @@
+package issue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/privacybydesign/irmago/irma"
+)
+
+// SessionPackage is the IRMA server's response to a session request. The
+// session pointer and frontend request are handed to the frontend as-is; the
+// requestor token must stay on the server.
+type SessionPackage struct {
+	SessionPtr      json.RawMessage `json:"sessionPtr"`
+	Token           string          `json:"token"`
+	FrontendRequest json.RawMessage `json:"frontendRequest"`
+}
+
+// IrmaServerClient talks to the requestor API of an IRMA server.
+type IrmaServerClient struct {
+	Client *http.Client
+	URL    string
+}
+
+// StartSession posts a signed session request and returns the started
+// session.
+func (c IrmaServerClient) StartSession(jwt string) (*SessionPackage, error) {
+	resp, err := c.Client.Post(c.endpoint("session"), "text/plain", strings.NewReader(jwt))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := checkResponse(resp, "session start"); err != nil {
+		return nil, err
+	}
+
+	var pkg SessionPackage
+	if err := json.NewDecoder(resp.Body).Decode(&pkg); err != nil {
+		return nil, fmt.Errorf("invalid session start response: %w", err)
+	}
+	if len(pkg.SessionPtr) == 0 || pkg.Token == "" {
+		return nil, fmt.Errorf("invalid session start response: missing session pointer or token")
+	}
+	return &pkg, nil
+}
+
+// SessionStatus returns the status of the session with the given requestor
+// token, e.g. irma.ServerStatusDone.
+func (c IrmaServerClient) SessionStatus(ctx context.Context, token string) (irma.ServerStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("session", token, "status"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := checkResponse(resp, "session status"); err != nil {
+		return "", err
+	}
+
+	var status irma.ServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", fmt.Errorf("invalid session status response: %w", err)
+	}
+	return status, nil
+}
+
+func (c IrmaServerClient) endpoint(parts ...string) string {
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/" + strings.Join(parts, "/")
+}
+
+func checkResponse(resp *http.Response, what string) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("IRMA server rejected %s: %s: %s", what, resp.Status, strings.TrimSpace(string(body)))
+}
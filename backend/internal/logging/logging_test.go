@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"backend/internal/config"
+)
+
+func TestRedactsByDefault(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(config.LoggingConfig{Format: "json"}, &buf)
+
+	logger.Info("sending email to user@example.com",
+		"to", "John Doe <john.doe@example.org>",
+		"code", "ABC123",
+		"link_token", "secret-link-token",
+		"body", "<a href=\"https://example.com/en/enroll#token:secret-link-token\">",
+		"error", errors.New("mailbox alice@example.net unavailable"),
+		"count", 3,
+	)
+
+	line := buf.String()
+	for _, secret := range []string{"user@", "john.doe@", "alice@", "ABC123", "secret-link-token"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("expected %q to be redacted, got %s", secret, line)
+		}
+	}
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON line, got %s: %v", line, err)
+	}
+	want := map[string]any{
+		"msg":   "sending email to ***@example.com",
+		"to":    "John Doe <***@example.org>",
+		"code":  Redacted,
+		"error": "mailbox ***@example.net unavailable",
+		"count": float64(3),
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, entry[key])
+		}
+	}
+}
+
+func TestRedactionCanBeDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	redact := false
+	New(config.LoggingConfig{Redact: &redact}, &buf).Info("sent", "email", "user@example.com", "code", "ABC123")
+
+	if line := buf.String(); !strings.Contains(line, "user@example.com") || !strings.Contains(line, "ABC123") {
+		t.Fatalf("expected the values to be logged as is, got %s", line)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(config.LoggingConfig{Level: "warn"}, &buf)
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+
+	if line := buf.String(); strings.Contains(line, "hidden") || !strings.Contains(line, "shown") {
+		t.Fatalf("expected only the warning to be logged, got %s", line)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(config.LoggingConfig{}, &buf).With("component", "test")
+
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "with id")
+	logger.Info("without id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "request_id=req-1") || strings.Contains(lines[1], "request_id") {
+		t.Fatalf("expected only the first line to carry the request ID, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "component=test") {
+		t.Fatalf("expected attributes added with With to be kept, got %s", lines[0])
+	}
+}
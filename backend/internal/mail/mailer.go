@@ -2,7 +2,10 @@ package mail
 
 import (
 	"backend/internal/config"
-	"log"
+	"backend/internal/metrics"
+	"context"
+	"log/slog"
+	"time"
 
 	gomail "gopkg.in/mail.v2"
 )
@@ -12,15 +15,22 @@ type Email struct {
 	To      string
 	Subject string
 	Body    string
+	// Language is the language of the template the email was rendered
+	// from. It is not sent; it only labels the email in the metrics.
+	Language string
 }
 
 type Mailer interface {
-	SendEmail(e Email) error
+	// SendEmail sends e. ctx carries the values of the request the email is
+	// sent for, such as its request ID.
+	SendEmail(ctx context.Context, e Email) error
 }
 
 type SmtpMailer struct {
 	mcfg   *config.MailConfig
 	dialer *gomail.Dialer
+	// Logger receives send failures. Nil logs to slog.Default().
+	Logger *slog.Logger
 }
 
 func NewSmtpMailer(mcfg *config.MailConfig) *SmtpMailer {
@@ -28,7 +38,7 @@ func NewSmtpMailer(mcfg *config.MailConfig) *SmtpMailer {
 	return &SmtpMailer{mcfg: mcfg, dialer: dialer}
 }
 
-func (sm SmtpMailer) SendEmail(e Email) error {
+func (sm SmtpMailer) SendEmail(ctx context.Context, e Email) error {
 	gm := gomail.NewMessage()
 	gm.SetHeader("From", e.From)
 	gm.SetHeader("To", e.To)
@@ -36,15 +46,44 @@ func (sm SmtpMailer) SendEmail(e Email) error {
 	gm.SetBody("text/html", e.Body)
 	err := sm.dialer.DialAndSend(gm)
 	if err != nil {
-		log.Printf("error: %s", err)
+		loggerOrDefault(sm.Logger).ErrorContext(ctx, "mail: sending failed", "to", e.To, "error", err)
 	}
 
 	return err
 }
 
-type DummyMailer struct{}
+// DummyMailer logs emails instead of sending them. The body, which holds the
+// verification code and link, is only logged at debug level and is redacted
+// unless redaction is disabled.
+type DummyMailer struct {
+	// Logger receives the emails. Nil logs to slog.Default().
+	Logger *slog.Logger
+}
 
-func (dm DummyMailer) SendEmail(e Email) error {
-	log.Printf("Sending email to %s with subject '%s' and body '%s'\n", e.To, e.Subject, e.Body)
+func (dm DummyMailer) SendEmail(ctx context.Context, e Email) error {
+	logger := loggerOrDefault(dm.Logger)
+	logger.InfoContext(ctx, "mail: not sending email with the dummy mailer", "to", e.To, "subject", e.Subject)
+	logger.DebugContext(ctx, "mail: dummy email body", "to", e.To, "body", e.Body)
 	return nil
 }
+
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// MeteredMailer records the outcome and latency of every email sent through
+// Mailer in Metrics.
+type MeteredMailer struct {
+	Mailer  Mailer
+	Metrics *metrics.Metrics
+}
+
+func (mm MeteredMailer) SendEmail(ctx context.Context, e Email) error {
+	start := time.Now()
+	err := mm.Mailer.SendEmail(ctx, e)
+	mm.Metrics.EmailSent(e.Language, time.Since(start), err)
+	return err
+}
@@ -1,6 +1,7 @@
 package mail
 
 import (
+	"context"
 	"testing"
 
 	gomail "gopkg.in/mail.v2"
@@ -13,7 +14,7 @@ func TestSmtpMailerSendEmailReturnsDialError(t *testing.T) {
 		dialer: gomail.NewDialer("127.0.0.1", 1, "user", "pass"),
 	}
 
-	err := sm.SendEmail(Email{
+	err := sm.SendEmail(context.Background(), Email{
 		From:    "from@example.com",
 		To:      "to@example.com",
 		Subject: "subject",
@@ -27,7 +28,7 @@ func TestSmtpMailerSendEmailReturnsDialError(t *testing.T) {
 
 // DummyMailer never dials anything, so it should always succeed.
 func TestDummyMailerSendEmailReturnsNil(t *testing.T) {
-	if err := (DummyMailer{}).SendEmail(Email{To: "to@example.com"}); err != nil {
+	if err := (DummyMailer{}).SendEmail(context.Background(), Email{To: "to@example.com"}); err != nil {
 		t.Fatalf("expected nil error from DummyMailer, got %v", err)
 	}
 }
@@ -0,0 +1,192 @@
+// Package metrics collects the Prometheus metrics of the email issuer.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "email_issuer"
+
+// Verification methods, used as the method label of verifications_total.
+const (
+	MethodCode = "code"
+	MethodLink = "link"
+)
+
+// Metrics holds the collectors of one server. Every method is a no-op on a
+// nil *Metrics, so components can be used without metrics, e.g. in tests.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	emailsSent           *prometheus.CounterVec
+	emailsFailed         *prometheus.CounterVec
+	smtpSendDuration     prometheus.Histogram
+	verifications        *prometheus.CounterVec
+	rateLimitRejections  *prometheus.CounterVec
+	jwtsIssued           *prometheus.CounterVec
+	issuanceSessions     *prometheus.CounterVec
+	validatorRejections  *prometheus.CounterVec
+	httpRequestDurations *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them, along with the Go runtime
+// and process collectors, on a registry of their own.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		emailsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "emails_sent_total",
+			Help:      "Verification emails sent, by language.",
+		}, []string{"language"}),
+		emailsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "emails_failed_total",
+			Help:      "Verification emails that could not be sent, by language.",
+		}, []string{"language"}),
+		smtpSendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "smtp_send_duration_seconds",
+			Help:      "Time taken to hand a verification email to the SMTP server.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "verifications_total",
+			Help:      "Verification attempts, by method (code or link) and result (success or failure).",
+		}, []string{"method", "result"}),
+		rateLimitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_rejections_total",
+			Help:      "Requests rejected by a rate limit, by the dimension (email, ip, domain or route) that rejected them.",
+		}, []string{"dimension"}),
+		jwtsIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jwts_issued_total",
+			Help:      "Issuance JWTs created, by credential.",
+		}, []string{"credential"}),
+		issuanceSessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "issuance_sessions_total",
+			Help:      "Issuance sessions started by the backend, by how they ended (done, cancelled, timeout or untracked).",
+		}, []string{"result"}),
+		validatorRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "validator_rejections_total",
+			Help:      "Email addresses rejected by the address validator or domain policy, by error code.",
+		}, []string{"code"}),
+		httpRequestDurations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency, by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.emailsSent,
+		m.emailsFailed,
+		m.smtpSendDuration,
+		m.verifications,
+		m.rateLimitRejections,
+		m.jwtsIssued,
+		m.issuanceSessions,
+		m.validatorRejections,
+		m.httpRequestDurations,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// EmailSent records an attempt to send an email in language that took d and
+// failed with err, if not nil.
+func (m *Metrics) EmailSent(language string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.smtpSendDuration.Observe(d.Seconds())
+	if err != nil {
+		m.emailsFailed.WithLabelValues(language).Inc()
+		return
+	}
+	m.emailsSent.WithLabelValues(language).Inc()
+}
+
+// Verification records a verification attempt by method.
+func (m *Metrics) Verification(method string, success bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.verifications.WithLabelValues(method, result).Inc()
+}
+
+// RateLimitRejected records a request rejected by the limit of dimension.
+func (m *Metrics) RateLimitRejected(dimension string) {
+	if m == nil {
+		return
+	}
+	m.rateLimitRejections.WithLabelValues(dimension).Inc()
+}
+
+// JWTIssued records an issuance JWT created for credential.
+func (m *Metrics) JWTIssued(credential string) {
+	if m == nil {
+		return
+	}
+	m.jwtsIssued.WithLabelValues(credential).Inc()
+}
+
+// IssuanceSession records how an issuance session started by the backend
+// ended: the lower-cased final status of the session, or "untracked".
+func (m *Metrics) IssuanceSession(result string) {
+	if m == nil {
+		return
+	}
+	m.issuanceSessions.WithLabelValues(result).Inc()
+}
+
+// ValidatorRejected records an email address rejected with code.
+func (m *Metrics) ValidatorRejected(code string) {
+	if m == nil {
+		return
+	}
+	m.validatorRejections.WithLabelValues(code).Inc()
+}
+
+// RequestServed records a request for route that was answered with status
+// code after d.
+func (m *Metrics) RequestServed(route, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.httpRequestDurations.WithLabelValues(route, methodLabel(method), strconv.Itoa(code)).Observe(d.Seconds())
+}
+
+// methodLabel maps method to one of a fixed set of labels. The catch-all
+// route accepts any method, so labelling by the raw method would let clients
+// create series at will.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
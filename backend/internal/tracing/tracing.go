@@ -0,0 +1,49 @@
+// Package tracing sets up OpenTelemetry tracing for the email issuer.
+package tracing
+
+import (
+	"backend/internal/config"
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+)
+
+// Setup installs the W3C trace-context propagator and, when tc has an
+// endpoint, a tracer provider that exports spans over OTLP/HTTP. Without an
+// endpoint spans are not recorded, but trace context is still passed on.
+// The returned function flushes and stops the exporter.
+func Setup(tc config.TracingConfig) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if tc.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(tc.Endpoint),
+		otlptracehttp.WithHeaders(tc.Headers),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(tc.ServiceNameOrDefault()))),
+		sdktrace.WithSampler(sampler(tc.SampleRatioOrDefault())),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// sampler samples ratio of the traces, both those started here and those
+// continued from a traceparent header. Any client can send that header, so
+// its sampled flag is not obeyed; a parent that is not sampled still keeps
+// the trace unsampled.
+func sampler(ratio float64) sdktrace.Sampler {
+	ratioBased := sdktrace.TraceIDRatioBased(ratio)
+	return sdktrace.ParentBased(ratioBased, sdktrace.WithRemoteParentSampled(ratioBased))
+}
@@ -0,0 +1,37 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSamplerAppliesRatioToRemoteParents(t *testing.T) {
+	parent := func(flags trace.TraceFlags) context.Context {
+		return trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{1},
+			TraceFlags: flags,
+			Remote:     true,
+		}))
+	}
+	decide := func(s sdktrace.Sampler, ctx context.Context) sdktrace.SamplingDecision {
+		return s.ShouldSample(sdktrace.SamplingParameters{ParentContext: ctx, TraceID: trace.TraceID{1}, Name: "test"}).Decision
+	}
+
+	// A client cannot force sampling by sending a sampled traceparent.
+	if got := decide(sampler(0), parent(trace.FlagsSampled)); got != sdktrace.Drop {
+		t.Fatalf("expected a sampled remote parent to be dropped at ratio 0, got %v", got)
+	}
+	if got := decide(sampler(1), parent(trace.FlagsSampled)); got != sdktrace.RecordAndSample {
+		t.Fatalf("expected a sampled remote parent to be sampled at ratio 1, got %v", got)
+	}
+	if got := decide(sampler(1), parent(0)); got != sdktrace.Drop {
+		t.Fatalf("expected an unsampled remote parent to stay unsampled, got %v", got)
+	}
+	if got := decide(sampler(1), context.Background()); got != sdktrace.RecordAndSample {
+		t.Fatalf("expected a new trace to be sampled at ratio 1, got %v", got)
+	}
+}
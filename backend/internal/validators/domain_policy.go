@@ -0,0 +1,62 @@
+package validators
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DomainPolicy restricts which email domains may be verified. Entries are
+// either an exact domain ("example.com") or a wildcard that matches every
+// subdomain ("*.example.com"); a wildcard does not match the domain itself, so
+// list both to cover the apex as well. Matching is case-insensitive.
+//
+// The deny list always wins. When the allow list is empty every domain that is
+// not denied is allowed.
+type DomainPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// CheckEmailAddress checks the domain of a normalised email address (as
+// returned by ParseAndValidateEmailAddress) against the policy. It returns
+// whether the address is allowed and, if not, an error message key.
+func (p DomainPolicy) CheckEmailAddress(email string) (bool, *string) {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+
+	if MatchesAnyDomain(domain, p.Deny) {
+		_, _, code := invalid("error_email_domain_blocked")
+		return false, code
+	}
+	if len(p.Allow) > 0 && !MatchesAnyDomain(domain, p.Allow) {
+		_, _, code := invalid("error_email_domain_not_allowed")
+		return false, code
+	}
+	return true, nil
+}
+
+// ValidateDomainPattern reports whether pattern is a usable DomainPolicy entry.
+func ValidateDomainPattern(pattern string) error {
+	domain := strings.ToLower(strings.TrimPrefix(pattern, "*."))
+	if !isValidDomainSyntax(domain) {
+		return fmt.Errorf("invalid domain pattern %q", pattern)
+	}
+	return nil
+}
+
+// MatchesAnyDomain reports whether domain matches one of the patterns, using
+// the same exact/wildcard rules as DomainPolicy.
+func MatchesAnyDomain(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesDomain(domain, strings.ToLower(strings.TrimSpace(pattern))) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesDomain(domain, pattern string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(domain, "."+suffix)
+	}
+	return domain == pattern
+}
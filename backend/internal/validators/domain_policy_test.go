@@ -0,0 +1,75 @@
+package validators
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DomainPolicy_Given_EmptyPolicy_Should_AllowEveryDomain(t *testing.T) {
+	allowed, errCode := DomainPolicy{}.CheckEmailAddress("john.doe@example.com")
+	require.True(t, allowed)
+	require.Nil(t, errCode)
+}
+
+func Test_DomainPolicy_Given_AllowList_Should_RejectOtherDomains(t *testing.T) {
+	p := DomainPolicy{Allow: []string{"example.com", "*.example.org"}}
+
+	testCases := map[string]bool{
+		"john@example.com":           true,
+		"john@sub.example.com":       false, // exact entry does not cover subdomains
+		"john@mail.example.org":      true,
+		"john@deep.mail.example.org": true,
+		"john@example.org":           false, // wildcard does not cover the apex
+		"john@notexample.org":        false,
+		"john@gmail.com":             false,
+	}
+
+	for email, want := range testCases {
+		allowed, errCode := p.CheckEmailAddress(email)
+		require.Equalf(t, want, allowed, "email: %s", email)
+		if !want {
+			require.Equal(t, "error_email_domain_not_allowed", *errCode)
+		}
+	}
+}
+
+func Test_DomainPolicy_Given_DenyList_Should_RejectListedDomains(t *testing.T) {
+	p := DomainPolicy{Deny: []string{"mailinator.com", "*.tempmail.net"}}
+
+	allowed, errCode := p.CheckEmailAddress("john@mailinator.com")
+	require.False(t, allowed)
+	require.Equal(t, "error_email_domain_blocked", *errCode)
+
+	allowed, _ = p.CheckEmailAddress("john@x.tempmail.net")
+	require.False(t, allowed)
+
+	allowed, _ = p.CheckEmailAddress("john@example.com")
+	require.True(t, allowed)
+}
+
+func Test_DomainPolicy_Given_DeniedAndAllowedDomain_Should_Deny(t *testing.T) {
+	p := DomainPolicy{Allow: []string{"*.example.com"}, Deny: []string{"spam.example.com"}}
+
+	allowed, errCode := p.CheckEmailAddress("john@spam.example.com")
+	require.False(t, allowed)
+	require.Equal(t, "error_email_domain_blocked", *errCode)
+
+	allowed, _ = p.CheckEmailAddress("john@ham.example.com")
+	require.True(t, allowed)
+}
+
+func Test_DomainPolicy_Should_MatchCaseInsensitively(t *testing.T) {
+	p := DomainPolicy{Deny: []string{"Example.COM"}}
+
+	allowed, _ := p.CheckEmailAddress("john@example.com")
+	require.False(t, allowed)
+}
+
+func Test_ValidateDomainPattern(t *testing.T) {
+	require.NoError(t, ValidateDomainPattern("example.com"))
+	require.NoError(t, ValidateDomainPattern("*.example.com"))
+	require.Error(t, ValidateDomainPattern("*"))
+	require.Error(t, ValidateDomainPattern("example"))
+	require.Error(t, ValidateDomainPattern("exa mple.com"))
+}
@@ -1,12 +1,21 @@
 package validators
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/mail"
 	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("backend/internal/validators")
+
 // Resolver abstracts the DNS lookups used to verify that a domain is able to
 // receive email. It is satisfied by the standard net package and can be
 // stubbed in tests so they don't depend on real DNS.
@@ -38,6 +47,12 @@ type EmailValidator struct {
 // If valid, the second return value contains the parsed address from the RFC-5322 format (e.g. "john.doe@example.com").
 // If invalid, an error message is returned in the third return value.
 func (v *EmailValidator) ParseAndValidateEmailAddress(email string) (bool, *string, *string) {
+	return v.ParseAndValidateEmailAddressContext(context.Background(), email)
+}
+
+// ParseAndValidateEmailAddressContext is like ParseAndValidateEmailAddress,
+// but records the DNS lookups as spans of the trace in ctx.
+func (v *EmailValidator) ParseAndValidateEmailAddressContext(ctx context.Context, email string) (bool, *string, *string) {
 	if email == "" {
 		return invalid("email_required")
 	}
@@ -61,7 +76,7 @@ func (v *EmailValidator) ParseAndValidateEmailAddress(email string) (bool, *stri
 		return invalid("error_email_format")
 	}
 
-	if !v.domainCanReceiveMail(domain) {
+	if !v.domainCanReceiveMail(ctx, domain) {
 		return invalid("error_email_unknown_domain")
 	}
 
@@ -129,13 +144,15 @@ func isDomainLabelChar(c byte) bool {
 // back to an A/AAAA record as allowed by RFC 5321. Transient DNS failures
 // (timeouts, no network) fail open so legitimate users are never blocked; only
 // a definitive "no such host"/no-records answer rejects the address.
-func (v *EmailValidator) domainCanReceiveMail(domain string) bool {
+func (v *EmailValidator) domainCanReceiveMail(ctx context.Context, domain string) bool {
 	r := v.Resolver
 	if r == nil {
 		r = netResolver{}
 	}
 
+	_, span := tracer.Start(ctx, "dns.lookup_mx", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.DNSQuestionName(domain)))
 	mx, err := r.LookupMX(domain)
+	endLookupSpan(span, len(mx), err)
 	if err != nil && !isNotFound(err) {
 		return true // transient failure: fail open
 	}
@@ -144,13 +161,26 @@ func (v *EmailValidator) domainCanReceiveMail(domain string) bool {
 	}
 
 	// No MX record found; fall back to the A/AAAA record (RFC 5321 §5.1).
+	_, span = tracer.Start(ctx, "dns.lookup_ip", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(semconv.DNSQuestionName(domain)))
 	ips, err := r.LookupIP(domain)
+	endLookupSpan(span, len(ips), err)
 	if err != nil && !isNotFound(err) {
 		return true // transient failure: fail open
 	}
 	return len(ips) > 0
 }
 
+// endLookupSpan ends the span of a DNS lookup that returned n records. A
+// definitive "not found" answer is an outcome rather than an error.
+func endLookupSpan(span trace.Span, n int, err error) {
+	span.SetAttributes(attribute.Int("dns.answer_count", n))
+	if err != nil && !isNotFound(err) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "lookup failed")
+	}
+	span.End()
+}
+
 // isNotFound reports whether the DNS error is a definitive "host not found"
 // answer (NXDOMAIN / no records) as opposed to a transient failure.
 func isNotFound(err error) bool {
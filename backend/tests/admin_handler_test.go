@@ -6,12 +6,26 @@ import (
 	httpapi "backend/internal/http"
 	"backend/internal/mail"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/require"
 )
 
@@ -78,16 +92,16 @@ func TestResetRateLimitUnblocksEmail(t *testing.T) {
 	// Exhaust the per-email limit (10) across enough different IPs that the
 	// per-IP limit (5) is not what blocks us.
 	for i := range 11 {
-		limiter.Allow("198.51.100."+string(rune('0'+i%10)), email)
+		limiter.Allow(t.Context(), "198.51.100."+string(rune('0'+i%10)), email)
 	}
-	allow, _ := limiter.Allow("203.0.113.9", email)
+	allow, _ := limiter.Allow(t.Context(), "203.0.113.9", email)
 	require.False(t, allow, "expected email to be rate-limited before reset")
 
 	resp := postResetRateLimit(t, srv, "s3cret", email)
 	defer func() { _ = resp.Body.Close() }()
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 
-	allow, _ = limiter.Allow("203.0.113.9", email)
+	allow, _ = limiter.Allow(t.Context(), "203.0.113.9", email)
 	require.True(t, allow, "expected email to be allowed after admin reset")
 }
 
@@ -99,15 +113,426 @@ func TestResetRateLimitNormalizesEmail(t *testing.T) {
 	// uses a mixed-case form and must still hit the same entry.
 	email := "locked@example.com"
 	for i := range 11 {
-		limiter.Allow("198.51.100."+string(rune('0'+i%10)), email)
+		limiter.Allow(t.Context(), "198.51.100."+string(rune('0'+i%10)), email)
 	}
-	allow, _ := limiter.Allow("203.0.113.9", email)
+	allow, _ := limiter.Allow(t.Context(), "203.0.113.9", email)
 	require.False(t, allow)
 
 	resp := postResetRateLimit(t, srv, "s3cret", "Locked@Example.com")
 	defer func() { _ = resp.Body.Close() }()
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 
-	allow, _ = limiter.Allow("203.0.113.9", email)
+	allow, _ = limiter.Allow(t.Context(), "203.0.113.9", email)
 	require.True(t, allow, "expected mixed-case reset to unblock the normalized email")
 }
+
+func postAdmin(t *testing.T, srv *httptest.Server, path, token string, body map[string]string) *http.Response {
+	t.Helper()
+	b, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewBuffer(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func getAdmin(t *testing.T, srv *httptest.Server, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestResetRateLimitUnblocksIP(t *testing.T) {
+	limiter := newTestRateLimiter(&mockClock{time: time.Now()})
+	srv := newAdminTestServer(t, "s3cret", limiter)
+
+	ip := "203.0.113.50"
+	for i := range 6 {
+		limiter.Allow(t.Context(), ip, "user"+string(rune('a'+i))+"@example.com")
+	}
+	allow, _ := limiter.Allow(t.Context(), ip, "other@example.com")
+	require.False(t, allow, "expected IP to be rate-limited before reset")
+
+	resp := postAdmin(t, srv, "/api/admin/reset-rate-limit", "s3cret", map[string]string{"ip": ip})
+	body := readResponseBody(t, resp)
+	require.Equalf(t, http.StatusOK, resp.StatusCode, "body: %v", body)
+
+	allow, _ = limiter.Allow(t.Context(), ip, "another@example.com")
+	require.True(t, allow, "expected IP to be allowed after admin reset")
+}
+
+func TestResetRateLimitRequiresExactlyOneTarget(t *testing.T) {
+	srv := newAdminTestServer(t, "s3cret", newTestRateLimiter(&mockClock{time: time.Now()}))
+
+	for want, body := range map[string]map[string]string{
+		"email_required":         {},
+		"email_and_ip_exclusive": {"email": "user@example.com", "ip": "192.0.2.1"},
+	} {
+		resp := postAdmin(t, srv, "/api/admin/reset-rate-limit", "s3cret", body)
+		resBody := readResponseBody(t, resp)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, want, resBody["error"])
+	}
+
+	resp := postAdmin(t, srv, "/api/admin/reset-rate-limit", "s3cret", map[string]string{"ip": "not-an-ip"})
+	resBody := readResponseBody(t, resp)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "error_ip_format", resBody["error"])
+}
+
+func TestRateLimitStatusForIP(t *testing.T) {
+	limiter := newTestRateLimiter(&mockClock{time: time.Now()})
+	srv := newAdminTestServer(t, "s3cret", limiter)
+
+	limiter.Allow(t.Context(), "203.0.113.51", "user@example.com")
+	limiter.Allow(t.Context(), "203.0.113.51", "user@example.com")
+
+	resp := postAdmin(t, srv, "/api/admin/rate-limit-status", "s3cret", map[string]string{"ip": "203.0.113.51"})
+	body := readResponseBody(t, resp)
+	require.Equalf(t, http.StatusOK, resp.StatusCode, "body: %v", body)
+	require.Equal(t, "ip:203.0.113.51", body["key"])
+	require.EqualValues(t, 2, body["count"])
+	require.EqualValues(t, 5, body["limit"])
+	require.Equal(t, false, body["blocked"])
+	require.Positive(t, body["ttl_seconds"])
+}
+
+func TestRateLimitStatusRequiresAdminToken(t *testing.T) {
+	srv := newAdminTestServer(t, "s3cret", newTestRateLimiter(&mockClock{time: time.Now()}))
+
+	resp := postAdmin(t, srv, "/api/admin/rate-limit-status", "wrong-token", map[string]string{"ip": "192.0.2.1"})
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = getAdmin(t, srv, "/api/admin/rate-limits/blocked?dimension=ip", "wrong-token")
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestListBlockedRateLimits(t *testing.T) {
+	limiter := newTestRateLimiter(&mockClock{time: time.Now()})
+	srv := newAdminTestServer(t, "s3cret", limiter)
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		for i := range 6 {
+			limiter.Allow(t.Context(), ip, "user"+string(rune('a'+i))+"@example.com")
+		}
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for range 5 {
+		resp := getAdmin(t, srv, "/api/admin/rate-limits/blocked?dimension=ip&limit=2&cursor="+cursor, "s3cret")
+		body := readResponseBody(t, resp)
+		require.Equalf(t, http.StatusOK, resp.StatusCode, "body: %v", body)
+
+		for _, k := range body["keys"].([]any) {
+			entry := k.(map[string]any)
+			require.Equal(t, true, entry["blocked"])
+			seen[entry["key"].(string)] = true
+		}
+		cursor = body["next_cursor"].(string)
+		if cursor == "" {
+			break
+		}
+	}
+	require.Equal(t, map[string]bool{"ip:192.0.2.1": true, "ip:192.0.2.2": true, "ip:192.0.2.3": true}, seen)
+
+	resp := getAdmin(t, srv, "/api/admin/rate-limits/blocked", "s3cret")
+	body := readResponseBody(t, resp)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "dimension_required", body["error"])
+}
+
+// With app.admin_addr set, the admin routes move to AdminRoutes and are no
+// longer reachable on the public router.
+func TestAdminRoutesOnSeparateListener(t *testing.T) {
+	cfg := &config.Config{
+		App:  config.AppConfig{Addr: ":8080", AdminAddr: "127.0.0.1:9090", AdminToken: "s3cret"},
+		Mail: config.MailConfig{From: "noreply@example.com"},
+	}
+	api := httpapi.NewAPI(cfg, newTestRateLimiter(&mockClock{time: time.Now()}), mail.DummyMailer{}, &core.StaticTokenGenerator{Token: "TESTTK"}, core.NewInMemoryTokenStorage())
+
+	public := httptest.NewServer(api.Routes())
+	t.Cleanup(public.Close)
+	admin := httptest.NewServer(api.AdminRoutes())
+	t.Cleanup(admin.Close)
+
+	resp := postAdmin(t, public, "/api/admin/reset-rate-limit", "s3cret", map[string]string{"ip": "192.0.2.1"})
+	defer func() { _ = resp.Body.Close() }()
+	require.NotEqual(t, http.StatusOK, resp.StatusCode, "admin route must not be served on the public listener")
+	require.NotEqual(t, http.StatusUnauthorized, resp.StatusCode, "admin handler must not run on the public listener")
+
+	resp = postAdmin(t, admin, "/api/admin/reset-rate-limit", "s3cret", map[string]string{"ip": "192.0.2.1"})
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	health, err := http.Get(admin.URL + "/api/health")
+	require.NoError(t, err)
+	defer func() { _ = health.Body.Close() }()
+	require.Equal(t, http.StatusOK, health.StatusCode)
+
+	// The public API is not exposed on the admin listener.
+	send, err := http.Post(admin.URL+"/api/send", "application/json", bytes.NewBufferString(`{}`))
+	require.NoError(t, err)
+	defer func() { _ = send.Body.Close() }()
+	require.Equal(t, http.StatusNotFound, send.StatusCode)
+}
+
+func sha256Hex(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newScopedAdminAPI(t *testing.T, creds ...config.AdminCredential) (*httpapi.API, *httptest.Server) {
+	t.Helper()
+	cfg := &config.Config{
+		App:  config.AppConfig{Addr: ":8080", AdminCredentials: creds},
+		Mail: config.MailConfig{From: "noreply@example.com"},
+	}
+	api := httpapi.NewAPI(cfg, newTestRateLimiter(&mockClock{time: time.Now()}), mail.DummyMailer{}, &core.StaticTokenGenerator{Token: "TESTTK"}, core.NewInMemoryTokenStorage())
+	srv := httptest.NewServer(api.Routes())
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func TestAdminCredentialScopes(t *testing.T) {
+	_, srv := newScopedAdminAPI(t,
+		config.AdminCredential{Name: "ops", TokenSHA256: sha256Hex("ops-token-0123456789"), Scopes: []string{config.ScopeRateLimitReset, config.ScopeStatsRead}},
+		config.AdminCredential{Name: "dashboard", TokenSHA256: sha256Hex("dashboard-token-0123"), Scopes: []string{config.ScopeStatsRead}},
+	)
+	target := map[string]string{"ip": "192.0.2.1"}
+
+	resp := postAdmin(t, srv, "/api/admin/reset-rate-limit", "ops-token-0123456789", target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = postAdmin(t, srv, "/api/admin/rate-limit-status", "dashboard-token-0123", target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = postAdmin(t, srv, "/api/admin/reset-rate-limit", "dashboard-token-0123", target)
+	body := readResponseBody(t, resp)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Equal(t, "insufficient_scope", body["error"])
+
+	// The hash itself is not a valid token.
+	resp = postAdmin(t, srv, "/api/admin/rate-limit-status", sha256Hex("dashboard-token-0123"), target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAdminAuditLogRecordsCredentialName(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	_, srv := newScopedAdminAPI(t,
+		config.AdminCredential{Name: "ops-alice", TokenSHA256: sha256Hex("alice-token-0123456789"), Scopes: []string{config.ScopeRateLimitReset}},
+	)
+
+	resp := postAdmin(t, srv, "/api/admin/reset-rate-limit", "alice-token-0123456789", map[string]string{"ip": "192.0.2.1"})
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, buf.String(), "admin=ops-alice")
+}
+
+func TestReloadAdminCredentialsRotatesTokens(t *testing.T) {
+	api, srv := newScopedAdminAPI(t,
+		config.AdminCredential{Name: "ops", TokenSHA256: sha256Hex("old-token-0123456789"), Scopes: []string{config.ScopeStatsRead}},
+	)
+	target := map[string]string{"ip": "192.0.2.1"}
+
+	api.ReloadAdminCredentials(config.AppConfig{AdminCredentials: []config.AdminCredential{
+		{Name: "ops", TokenSHA256: sha256Hex("new-token-0123456789"), Scopes: []string{config.ScopeStatsRead}},
+	}})
+
+	resp := postAdmin(t, srv, "/api/admin/rate-limit-status", "old-token-0123456789", target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = postAdmin(t, srv, "/api/admin/rate-limit-status", "new-token-0123456789", target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Reloading an empty set disables the admin endpoints again.
+	api.ReloadAdminCredentials(config.AppConfig{})
+	resp = postAdmin(t, srv, "/api/admin/rate-limit-status", "new-token-0123456789", target)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func newJWTAdminAPI(t *testing.T, key *ecdsa.PrivateKey) *httptest.Server {
+	t.Helper()
+	point, err := key.PublicKey.Bytes()
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "EC", "kid": "admin-1", "crv": "P-256", "x": b64(point[1:33]), "y": b64(point[33:])},
+	}})
+	require.NoError(t, err)
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(jwksPath, jwks, 0o600))
+
+	cfg := &config.Config{
+		App: config.AppConfig{Addr: ":8080", AdminJWT: &config.AdminJWTConfig{
+			JWKSPath: jwksPath,
+			Issuer:   "https://idp.example.com",
+			Audience: "email-issuer-admin",
+		}},
+		Mail: config.MailConfig{From: "noreply@example.com"},
+	}
+	api := httpapi.NewAPI(cfg, newTestRateLimiter(&mockClock{time: time.Now()}), mail.DummyMailer{}, &core.StaticTokenGenerator{Token: "TESTTK"}, core.NewInMemoryTokenStorage())
+	srv := httptest.NewServer(api.Routes())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func signAdminJWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestAdminJWTAuthentication(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv := newJWTAdminAPI(t, key)
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   "https://idp.example.com",
+			"aud":   "email-issuer-admin",
+			"sub":   "ops-alice",
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"scope": "openid stats:read",
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := map[string]struct {
+		token string
+		want  int
+	}{
+		"valid":         {signAdminJWT(t, key, "admin-1", valid()), http.StatusOK},
+		"no scopes":     {signAdminJWT(t, key, "admin-1", with("scope", nil)), http.StatusForbidden},
+		"wrong issuer":  {signAdminJWT(t, key, "admin-1", with("iss", "https://evil.example.com")), http.StatusUnauthorized},
+		"wrong aud":     {signAdminJWT(t, key, "admin-1", with("aud", "another-service")), http.StatusUnauthorized},
+		"expired":       {signAdminJWT(t, key, "admin-1", with("exp", time.Now().Add(-time.Minute).Unix())), http.StatusUnauthorized},
+		"no exp":        {signAdminJWT(t, key, "admin-1", with("exp", nil)), http.StatusUnauthorized},
+		"missing scope": {signAdminJWT(t, key, "admin-1", with("scope", "openid")), http.StatusForbidden},
+		"unknown kid":   {signAdminJWT(t, key, "admin-2", valid()), http.StatusUnauthorized},
+		"wrong key":     {signAdminJWT(t, otherKey, "admin-1", valid()), http.StatusUnauthorized},
+	}
+	for name, tc := range tests {
+		resp := postAdmin(t, srv, "/api/admin/rate-limit-status", tc.token, map[string]string{"ip": "192.0.2.1"})
+		_ = resp.Body.Close()
+		require.Equal(t, tc.want, resp.StatusCode, name)
+	}
+
+	claims := with("scope", nil)
+	claims["scp"] = []string{"stats:read"}
+	resp := postAdmin(t, srv, "/api/admin/rate-limit-status", signAdminJWT(t, key, "admin-1", claims), map[string]string{"ip": "192.0.2.1"})
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// newTestCert creates a certificate for subject, signed by parent (or
+// self-signed when parent is nil).
+func newTestCert(t *testing.T, subject pkix.Name, isCA bool, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestAdminClientCertificateAuthentication(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ca := newTestCert(t, pkix.Name{CommonName: "Admin CA"}, true, nil)
+	alice := newTestCert(t, pkix.Name{CommonName: "ops-alice", Organization: []string{"Yivi"}}, false, &ca)
+	bob := newTestCert(t, pkix.Name{CommonName: "ops-bob", Organization: []string{"Yivi"}}, false, &ca)
+	dashboard := newTestCert(t, pkix.Name{CommonName: "dashboard", Organization: []string{"Yivi"}}, false, &ca)
+
+	cfg := &config.Config{
+		App: config.AppConfig{Addr: ":8080", AdminClientCerts: &config.AdminClientCertConfig{Subjects: []config.AdminCertSubject{
+			{Name: "ops-alice", Subject: "CN=ops-alice,O=Yivi", Scopes: []string{config.ScopeRateLimitReset}},
+			{Name: "dashboard", Subject: "CN=dashboard,O=Yivi", Scopes: []string{config.ScopeStatsRead}},
+		}}},
+		Mail: config.MailConfig{From: "noreply@example.com"},
+	}
+	api := httpapi.NewAPI(cfg, newTestRateLimiter(&mockClock{time: time.Now()}), mail.DummyMailer{}, &core.StaticTokenGenerator{Token: "TESTTK"}, core.NewInMemoryTokenStorage())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv := httptest.NewUnstartedServer(api.AdminRoutes())
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	resetAs := func(cert *tls.Certificate) int {
+		client := srv.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client.Transport = transport
+
+		b, err := json.Marshal(map[string]string{"ip": "192.0.2.1"})
+		require.NoError(t, err)
+		resp, err := client.Post(srv.URL+"/api/admin/reset-rate-limit", "application/json", bytes.NewBuffer(b))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, resetAs(&alice))
+	require.Contains(t, buf.String(), "admin=cert:ops-alice")
+	require.Equal(t, http.StatusForbidden, resetAs(&dashboard))
+	require.Equal(t, http.StatusUnauthorized, resetAs(&bob))
+	require.Equal(t, http.StatusUnauthorized, resetAs(nil))
+}
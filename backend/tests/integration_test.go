@@ -6,10 +6,13 @@ import (
 	httpapi "backend/internal/http"
 	"backend/internal/mail"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 
@@ -52,6 +55,33 @@ var testToken = "TESTTK"
 var testemail = "test@email.com"
 var testTokenStorage = core.NewInMemoryTokenStorage()
 
+// testClient keeps the session cookie set by /api/send, like a browser, so
+// verification requests come from the session that requested the code.
+var testClient = newTestClient()
+
+// testSessionID is the session ID used by tests that store a code or link
+// token directly instead of going through /api/send.
+const testSessionID = "dGVzdC1zZXNzaW9uLWlkLXRlc3Qtc2Vzc2lvbi1pZC0"
+
+func newTestClient() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// storeTestSession binds the pending verification of email to testSessionID
+// and gives testClient the matching session cookie.
+func storeTestSession(t *testing.T, email string) {
+	t.Helper()
+	require.NoError(t, testTokenStorage.StoreSession(email, testSessionID))
+
+	u, err := url.Parse(testServer.URL + "/api")
+	require.NoError(t, err)
+	testClient.Jar.SetCookies(u, []*http.Cookie{{Name: "email_issuer_session", Value: testSessionID, Path: "/api"}})
+}
+
 func NewTestAPI() *httpapi.API {
 	return httpapi.NewAPI(testCfg, testLimiter, testMailer, &core.StaticTokenGenerator{Token: testToken}, testTokenStorage)
 }
@@ -67,7 +97,7 @@ func makeVerifyEmailRequest(t *testing.T, token string, email string) *http.Resp
 	b, err := json.Marshal(map[string]string{"token": token, "email": email})
 	require.NoError(t, err)
 
-	resp, err := http.Post(testServer.URL+"/api/verify", "application/json", bytes.NewBuffer(b))
+	resp, err := testClient.Post(testServer.URL+"/api/verify", "application/json", bytes.NewBuffer(b))
 	require.NoError(t, err)
 	return resp
 }
@@ -77,7 +107,7 @@ func makeVerifyLinkRequest(t *testing.T, linkToken string) *http.Response {
 	b, err := json.Marshal(map[string]string{"link_token": linkToken})
 	require.NoError(t, err)
 
-	resp, err := http.Post(testServer.URL+"/api/verify-link", "application/json", bytes.NewBuffer(b))
+	resp, err := testClient.Post(testServer.URL+"/api/verify-link", "application/json", bytes.NewBuffer(b))
 	require.NoError(t, err)
 	return resp
 }
@@ -87,7 +117,7 @@ func makeSendEmailRequest(t *testing.T, email, language string) *http.Response {
 	b, err := json.Marshal(map[string]string{"email": email, "language": language})
 	require.NoError(t, err)
 
-	resp, err := http.Post(testServer.URL+"/api/send", "application/json", bytes.NewBuffer(b))
+	resp, err := testClient.Post(testServer.URL+"/api/send", "application/json", bytes.NewBuffer(b))
 	require.NoError(t, err)
 	return resp
 }
@@ -118,6 +148,7 @@ func TestHealthCheckEndpoint(t *testing.T) {
 func TestVerifyEmailHappyPath(t *testing.T) {
 	tokenErr := testTokenStorage.StoreToken(testemail, testToken)
 	require.NoError(t, tokenErr)
+	storeTestSession(t, testemail)
 
 	res := makeVerifyEmailRequest(t, testToken, testemail)
 	resBody := readResponseBody(t, res)
@@ -131,6 +162,7 @@ func TestVerificationCodeIsSingleUse(t *testing.T) {
 
 	tokenErr := testTokenStorage.StoreToken(reuseEmail, testToken)
 	require.NoError(t, tokenErr)
+	storeTestSession(t, reuseEmail)
 
 	// First redemption succeeds and hands out a JWT.
 	firstRes := makeVerifyEmailRequest(t, testToken, reuseEmail)
@@ -200,6 +232,7 @@ func TestSendEmailEmptyData(t *testing.T) {
 func TestVerifyLinkHappyPath(t *testing.T) {
 	linkToken := "opaque-link-token-happy"
 	require.NoError(t, testTokenStorage.StoreLinkToken(linkToken, testemail))
+	storeTestSession(t, testemail)
 
 	res := makeVerifyLinkRequest(t, linkToken)
 	resBody := readResponseBody(t, res)
@@ -217,6 +250,7 @@ func TestVerifyLinkHappyPath(t *testing.T) {
 func TestVerifyLinkTokenIsSingleUse(t *testing.T) {
 	linkToken := "opaque-link-token-single-use"
 	require.NoError(t, testTokenStorage.StoreLinkToken(linkToken, testemail))
+	storeTestSession(t, testemail)
 
 	// First use succeeds.
 	first := makeVerifyLinkRequest(t, linkToken)
@@ -258,7 +292,7 @@ func TestSendEmailStoresLinkTokenWithoutEmailInUrl(t *testing.T) {
 
 	b, err := json.Marshal(map[string]string{"email": testemail, "language": "en"})
 	require.NoError(t, err)
-	resp, err := http.Post(srv.URL+"/api/send", "application/json", bytes.NewBuffer(b))
+	resp, err := testClient.Post(srv.URL+"/api/send", "application/json", bytes.NewBuffer(b))
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 
@@ -286,7 +320,7 @@ func makeVerifyLinkRequestTo(t *testing.T, srv *httptest.Server, linkToken strin
 	t.Helper()
 	b, err := json.Marshal(map[string]string{"link_token": linkToken})
 	require.NoError(t, err)
-	resp, err := http.Post(srv.URL+"/api/verify-link", "application/json", bytes.NewBuffer(b))
+	resp, err := testClient.Post(srv.URL+"/api/verify-link", "application/json", bytes.NewBuffer(b))
 	require.NoError(t, err)
 	return resp
 }
@@ -297,7 +331,7 @@ type capturingMailer struct {
 	last *mail.Email
 }
 
-func (m *capturingMailer) SendEmail(e mail.Email) error {
+func (m *capturingMailer) SendEmail(_ context.Context, e mail.Email) error {
 	m.last = &e
 	return nil
 }
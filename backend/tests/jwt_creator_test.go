@@ -1,9 +1,22 @@
 package main
 
 import (
+	"backend/internal/config"
 	"backend/internal/issue"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,3 +32,181 @@ func TestCreatingJwt(t *testing.T) {
 	require.NoError(t, err, "Failed to create the jwt for the given email")
 	require.NotEmpty(t, jwt, "jwt should not be empty")
 }
+
+// issuedCredential decodes the single credential request of an issuance JWT.
+func issuedCredential(t *testing.T, token string) (credential string, attributes map[string]string, batchSize uint) {
+	t.Helper()
+	var claims struct {
+		jwt.RegisteredClaims
+		Request struct {
+			Request struct {
+				Credentials []struct {
+					Credential     string            `json:"credential"`
+					Attributes     map[string]string `json:"attributes"`
+					SdJwtBatchSize uint              `json:"sdJwtBatchSize"`
+				} `json:"credentials"`
+			} `json:"request"`
+		} `json:"iprequest"`
+	}
+	_, _, err := jwt.NewParser().ParseUnverified(token, &claims)
+	require.NoError(t, err)
+	require.Len(t, claims.Request.Request.Credentials, 1)
+	c := claims.Request.Request.Credentials[0]
+	return c.Credential, c.Attributes, c.SdJwtBatchSize
+}
+
+func TestCreatingJwtForLegacyCredential(t *testing.T) {
+	jwtCreator, err := issue.NewIrmaJwtCreator(testCfg.JWT)
+	require.NoError(t, err)
+
+	token, err := jwtCreator.CreateJwt("test@email.com")
+	require.NoError(t, err)
+
+	credential, attributes, batchSize := issuedCredential(t, token)
+	require.Equal(t, "irma-demo.sidn-pbdf.email", credential)
+	require.Equal(t, map[string]string{"email": "test@email.com", "domain": "email.com"}, attributes)
+	require.EqualValues(t, config.DefaultSdJwtBatchSize, batchSize)
+}
+
+func TestCreatingJwtForConfiguredCredentials(t *testing.T) {
+	cfg := testCfg.JWT
+	cfg.Credentials = []config.CredentialConfig{
+		{
+			Name:       "demo",
+			Credential: "irma-demo.sidn-pbdf.email",
+			Attributes: config.EmailCredentialAttributes{Email: "email"},
+			BatchSize:  10,
+		},
+		{
+			Name:       "production",
+			Credential: "pbdf.sidn-pbdf.email",
+			Attributes: config.EmailCredentialAttributes{
+				Email:       "email",
+				EmailDomain: "domain",
+				LocalPart:   "localpart",
+				VerifiedAt:  "verified",
+			},
+		},
+	}
+	jwtCreator, err := issue.NewIrmaJwtCreator(cfg)
+	require.NoError(t, err)
+
+	// Without a name the first credential is issued.
+	token, err := jwtCreator.CreateJwt("test@email.com")
+	require.NoError(t, err)
+	credential, attributes, batchSize := issuedCredential(t, token)
+	require.Equal(t, "irma-demo.sidn-pbdf.email", credential)
+	require.Equal(t, map[string]string{"email": "test@email.com"}, attributes)
+	require.EqualValues(t, 10, batchSize)
+
+	before := time.Now().Unix()
+	token, err = jwtCreator.CreateJwtForCredential("production", "first.last@email.com")
+	require.NoError(t, err)
+	credential, attributes, _ = issuedCredential(t, token)
+	require.Equal(t, "pbdf.sidn-pbdf.email", credential)
+	require.Equal(t, "first.last@email.com", attributes["email"])
+	require.Equal(t, "email.com", attributes["domain"])
+	require.Equal(t, "first.last", attributes["localpart"])
+	verifiedAt, err := strconv.ParseInt(attributes["verified"], 10, 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, verifiedAt, before)
+
+	_, err = jwtCreator.CreateJwtForCredential("unknown", "test@email.com")
+	require.ErrorIs(t, err, issue.ErrUnknownCredential)
+}
+
+func TestIssuingWithValidityAndRevocation(t *testing.T) {
+	cfg := testCfg.JWT
+	cfg.Credentials = []config.CredentialConfig{{
+		Name:       "production",
+		Credential: "pbdf.sidn-pbdf.email",
+		Attributes: config.EmailCredentialAttributes{Email: "email"},
+		Validity:   config.JSONDuration(30 * 24 * time.Hour),
+		Revocation: true,
+	}}
+	jwtCreator, err := issue.NewIrmaJwtCreator(cfg)
+	require.NoError(t, err)
+
+	before := time.Now()
+	issuance, err := jwtCreator.Issue("", "test@email.com")
+	require.NoError(t, err)
+	require.Equal(t, "pbdf.sidn-pbdf.email", issuance.Credential)
+	require.NotEmpty(t, issuance.RevocationKey)
+	require.Equal(t, 30*24*time.Hour, issuance.Validity)
+
+	var claims struct {
+		jwt.RegisteredClaims
+		Request struct {
+			Request struct {
+				Credentials []struct {
+					Validity      int64  `json:"validity"`
+					RevocationKey string `json:"revocationKey"`
+				} `json:"credentials"`
+			} `json:"request"`
+		} `json:"iprequest"`
+	}
+	_, _, err = jwt.NewParser().ParseUnverified(issuance.JWT, &claims)
+	require.NoError(t, err)
+	require.Len(t, claims.Request.Request.Credentials, 1)
+	c := claims.Request.Request.Credentials[0]
+	require.Equal(t, issuance.RevocationKey, c.RevocationKey)
+	require.GreaterOrEqual(t, c.Validity, before.Add(30*24*time.Hour).Unix())
+
+	// Every issuance gets its own revocation key.
+	again, err := jwtCreator.Issue("", "test@email.com")
+	require.NoError(t, err)
+	require.NotEqual(t, issuance.RevocationKey, again.RevocationKey)
+}
+
+func writeKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestCreatingJwtWithEachKeyType(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		key       any
+		public    any
+		algorithm string
+		want      string
+	}{
+		{"RSA", rsaKey, &rsaKey.PublicKey, "", "RS256"},
+		{"RSA-PSS", rsaKey, &rsaKey.PublicKey, "PS256", "PS256"},
+		{"ECDSA P-256", p256, &p256.PublicKey, "", "ES256"},
+		{"ECDSA P-384", p384, &p384.PublicKey, "", "ES384"},
+		{"Ed25519", edKey, edPublic, "", "EdDSA"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testCfg.JWT
+			cfg.PrivateKeyPath = writeKey(t, tc.key)
+			cfg.SigningAlgorithm = tc.algorithm
+			jwtCreator, err := issue.NewIrmaJwtCreator(cfg)
+			require.NoError(t, err)
+
+			token, err := jwtCreator.CreateJwt("test@email.com")
+			require.NoError(t, err)
+
+			// The signature verifies with the public key and the expected
+			// algorithm.
+			parsed, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return tc.public, nil },
+				jwt.WithValidMethods([]string{tc.want}))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, parsed.Method.Alg())
+		})
+	}
+}
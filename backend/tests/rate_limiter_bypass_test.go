@@ -0,0 +1,88 @@
+package main
+
+import (
+	"backend/internal/config"
+	"backend/internal/core"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newBypassingRateLimiter(t *testing.T, clock core.Clock) *core.TotalRateLimiter {
+	t.Helper()
+	qa, err := config.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+
+	rl := newTestRateLimiter(clock)
+	rl.Bypass = &core.RateLimitBypass{
+		Networks: []*net.IPNet{qa},
+		Emails:   []string{"partner@example.com"},
+		Domains:  []string{"*.test.example.org"},
+	}
+	return rl
+}
+
+func TestRateLimitBypass(t *testing.T) {
+	tests := []struct {
+		name  string
+		ip    func(i int) string
+		email func(i int) string
+	}{
+		{
+			name:  "trusted network",
+			ip:    func(i int) string { return "192.0.2.10" },
+			email: func(i int) string { return fmt.Sprintf("user%d@example.com", i) },
+		},
+		{
+			name:  "trusted email",
+			ip:    func(i int) string { return "198.51.100.1" },
+			email: func(i int) string { return "Partner@Example.com" },
+		},
+		{
+			name:  "trusted email domain",
+			ip:    func(i int) string { return "198.51.100.2" },
+			email: func(i int) string { return fmt.Sprintf("qa%d@ci.test.example.org", i) },
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := newBypassingRateLimiter(t, &mockClock{time: time.Now()})
+			// Far beyond both the IP (5) and email (10) limits.
+			for i := range 50 {
+				allow, timeout := rl.Allow(t.Context(), tc.ip(i), tc.email(i))
+				require.Truef(t, allow, "unexpected block at attempt %d", i+1)
+				require.Zero(t, timeout)
+			}
+		})
+	}
+}
+
+func TestRateLimitBypassDoesNotCoverOthers(t *testing.T) {
+	rl := newBypassingRateLimiter(t, &mockClock{time: time.Now()})
+
+	for i := range 5 {
+		allow, _ := rl.Allow(t.Context(), "198.51.100.3", fmt.Sprintf("user%d@example.com", i))
+		require.True(t, allow)
+	}
+	allow, _ := rl.Allow(t.Context(), "198.51.100.3", "user@test.example.org")
+	require.False(t, allow, "the wildcard must not cover the apex domain")
+}
+
+func TestRateLimitBypassIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	rl := newBypassingRateLimiter(t, &mockClock{time: time.Now()})
+	rl.Allow(t.Context(), "192.0.2.10", "user@example.com")
+
+	require.Contains(t, buf.String(), "ratelimit: bypassed")
+	require.Contains(t, buf.String(), "ip in 192.0.2.0/24")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"backend/internal/core"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Spraying many addresses at one domain from many IPs must hit the per-domain
+// limit even though neither the email nor the IP limit is reached.
+func TestRateLimiterDomainLimit(t *testing.T) {
+	clock := &mockClock{time: time.Now()}
+	rl := newTestRateLimiter(clock)
+	rl.Domain = core.NewInMemoryRateLimiter(clock, core.RateLimitingPolicy{Window: 30 * time.Minute, Limit: 3})
+
+	for i := range 3 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("198.51.100.%d", i+1), fmt.Sprintf("victim%d@example.com", i))
+		require.Truef(t, allow, "unexpected block at attempt %d", i+1)
+	}
+
+	allow, timeout := rl.Allow(t.Context(), "198.51.100.99", "victim99@example.com")
+	require.False(t, allow, "expected the domain limit to block the 4th address")
+	require.Positive(t, timeout)
+
+	// Other domains are unaffected.
+	allow, _ = rl.Allow(t.Context(), "198.51.100.100", "someone@example.org")
+	require.True(t, allow)
+}
+
+func TestRateLimiterWithoutDomainLimit(t *testing.T) {
+	rl := newTestRateLimiter(&mockClock{time: time.Now()})
+
+	for i := range 20 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("198.51.100.%d", i+1), fmt.Sprintf("user%d@example.com", i))
+		require.True(t, allow)
+	}
+}
+
+func TestRateLimiterReportsRejectingDimension(t *testing.T) {
+	clock := &mockClock{time: time.Now()}
+	rl := newTestRateLimiter(clock)
+	rl.Domain = core.NewInMemoryRateLimiter(clock, core.RateLimitingPolicy{Window: 30 * time.Minute, Limit: 1})
+	var rejected []string
+	rl.OnReject = func(dimension string) { rejected = append(rejected, dimension) }
+
+	allow, _ := rl.Allow(t.Context(), "198.51.100.1", "first@example.com")
+	require.True(t, allow)
+	allow, _ = rl.Allow(t.Context(), "198.51.100.2", "second@example.com")
+	require.False(t, allow)
+	require.Equal(t, []string{core.DimensionDomain}, rejected)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"backend/internal/config"
 	"backend/internal/core"
+	"backend/internal/logging"
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,7 +22,7 @@ func TestInMemoryRateLimiterEviction(t *testing.T) {
 	rl := core.NewInMemoryRateLimiter(clock, policy)
 
 	for i := range 100 {
-		_, _, _ = rl.Allow(fmt.Sprintf("ip:%d", i))
+		_, _, _ = rl.Allow(t.Context(), fmt.Sprintf("ip:%d", i))
 	}
 	if got := rl.Len(); got != 100 {
 		t.Fatalf("expected 100 tracked keys, got %d", got)
@@ -38,7 +42,7 @@ func TestInMemoryRateLimiterEviction(t *testing.T) {
 	}
 
 	// A request after eviction starts a fresh window and is allowed again.
-	allow, _, err := rl.Allow("ip:0")
+	allow, _, err := rl.Allow(t.Context(), "ip:0")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -58,7 +62,7 @@ func TestInMemoryThresholdBoundary(t *testing.T) {
 	rl := core.NewInMemoryRateLimiter(clock, policy)
 
 	for i := 1; i <= 3; i++ {
-		allow, _, err := rl.Allow("key")
+		allow, _, err := rl.Allow(t.Context(), "key")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -67,7 +71,7 @@ func TestInMemoryThresholdBoundary(t *testing.T) {
 		}
 	}
 
-	allow, timeout, err := rl.Allow("key")
+	allow, timeout, err := rl.Allow(t.Context(), "key")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -88,9 +92,9 @@ func TestInMemoryWindowResetCountsCurrentRequest(t *testing.T) {
 	rl := core.NewInMemoryRateLimiter(clock, policy)
 
 	// Exhaust the first window: 2 allowed, 3rd blocked.
-	_, _, _ = rl.Allow("key")
-	_, _, _ = rl.Allow("key")
-	if allow, _, _ := rl.Allow("key"); allow {
+	_, _, _ = rl.Allow(t.Context(), "key")
+	_, _, _ = rl.Allow(t.Context(), "key")
+	if allow, _, _ := rl.Allow(t.Context(), "key"); allow {
 		t.Fatal("expected 3rd request to be blocked in the first window")
 	}
 
@@ -99,13 +103,13 @@ func TestInMemoryWindowResetCountsCurrentRequest(t *testing.T) {
 
 	// The new window must allow exactly Limit requests, with the first
 	// (window-opening) request counted.
-	if allow, _, _ := rl.Allow("key"); !allow {
+	if allow, _, _ := rl.Allow(t.Context(), "key"); !allow {
 		t.Fatal("expected 1st request of the new window to be allowed")
 	}
-	if allow, _, _ := rl.Allow("key"); !allow {
+	if allow, _, _ := rl.Allow(t.Context(), "key"); !allow {
 		t.Fatal("expected 2nd request of the new window to be allowed")
 	}
-	if allow, _, _ := rl.Allow("key"); allow {
+	if allow, _, _ := rl.Allow(t.Context(), "key"); allow {
 		t.Fatal("expected 3rd request of the new window to be blocked")
 	}
 }
@@ -133,11 +137,11 @@ func TestRedisAndInMemoryAgreeOnThreshold(t *testing.T) {
 	allowedInMem := 0
 	allowedRedis := 0
 	for i := 1; i <= limit+3; i++ {
-		memAllow, _, memErr := inMem.Allow("key")
+		memAllow, _, memErr := inMem.Allow(t.Context(), "key")
 		if memErr != nil {
 			t.Fatalf("in-memory error at request %d: %v", i, memErr)
 		}
-		redisAllow, _, redisErr := redisRL.Allow("key")
+		redisAllow, _, redisErr := redisRL.Allow(t.Context(), "key")
 		if redisErr != nil {
 			t.Fatalf("redis error at request %d: %v", i, redisErr)
 		}
@@ -160,3 +164,26 @@ func TestRedisAndInMemoryAgreeOnThreshold(t *testing.T) {
 		t.Fatalf("expected redis to allow exactly %d requests, allowed %d", limit, allowedRedis)
 	}
 }
+
+// TestRedisRateLimiterLogsRequestID checks that a Redis failure is logged
+// with the ID of the request that ran into it.
+func TestRedisRateLimiterLogsRequestID(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = client.Close() }()
+
+	var buf bytes.Buffer
+	policy := core.RateLimitingPolicy{Window: 30 * time.Minute, Limit: 5}
+	email := core.NewRedisRateLimiter(client, "test", policy)
+	email.Logger = logging.New(config.LoggingConfig{}, &buf)
+	rl := core.NewTotalRateLimiter(email, core.NewInMemoryRateLimiter(&mockClock{time: time.Now()}, policy))
+
+	mr.SetError("READONLY")
+	allow, _ := rl.Allow(logging.WithRequestID(t.Context(), "req-7"), "192.0.2.1", "user@example.com")
+	if allow {
+		t.Fatal("expected a Redis failure to block the request")
+	}
+	if log := buf.String(); !strings.Contains(log, "redis INCR failed") || !strings.Contains(log, "request_id=req-7") {
+		t.Fatalf("expected the failure to be logged with the request ID, got:\n%s", log)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"backend/internal/config"
+	"backend/internal/core"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newAggregatingRateLimiter(clock core.Clock, v4, v6 int) *core.TotalRateLimiter {
+	rl := newTestRateLimiter(clock)
+	rl.IPAggregation = core.IPAggregation{IPv4Prefix: v4, IPv6Prefix: v6}
+	return rl
+}
+
+// Rotating through addresses of the same IPv6 /64 must not bypass the per-IP
+// limit (5 in newTestRateLimiter).
+func TestRateLimiterAggregatesIPv6Prefix(t *testing.T) {
+	rl := newAggregatingRateLimiter(&mockClock{time: time.Now()}, 32, 64)
+
+	for i := range 5 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("2001:db8:1:2::%x", i+1), fmt.Sprintf("user%d@example.com", i))
+		require.Truef(t, allow, "unexpected block at attempt %d", i+1)
+	}
+
+	allow, _ := rl.Allow(t.Context(), "2001:db8:1:2:ffff:ffff:ffff:ffff", "other@example.com")
+	require.False(t, allow, "expected a new address in the same /64 to share the limit")
+
+	// A different /64 has its own counter.
+	allow, _ = rl.Allow(t.Context(), "2001:db8:1:3::1", "other@example.com")
+	require.True(t, allow)
+}
+
+func TestRateLimiterAggregatesIPv4Prefix(t *testing.T) {
+	rl := newAggregatingRateLimiter(&mockClock{time: time.Now()}, 24, 64)
+
+	for i := range 5 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("198.51.100.%d", i+1), fmt.Sprintf("user%d@example.com", i))
+		require.True(t, allow)
+	}
+
+	allow, _ := rl.Allow(t.Context(), "198.51.100.200", "other@example.com")
+	require.False(t, allow, "expected the /24 to share one counter")
+
+	allow, _ = rl.Allow(t.Context(), "198.51.101.1", "other@example.com")
+	require.True(t, allow)
+}
+
+// Without aggregation the exact address is still the key, so existing
+// deployments keep their behaviour.
+func TestRateLimiterWithoutAggregationKeysOnAddress(t *testing.T) {
+	rl := newTestRateLimiter(&mockClock{time: time.Now()})
+
+	for i := range 10 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("2001:db8::%x", i+1), fmt.Sprintf("user%d@example.com", i))
+		require.True(t, allow)
+	}
+}
+
+// IPv4-mapped IPv6 and the plain IPv4 spelling of an address must share a key.
+func TestRateLimiterTreatsMappedIPv4AsIPv4(t *testing.T) {
+	rl := newAggregatingRateLimiter(&mockClock{time: time.Now()}, 32, 64)
+
+	for i := range 5 {
+		allow, _ := rl.Allow(t.Context(), "203.0.113.7", fmt.Sprintf("user%d@example.com", i))
+		require.True(t, allow)
+	}
+
+	allow, _ := rl.Allow(t.Context(), "::ffff:203.0.113.7", "other@example.com")
+	require.False(t, allow)
+}
+
+func TestRateLimiterPrefixLimitOverridesIPLimit(t *testing.T) {
+	clock := &mockClock{time: time.Now()}
+	rl := newAggregatingRateLimiter(clock, 32, 64)
+
+	nat, err := config.ParseCIDR("100.64.0.0/10")
+	require.NoError(t, err)
+	natOffice, err := config.ParseCIDR("100.64.1.0/24")
+	require.NoError(t, err)
+
+	policy := func(limit int) core.RateLimitingPolicy {
+		return core.RateLimitingPolicy{Window: 30 * time.Minute, Limit: limit}
+	}
+	rl.IPPrefixLimits = []core.IPPrefixLimit{
+		{Network: nat, Limiter: core.NewInMemoryRateLimiter(clock, policy(20))},
+		{Network: natOffice, Limiter: core.NewInMemoryRateLimiter(clock, policy(2))},
+	}
+
+	// The whole NAT range shares one counter with the larger limit, well past
+	// the regular per-IP limit of 5, even when every request uses another
+	// address.
+	for i := range 20 {
+		allow, _ := rl.Allow(t.Context(), fmt.Sprintf("100.64.2.%d", i+1), fmt.Sprintf("nat%d@example.com", i))
+		require.Truef(t, allow, "unexpected block at attempt %d", i+1)
+	}
+	allow, _ := rl.Allow(t.Context(), "100.127.0.1", "natx@example.com")
+	require.False(t, allow, "expected the NAT range limit to be shared")
+
+	// The most specific range wins.
+	for i := range 2 {
+		allow, _ := rl.Allow(t.Context(), "100.64.1.9", fmt.Sprintf("office%d@example.com", i))
+		require.True(t, allow)
+	}
+	allow, _ = rl.Allow(t.Context(), "100.64.1.10", "officex@example.com")
+	require.False(t, allow)
+
+	// Addresses outside every range use the regular per-IP limiter.
+	allow, _ = rl.Allow(t.Context(), "192.0.2.1", "outside@example.com")
+	require.True(t, allow)
+}
+
+func TestNormalizeIP(t *testing.T) {
+	require.Equal(t, "2001:db8::1", core.NormalizeIP("2001:DB8:0:0:0:0:0:1"))
+	require.Equal(t, "192.0.2.1", core.NormalizeIP("::ffff:192.0.2.1"))
+	require.Equal(t, "192.0.2.1", core.NormalizeIP(" 192.0.2.1 "))
+	require.Equal(t, "not-an-ip", core.NormalizeIP("not-an-ip"))
+}
@@ -14,7 +14,7 @@ import (
 func exhaust(t *testing.T, rl core.RateLimiter, key string) {
 	t.Helper()
 	for range 100 {
-		allow, _, err := rl.Allow(key)
+		allow, _, err := rl.Allow(t.Context(), key)
 		require.NoError(t, err)
 		if !allow {
 			return
@@ -30,13 +30,13 @@ func TestInMemoryRateLimiterReset(t *testing.T) {
 	key := "email:locked@example.com"
 	exhaust(t, rl, key)
 
-	allow, _, err := rl.Allow(key)
+	allow, _, err := rl.Allow(t.Context(), key)
 	require.NoError(t, err)
 	require.False(t, allow, "expected key to be blocked before reset")
 
-	require.NoError(t, rl.Reset(key))
+	require.NoError(t, rl.Reset(t.Context(), key))
 
-	allow, _, err = rl.Allow(key)
+	allow, _, err = rl.Allow(t.Context(), key)
 	require.NoError(t, err)
 	require.True(t, allow, "expected key to be allowed after reset")
 }
@@ -44,7 +44,7 @@ func TestInMemoryRateLimiterReset(t *testing.T) {
 func TestInMemoryRateLimiterResetUnknownKeyIsNoOp(t *testing.T) {
 	policy := core.RateLimitingPolicy{Limit: 5, Window: 30 * time.Minute}
 	rl := core.NewInMemoryRateLimiter(&mockClock{time: time.Now()}, policy)
-	require.NoError(t, rl.Reset("email:never-seen@example.com"))
+	require.NoError(t, rl.Reset(t.Context(), "email:never-seen@example.com"))
 }
 
 func TestTotalRateLimiterResetEmail(t *testing.T) {
@@ -57,15 +57,15 @@ func TestTotalRateLimiterResetEmail(t *testing.T) {
 	// Exhaust the per-email limit (10) from many different IPs so the IP limit
 	// (5) is not what blocks us.
 	for i := range 11 {
-		rl.Allow("198.51.100."+string(rune('0'+i%10)), email)
+		rl.Allow(t.Context(), "198.51.100."+string(rune('0'+i%10)), email)
 	}
 
-	allow, _ := rl.Allow(ip, email)
+	allow, _ := rl.Allow(t.Context(), ip, email)
 	require.False(t, allow, "expected email to be rate-limited before reset")
 
-	require.NoError(t, rl.ResetEmail(email))
+	require.NoError(t, rl.ResetEmail(t.Context(), email))
 
-	allow, _ = rl.Allow(ip, email)
+	allow, _ = rl.Allow(t.Context(), ip, email)
 	require.True(t, allow, "expected email to be allowed after reset")
 }
 
@@ -88,13 +88,13 @@ func TestRedisRateLimiterReset(t *testing.T) {
 	key := "email:locked@example.com"
 	exhaust(t, rl, key)
 
-	allow, _, err := rl.Allow(key)
+	allow, _, err := rl.Allow(t.Context(), key)
 	require.NoError(t, err)
 	require.False(t, allow, "expected key to be blocked before reset")
 
-	require.NoError(t, rl.Reset(key))
+	require.NoError(t, rl.Reset(t.Context(), key))
 
-	allow, _, err = rl.Allow(key)
+	allow, _, err = rl.Allow(t.Context(), key)
 	require.NoError(t, err)
 	require.True(t, allow, "expected key to be allowed after reset")
 }
@@ -115,14 +115,14 @@ func TestTotalRateLimiterResetEmailRedis(t *testing.T) {
 
 	addr := "locked@example.com"
 	for range 6 {
-		rl.Allow("203.0.113.7", addr)
+		rl.Allow(t.Context(), "203.0.113.7", addr)
 	}
 
-	allow, _ := rl.Allow("203.0.113.7", addr)
+	allow, _ := rl.Allow(t.Context(), "203.0.113.7", addr)
 	require.False(t, allow, "expected email to be rate-limited before reset")
 
-	require.NoError(t, rl.ResetEmail(addr))
+	require.NoError(t, rl.ResetEmail(t.Context(), addr))
 
-	allow, _ = rl.Allow("203.0.113.7", addr)
+	allow, _ = rl.Allow(t.Context(), "203.0.113.7", addr)
 	require.True(t, allow, "expected email to be allowed after reset")
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"backend/internal/core"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// statusBackends returns an in-memory and a Redis limiter with the same policy,
+// so the Status/ListBlocked contract can be checked against both.
+func statusBackends(t *testing.T, policy core.RateLimitingPolicy) map[string]core.RateLimiter {
+	t.Helper()
+	return map[string]core.RateLimiter{
+		"inmemory": core.NewInMemoryRateLimiter(&mockClock{time: time.Now()}, policy),
+		"redis":    newRedisTestLimiter(t, "yivi", policy),
+	}
+}
+
+func TestRateLimiterStatus(t *testing.T) {
+	policy := core.RateLimitingPolicy{Limit: 2, Window: 30 * time.Minute}
+	for name, rl := range statusBackends(t, policy) {
+		t.Run(name, func(t *testing.T) {
+			status, err := rl.Status(t.Context(), "ip:192.0.2.1")
+			require.NoError(t, err)
+			require.Equal(t, core.RateLimitStatus{Key: "ip:192.0.2.1", Limit: 2}, status)
+
+			_, _, err = rl.Allow(t.Context(), "ip:192.0.2.1")
+			require.NoError(t, err)
+
+			status, err = rl.Status(t.Context(), "ip:192.0.2.1")
+			require.NoError(t, err)
+			require.Equal(t, 1, status.Count)
+			require.False(t, status.Blocked)
+			require.Positive(t, status.TTL)
+			require.LessOrEqual(t, status.TTL, 30*time.Minute)
+
+			// Status must not count as a request.
+			status, err = rl.Status(t.Context(), "ip:192.0.2.1")
+			require.NoError(t, err)
+			require.Equal(t, 1, status.Count)
+
+			exhaust(t, rl, "ip:192.0.2.1")
+			status, err = rl.Status(t.Context(), "ip:192.0.2.1")
+			require.NoError(t, err)
+			require.True(t, status.Blocked)
+		})
+	}
+}
+
+func TestRateLimiterListBlockedPaginates(t *testing.T) {
+	policy := core.RateLimitingPolicy{Limit: 1, Window: 30 * time.Minute}
+	for name, rl := range statusBackends(t, policy) {
+		t.Run(name, func(t *testing.T) {
+			want := map[string]bool{}
+			for i := range 7 {
+				key := fmt.Sprintf("ip:192.0.2.%d", i+1)
+				exhaust(t, rl, key)
+				want[key] = true
+			}
+			// Keys that are under the limit or in another dimension are not
+			// listed.
+			_, _, err := rl.Allow(t.Context(), "ip:198.51.100.1")
+			require.NoError(t, err)
+			exhaust(t, rl, "email:user@example.com")
+
+			got := map[string]bool{}
+			cursor := ""
+			for range 20 {
+				page, next, err := rl.ListBlocked(t.Context(), "ip:", cursor, 3)
+				require.NoError(t, err)
+				for _, status := range page {
+					require.True(t, status.Blocked)
+					require.False(t, got[status.Key], "key %s listed twice", status.Key)
+					got[status.Key] = true
+				}
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			require.Equal(t, want, got)
+		})
+	}
+}
+
+func TestTotalRateLimiterResetIP(t *testing.T) {
+	rl := newAggregatingRateLimiter(&mockClock{time: time.Now()}, 32, 64)
+
+	for i := range 5 {
+		rl.Allow(t.Context(), fmt.Sprintf("2001:db8::%x", i+1), fmt.Sprintf("user%d@example.com", i))
+	}
+	allow, _ := rl.Allow(t.Context(), "2001:db8::ff", "other@example.com")
+	require.False(t, allow, "expected the /64 to be blocked before reset")
+
+	status, err := rl.IPStatus(t.Context(), "2001:db8::1234")
+	require.NoError(t, err)
+	require.Equal(t, "ip:2001:db8::/64", status.Key)
+	require.True(t, status.Blocked)
+
+	// Resetting any address in the /64 unblocks the whole prefix.
+	require.NoError(t, rl.ResetIP(t.Context(), "2001:db8::1234"))
+	allow, _ = rl.Allow(t.Context(), "2001:db8::ff", "another@example.com")
+	require.True(t, allow, "expected the /64 to be allowed after reset")
+}
+
+func TestTotalRateLimiterListBlockedDimensions(t *testing.T) {
+	rl := newTestRateLimiter(&mockClock{time: time.Now()})
+
+	for i := range 6 {
+		rl.Allow(t.Context(), "192.0.2.1", fmt.Sprintf("user%d@example.com", i))
+	}
+
+	blocked, next, err := rl.ListBlocked(t.Context(), core.DimensionIP, "", 10)
+	require.NoError(t, err)
+	require.Empty(t, next)
+	require.Len(t, blocked, 1)
+	require.Equal(t, "ip:192.0.2.1", blocked[0].Key)
+
+	blocked, _, err = rl.ListBlocked(t.Context(), core.DimensionEmail, "", 10)
+	require.NoError(t, err)
+	require.Empty(t, blocked)
+
+	// Without a domain limiter the domain dimension is simply empty.
+	blocked, _, err = rl.ListBlocked(t.Context(), core.DimensionDomain, "", 10)
+	require.NoError(t, err)
+	require.Empty(t, blocked)
+
+	_, _, err = rl.ListBlocked(t.Context(), "bogus", "", 10)
+	require.Error(t, err)
+}
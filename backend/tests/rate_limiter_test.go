@@ -15,14 +15,14 @@ func TestRateLimiterWithSameIPandEmail(t *testing.T) {
 
 	// First 5 should pass
 	for i := range 5 {
-		allow, _ := rl.Allow(ip, email)
+		allow, _ := rl.Allow(t.Context(), ip, email)
 		if !allow {
 			t.Fatalf("unexpected fail at attempt %d", i+1)
 		}
 	}
 
 	// 6th should fail, since IP limit is 5 and Email limit is 10
-	allow, timeout := rl.Allow(ip, email)
+	allow, timeout := rl.Allow(t.Context(), ip, email)
 	if allow {
 		t.Fatal("expected to fail at 6th attempt")
 	}
@@ -44,14 +44,14 @@ func TestRateLimiterWithDifferentEmails(t *testing.T) {
 
 	// 5 different emails with the same IP allowed
 	for i, email := range emails {
-		allow, _ := rl.Allow(ip, email)
+		allow, _ := rl.Allow(t.Context(), ip, email)
 		if !allow {
 			t.Fatalf("unexpected fail at attempt %d", i+1)
 		}
 	}
 
 	// 6th  different email from the same IP should fail
-	allow, _ := rl.Allow(ip, "test5@email.com")
+	allow, _ := rl.Allow(t.Context(), ip, "test5@email.com")
 	if allow {
 		t.Fatal("expected to fail at 6th attempt")
 	}
@@ -66,12 +66,12 @@ func TestRateLimiterWindowReset(t *testing.T) {
 	email := "test@email.com"
 
 	for range 5 {
-		rl.Allow(ip, email)
+		rl.Allow(t.Context(), ip, email)
 	}
 
 	clock.IncTime(31 * time.Minute)
 
-	allow, timeout := rl.Allow(ip, email)
+	allow, timeout := rl.Allow(t.Context(), ip, email)
 	if !allow {
 		t.Fatalf("expected the new window, got timeout %v minutes", timeout.Minutes())
 	}
@@ -100,14 +100,14 @@ func TestRateLimiterDifferentIPs(t *testing.T) {
 
 	// 10 different IPs with same email
 	for i, ip := range ips {
-		allow, _ := rl.Allow(ip, testemail)
+		allow, _ := rl.Allow(t.Context(), ip, testemail)
 		if !allow {
 			t.Fatalf("unexpected fail at attempt %d", i+1)
 		}
 	}
 
 	// 11th attempt with same email should fail
-	allow, _ := rl.Allow("127.0.0.11", testemail)
+	allow, _ := rl.Allow(t.Context(), "127.0.0.11", testemail)
 	if allow {
 		t.Fatal("expected to fail at 11th attempt")
 	}
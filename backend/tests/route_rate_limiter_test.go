@@ -0,0 +1,62 @@
+package main
+
+import (
+	"backend/internal/core"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouteLimiter(clock core.Clock) *core.RouteRateLimiter {
+	policy := core.RateLimitingPolicy{Window: 15 * time.Minute, Limit: 3}
+	return core.NewRouteRateLimiter(map[string]core.RateLimiter{
+		"/api/verify":      core.NewInMemoryRateLimiter(clock, policy),
+		"/api/verify-link": core.NewInMemoryRateLimiter(clock, policy),
+	}, core.IPAggregation{IPv4Prefix: 32, IPv6Prefix: 64})
+}
+
+func TestRouteRateLimiterBlocksAfterLimit(t *testing.T) {
+	clock := &mockClock{time: time.Now()}
+	rl := newTestRouteLimiter(clock)
+
+	for i := range 3 {
+		allow, _ := rl.Allow(t.Context(), "/api/verify", "192.0.2.1")
+		require.Truef(t, allow, "unexpected block at attempt %d", i+1)
+	}
+	allow, timeout := rl.Allow(t.Context(), "/api/verify", "192.0.2.1")
+	require.False(t, allow)
+	require.Positive(t, timeout)
+
+	// Routes and clients are counted separately.
+	allow, _ = rl.Allow(t.Context(), "/api/verify-link", "192.0.2.1")
+	require.True(t, allow)
+	allow, _ = rl.Allow(t.Context(), "/api/verify", "192.0.2.2")
+	require.True(t, allow)
+
+	// The window expires.
+	clock.IncTime(16 * time.Minute)
+	allow, _ = rl.Allow(t.Context(), "/api/verify", "192.0.2.1")
+	require.True(t, allow)
+}
+
+func TestRouteRateLimiterAggregatesIPv6(t *testing.T) {
+	rl := newTestRouteLimiter(&mockClock{time: time.Now()})
+
+	for i := range 3 {
+		allow, _ := rl.Allow(t.Context(), "/api/verify", fmt.Sprintf("2001:db8::%x", i+1))
+		require.True(t, allow)
+	}
+	allow, _ := rl.Allow(t.Context(), "/api/verify", "2001:db8::ffff")
+	require.False(t, allow, "expected addresses in the same /64 to share the route limit")
+}
+
+func TestRouteRateLimiterIgnoresUnconfiguredRoutes(t *testing.T) {
+	rl := newTestRouteLimiter(&mockClock{time: time.Now()})
+
+	for range 10 {
+		allow, _ := rl.Allow(t.Context(), "/api/health", "192.0.2.1")
+		require.True(t, allow)
+	}
+}
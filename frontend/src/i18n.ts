@@ -34,6 +34,10 @@ i18n
           error_email_unknown_domain:
             "The domain of this email address does not seem to exist. Please check for typos (for example 'gmail.com' instead of 'gemail.com').",
           error_email_format_lowercase: "Email address must be in lowercase.",
+          error_email_domain_not_allowed:
+            "Email addresses at this domain cannot be added. Please use another email address.",
+          error_email_domain_blocked:
+            "Email addresses at this domain are not accepted. Please use another email address.",
           error_internal:
             "Internal error. Please contact Yivi if this happens more often.",
           error_sending_email:
@@ -65,6 +69,10 @@ i18n
             "Unfortunately, it was not possible to add this email address to the Yivi app.",
           enter_verification_code: "Enter verification code",
           error_invalid_token: "The verification code is invalid.",
+          error_session_mismatch:
+            "Please open the verification link or enter the code in the browser where you requested it.",
+          error_starting_session:
+            "The Yivi session could not be started. Please try again.",
           done_header: "Email address added",
           thank_you: "Thank you for using Yivi, you can close this page now.",
           again: "Add another email address",
@@ -93,6 +101,10 @@ i18n
           error_email_unknown_domain:
             "Het domein van dit emailadres lijkt niet te bestaan. Controleer op typefouten (bijvoorbeeld 'gmail.com' in plaats van 'gemail.com').",
           error_email_format_lowercase: "Emailadres moet in kleine letters zijn.",
+          error_email_domain_not_allowed:
+            "Emailadressen van dit domein kunnen niet worden toegevoegd. Gebruik een ander emailadres.",
+          error_email_domain_blocked:
+            "Emailadressen van dit domein worden niet geaccepteerd. Gebruik een ander emailadres.",
           error_internal:
             "Interne fout. Neem contact op met Yivi als dit vaker voorkomt.",
           error_sending_email:
@@ -125,6 +137,10 @@ i18n
           email_add_error:
             "Het is helaas niet gelukt dit emailadres toe te voegen aan de Yivi-app.",
           error_invalid_token: "De verificatiecode is ongeldig.",
+          error_session_mismatch:
+            "Open de verificatielink of voer de code in via de browser waarin u deze heeft aangevraagd.",
+          error_starting_session:
+            "De Yivi-sessie kon niet worden gestart. Probeer het opnieuw.",
           done_header: "Emailadres toegevoegd",
           thank_you:
             "Bedankt voor het gebruik van Yivi, u kunt deze pagina nu sluiten.",
@@ -4,11 +4,17 @@ import { useAppContext } from "../AppContext";
 import i18n from "../i18n";
 import { useEffect, useRef, useState } from "react";
 type VerifyResponse = {
-  jwt: string;
-  irma_server_url: string;
+  // Either the signed request, which the frontend posts to the IRMA server
+  // itself, or (with server_side_session) the session the backend started.
+  jwt?: string;
+  irma_server_url?: string;
+  session_ptr?: object;
+  frontend_request?: object;
   // Only present on the verification-link flow: the email is resolved
   // server-side from the opaque token and returned here so issuance can finish.
   email?: string;
+  // Authorizes the cleanup call to /api/done for this verification.
+  done_token?: string;
 };
 
 export default function EnrollPage() {
@@ -37,22 +43,32 @@ export default function EnrollPage() {
     }
   }, [location.state]);
   // Launch the Yivi issuance popup for a verified email and clean up afterwards.
-  const startIssuance = (res: VerifyResponse, emailForCleanup: string) => {
+  const startIssuance = (res: VerifyResponse) => {
     import("@privacybydesign/yivi-frontend")
       .then((yivi) => {
+        const session = res.session_ptr
+          ? {
+              start: false,
+              mapping: {
+                sessionPtr: () => res.session_ptr,
+                frontendRequest: () => res.frontend_request,
+              },
+              result: false,
+            }
+          : {
+              url: res.irma_server_url,
+              start: {
+                method: "POST",
+                headers: {
+                  "Content-Type": "text/plain",
+                },
+                body: res.jwt,
+              },
+              result: false,
+            };
         const issuance = yivi.newPopup({
           language: i18n.language,
-          session: {
-            url: res.irma_server_url,
-            start: {
-              method: "POST",
-              headers: {
-                "Content-Type": "text/plain",
-              },
-              body: res.jwt,
-            },
-            result: false,
-          },
+          session: session,
         });
         issuance
           .start()
@@ -69,12 +85,15 @@ export default function EnrollPage() {
           });
       })
       .finally(() => {
+        if (!res.done_token) {
+          return;
+        }
         fetch("/api/done", {
           method: "POST",
           headers: {
             "Content-Type": "application/json",
           },
-          body: JSON.stringify({ email: emailForCleanup }),
+          body: JSON.stringify({ done_token: res.done_token }),
         });
       });
   };
@@ -109,7 +128,7 @@ export default function EnrollPage() {
 
       if (response.ok) {
         const res: VerifyResponse = await response.json();
-        startIssuance(res, email);
+        startIssuance(res);
         return;
       }
       await handleVerifyError(response);
@@ -139,7 +158,7 @@ export default function EnrollPage() {
         if (res.email) {
           setEmail(res.email);
         }
-        startIssuance(res, res.email ?? "");
+        startIssuance(res);
         return;
       }
       await handleVerifyError(response);